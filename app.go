@@ -3,10 +3,13 @@ package prate
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
@@ -25,6 +28,20 @@ type App struct {
 	middlewares []*Middleware
 	mwareIndex  map[string]int
 	epCache     []epInit
+
+	deadlineHeader    string
+	maxHandlerTimeout time.Duration
+
+	readyHooks []func(context.Context) error
+	// Guards readyRun, the number of hooks that succeeded
+	readyMu    sync.Mutex
+	readyRun   int
+	ready      atomic.Bool
+	draining   atomic.Bool
+	drainDelay time.Duration
+
+	cache      *responseCache
+	operations *operations
 }
 
 // Conforms with the type accepted by the panic handler of httprouter
@@ -43,6 +60,14 @@ type AppOptions struct {
 	ErrorLog          *log.Logger
 	BaseContext       func(net.Listener) context.Context
 	ConnContext       func(ctx context.Context, c net.Conn) context.Context
+
+	// Header clients use to ask for a shorter handler deadline. The
+	// value is either milliseconds ("1500") or a Go duration ("1.5s").
+	// Defaults to X-Request-Timeout.
+	DeadlineHeader string
+	// Upper bound for handler deadlines requested by clients on
+	// endpoints without a timeout of their own. Zero means unbounded.
+	MaxHandlerTimeout time.Duration
 }
 
 func (ao AppOptions) server() *http.Server {
@@ -171,6 +196,11 @@ func New(ao AppOptions) (*App, error) {
 	app.router = newRouter()
 	app.Handler = app.router
 	app.mwareIndex = map[string]int{}
+	app.deadlineHeader = HeaderXRequestTimeout
+	if ao.DeadlineHeader != "" {
+		app.deadlineHeader = ao.DeadlineHeader
+	}
+	app.maxHandlerTimeout = ao.MaxHandlerTimeout
 	app.FromServer(server)
 	return app, nil
 }
@@ -196,6 +226,9 @@ func errorHandler(rc *RequestCtx, err error) error {
 	code := StatusInternalServerError
 	if e, ok := err.(*Error); ok {
 		code = e.Code
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		err = NewError(StatusGatewayTimeout)
+		code = StatusGatewayTimeout
 	}
 	rc.ResponseWriter.WriteHeader(code)
 	if _, err := rc.ResponseWriter.Write([]byte(err.Error())); err != nil {
@@ -204,11 +237,20 @@ func errorHandler(rc *RequestCtx, err error) error {
 	return nil
 }
 
-// Called before listen
+// Called before listen. Each step wraps the handler built so far, so
+// later steps run first: middlewares, then patching, so policies
+// judge the patched body, then policies, and around the handler
+// itself coalescing and pagination, so policies and middlewares
+// still run for every request.
 func (app *App) mountEndpoints() {
 	for _, v := range app.epCache {
+		v.ec.applyPagination()
+		v.ec.applyCoalescing()
+		v.ec.applyPolicies()
+		v.ec.applyPatching()
 		v.ec.applyMiddlerwares(app.middlewares)
 		ep := v.ec.endpoint()
+		ep.app = app
 		ep.handle(v.f)
 	}
 }
@@ -362,6 +404,7 @@ func (app *App) Start() error {
 	}
 	tlsListener := tls.NewListener(conn, app.TLSConfig)
 	log.Println("Listening at: ", tlsListener.Addr())
+	go app.runReadyHooks(context.Background())
 	if err := app.Serve(tlsListener); err != nil {
 		return wrapErr(err)
 	}
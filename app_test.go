@@ -6,6 +6,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/daimaou92/prate/pb/fortest"
@@ -383,3 +384,10 @@ func TestStart(t *testing.T) {
 		})
 	}
 }
+
+// Serves r on an App whose endpoints have already been mounted
+func testServe(app *App, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	return w
+}
@@ -0,0 +1,254 @@
+package prate
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Returned by an Authenticator when the request carries no
+// credentials meant for it. The next Authenticator is tried.
+var ErrNoCredentials = errors.New("no credentials")
+
+// The authenticated caller of a request
+type Principal struct {
+	Subject string
+	// Scheme of the Authenticator that produced the Principal,
+	// for example "Bearer", "Basic" or "APIKey"
+	Scheme string
+	Roles  []string
+	Scopes []string
+	Claims map[string]interface{}
+}
+
+func (p *Principal) HasRole(role string) bool {
+	if p == nil {
+		return false
+	}
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	if p == nil {
+		return false
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Extracts and verifies credentials from a request
+type Authenticator interface {
+	// Returns ErrNoCredentials if the request has no credentials
+	// for this scheme. Any other error means the credentials were
+	// present but invalid.
+	Authenticate(*RequestCtx) (*Principal, error)
+	// Value of the WWW-Authenticate header sent along a 401
+	Challenge() string
+}
+
+type AuthMode int
+
+const (
+	// Inherit the mode set in AuthOptions
+	AuthDefault AuthMode = iota
+	// Requests without valid credentials get a 401
+	AuthRequired
+	// Credentials are verified when present. Anonymous requests
+	// reach the handler with a nil Principal.
+	AuthOptional
+	// Credentials are ignored
+	AuthNone
+)
+
+type AuthOptions struct {
+	// Tried in order. The first one that does not return
+	// ErrNoCredentials decides the outcome.
+	Authenticators []Authenticator
+	// Mode for endpoints that don't declare one. Defaults to AuthRequired.
+	Mode AuthMode
+}
+
+// Returns a middleware with ID "auth". The Principal is made available
+// through RequestCtx.Principal. Endpoints choose whether authentication
+// is required with EndpointConfig.WithAuth.
+func Authentication(opts AuthOptions) *Middleware {
+	if opts.Mode == AuthDefault {
+		opts.Mode = AuthRequired
+	}
+	return &Middleware{
+		ID: "auth",
+		Handler: func(h Handler) Handler {
+			return func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+				mode := opts.Mode
+				if rc.endpoint != nil && rc.endpoint.config.Auth != AuthDefault {
+					mode = rc.endpoint.config.Auth
+				}
+				if mode == AuthNone {
+					return h(rc, rd)
+				}
+
+				for _, a := range opts.Authenticators {
+					p, err := a.Authenticate(rc)
+					if errors.Is(err, ErrNoCredentials) {
+						continue
+					}
+					if err != nil || p == nil {
+						return nil, unauthorized(rc, opts.Authenticators, "invalid credentials")
+					}
+					rc.principal = p
+					return h(rc, rd)
+				}
+
+				if mode == AuthRequired {
+					return nil, unauthorized(rc, opts.Authenticators, "authentication required")
+				}
+				return h(rc, rd)
+			}
+		},
+	}
+}
+
+func unauthorized(rc *RequestCtx, as []Authenticator, msg string) error {
+	for _, a := range as {
+		if c := a.Challenge(); c != "" {
+			rc.ResponseWriter.Header().Add(HeaderWWWAuthenticate, c)
+		}
+	}
+	return NewError(StatusUnauthorized, msg)
+}
+
+// Splits an Authorization header of the given scheme.
+// The scheme comparison is case insensitive.
+func authorizationCredentials(r *http.Request, scheme string) (string, bool) {
+	v := r.Header.Get(HeaderAuthorization)
+	if len(v) <= len(scheme) || !strings.EqualFold(v[:len(scheme)], scheme) || v[len(scheme)] != ' ' {
+		return "", false
+	}
+	return strings.TrimSpace(v[len(scheme)+1:]), true
+}
+
+type APIKeyOptions struct {
+	// Header carrying the key. Defaults to "X-API-Key".
+	Header string
+	// Optional query parameter checked when the header is absent
+	QueryParam string
+	// Static keys and the Principal each one maps to
+	Keys map[string]*Principal
+	// Called for keys not found in Keys. Returning a nil Principal
+	// rejects the key.
+	Verify func(ctx context.Context, key string) (*Principal, error)
+}
+
+type APIKeyAuthenticator struct {
+	opts APIKeyOptions
+	// Static keys are looked up by digest so lookups don't
+	// leak key prefixes through timing.
+	keys map[[sha256.Size]byte]*Principal
+}
+
+func NewAPIKeyAuthenticator(opts APIKeyOptions) *APIKeyAuthenticator {
+	if opts.Header == "" {
+		opts.Header = "X-API-Key"
+	}
+	a := &APIKeyAuthenticator{
+		opts: opts,
+		keys: map[[sha256.Size]byte]*Principal{},
+	}
+	for k, p := range opts.Keys {
+		a.keys[sha256.Sum256([]byte(k))] = p
+	}
+	return a
+}
+
+func (a *APIKeyAuthenticator) Authenticate(rc *RequestCtx) (*Principal, error) {
+	key := rc.Request.Header.Get(a.opts.Header)
+	if key == "" && a.opts.QueryParam != "" {
+		key = rc.Request.URL.Query().Get(a.opts.QueryParam)
+	}
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+
+	if p, ok := a.keys[sha256.Sum256([]byte(key))]; ok {
+		return a.principal(p), nil
+	}
+	if a.opts.Verify != nil {
+		p, err := a.opts.Verify(rc.Context(), key)
+		if err != nil {
+			return nil, wrapErr(err)
+		}
+		if p != nil {
+			return a.principal(p), nil
+		}
+	}
+	return nil, wrapErr(fmt.Errorf("unknown api key"))
+}
+
+func (a *APIKeyAuthenticator) principal(p *Principal) *Principal {
+	c := *p
+	if c.Scheme == "" {
+		c.Scheme = "APIKey"
+	}
+	return &c
+}
+
+func (a *APIKeyAuthenticator) Challenge() string {
+	return fmt.Sprintf(`APIKey header="%s"`, a.opts.Header)
+}
+
+type BasicAuthenticator struct {
+	realm  string
+	verify func(ctx context.Context, user, password string) (*Principal, error)
+}
+
+// verify returns a nil Principal to reject the credentials
+func NewBasicAuthenticator(
+	realm string,
+	verify func(ctx context.Context, user, password string) (*Principal, error),
+) *BasicAuthenticator {
+	return &BasicAuthenticator{
+		realm:  realm,
+		verify: verify,
+	}
+}
+
+func (a *BasicAuthenticator) Authenticate(rc *RequestCtx) (*Principal, error) {
+	if _, ok := authorizationCredentials(rc.Request, "Basic"); !ok {
+		return nil, ErrNoCredentials
+	}
+	user, pass, ok := rc.Request.BasicAuth()
+	if !ok {
+		return nil, wrapErr(fmt.Errorf("malformed basic credentials"))
+	}
+	p, err := a.verify(rc.Context(), user, pass)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	if p == nil {
+		return nil, wrapErr(fmt.Errorf("invalid basic credentials"))
+	}
+	c := *p
+	c.Scheme = "Basic"
+	if c.Subject == "" {
+		c.Subject = user
+	}
+	return &c, nil
+}
+
+func (a *BasicAuthenticator) Challenge() string {
+	return fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, a.realm)
+}
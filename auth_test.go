@@ -0,0 +1,193 @@
+package prate
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/daimaou92/prate/pb/fortest"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func signTestJWT(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	enc := func(v interface{}) string {
+		bs, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(bs)
+	}
+	signed := enc(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + enc(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch alg {
+	case "HS256":
+		m := hmac.New(sha256.New, key.([]byte))
+		m.Write([]byte(signed))
+		sig = m.Sum(nil)
+	case "RS256":
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa1", "n": b64(rsaKey.N), "e": b64(big.NewInt(int64(rsaKey.E)))},
+			{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ecKey.X), "y": b64(ecKey.Y)},
+		},
+	})
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksFile, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("s3cr3t")
+	a, err := NewJWTAuthenticator(JWTOptions{
+		HMACSecret: secret,
+		JWKSFile:   jwksFile,
+		Issuer:     "prate",
+		Audience:   "api",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	valid := map[string]interface{}{
+		"sub": "u1", "iss": "prate", "aud": []string{"api"}, "exp": exp,
+		"scope": "orders:read orders:write", "roles": []string{"admin"},
+	}
+	tsts := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"HS256", signTestJWT(t, "HS256", "", secret, valid), true},
+		{"RS256", signTestJWT(t, "RS256", "rsa1", rsaKey, valid), true},
+		{"ES256", signTestJWT(t, "ES256", "ec1", ecKey, valid), true},
+		{"wrong kid", signTestJWT(t, "RS256", "ec1", rsaKey, valid), false},
+		{"bad secret", signTestJWT(t, "HS256", "", []byte("nope"), valid), false},
+		{"expired", signTestJWT(t, "HS256", "", secret, map[string]interface{}{
+			"sub": "u1", "iss": "prate", "aud": "api", "exp": float64(time.Now().Add(-time.Hour).Unix()),
+		}), false},
+		{"wrong audience", signTestJWT(t, "HS256", "", secret, map[string]interface{}{
+			"sub": "u1", "iss": "prate", "aud": "other", "exp": exp,
+		}), false},
+		{"malformed", "abc.def", false},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set(HeaderAuthorization, "Bearer "+tst.token)
+			p, err := a.Authenticate(&RequestCtx{Request: r})
+			if !tst.ok {
+				if err == nil {
+					t.Fatalf("wanted error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Subject != "u1" || !p.HasScope("orders:write") || !p.HasRole("admin") {
+				t.Fatalf("unexpected principal: %+v", p)
+			}
+		})
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		res := &fortest.TestRes{Key: "subject"}
+		if p := rc.Principal(); p != nil {
+			res.Value = p.Subject
+		}
+		return res, nil
+	}
+	app.GET(NewEndpointConfig("/private", h))
+	app.GET(NewEndpointConfig("/public", h).WithAuth(AuthOptional))
+	if err := app.Apply(Authentication(AuthOptions{
+		Authenticators: []Authenticator{
+			NewAPIKeyAuthenticator(APIKeyOptions{
+				Keys: map[string]*Principal{"key-1": {Subject: "svc"}},
+			}),
+			NewBasicAuthenticator("prate", func(_ context.Context, u, p string) (*Principal, error) {
+				if u == "alice" && p == "pw" {
+					return &Principal{}, nil
+				}
+				return nil, nil
+			}),
+		},
+	})); err != nil {
+		t.Fatal(err)
+	}
+	app.mountEndpoints()
+
+	tsts := []struct {
+		name   string
+		path   string
+		header func(*http.Request)
+		code   int
+	}{
+		{"anonymous private", "/private", func(*http.Request) {}, StatusUnauthorized},
+		{"anonymous public", "/public", func(*http.Request) {}, StatusOK},
+		{"api key", "/private", func(r *http.Request) { r.Header.Set("X-API-Key", "key-1") }, StatusOK},
+		{"bad api key", "/public", func(r *http.Request) { r.Header.Set("X-API-Key", "key-2") }, StatusUnauthorized},
+		{"basic", "/private", func(r *http.Request) { r.SetBasicAuth("alice", "pw") }, StatusOK},
+		{"bad basic", "/private", func(r *http.Request) { r.SetBasicAuth("alice", "no") }, StatusUnauthorized},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tst.path, nil)
+			tst.header(r)
+			w := testServe(app, r)
+			if w.Code != tst.code {
+				t.Fatalf("statuscode wanted: %d. got: %d", tst.code, w.Code)
+			}
+			if tst.code == StatusUnauthorized && len(w.Header().Values(HeaderWWWAuthenticate)) != 2 {
+				t.Fatalf("challenges wanted: 2. got: %v", w.Header().Values(HeaderWWWAuthenticate))
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package prate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+type BatchOptions struct {
+	// Defaults to "/batch"
+	Path string
+	// Sub-requests accepted in one batch. Defaults to 20.
+	MaxItems int
+	// Size of the whole batch request body. Defaults to 1MB.
+	MaxSize int64
+	// Sub-requests served at once. Defaults to 1, serving them
+	// one after the other.
+	Parallelism int
+	// Middlewares the batch endpoint itself skips. Sub-requests go
+	// through the middlewares of the endpoints they target.
+	ExcludeMiddlewares []string
+}
+
+// A sub-request. Body holds the payload exactly as it would be sent
+// to Path, usually protobuf, and travels base64 encoded in JSON.
+type BatchItem struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    []byte            `json:"body,omitempty"`
+}
+
+type BatchRequest struct {
+	Requests []BatchItem `json:"requests"`
+}
+
+// The response to a sub-request. Repeated headers are joined
+// with ", ".
+type BatchResult struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    []byte            `json:"body,omitempty"`
+}
+
+type BatchResponse struct {
+	// In the order of BatchRequest.Requests
+	Responses []BatchResult `json:"responses"`
+}
+
+func (br BatchRequest) Marshal() ([]byte, error) {
+	bs, err := json.Marshal(br)
+	if err != nil {
+		return nil, wrapErr(err, "json marshal failed")
+	}
+	return bs, nil
+}
+
+func (br *BatchRequest) Unmarshal(src []byte) error {
+	var t BatchRequest
+	if err := json.Unmarshal(src, &t); err != nil {
+		return wrapErr(err, "json unmarshal failed")
+	}
+	*br = t
+	return nil
+}
+
+func (BatchRequest) ContentType() ContentType {
+	return ContentTypeJSON
+}
+
+func (br BatchResponse) Marshal() ([]byte, error) {
+	bs, err := json.Marshal(br)
+	if err != nil {
+		return nil, wrapErr(err, "json marshal failed")
+	}
+	return bs, nil
+}
+
+func (br *BatchResponse) Unmarshal(src []byte) error {
+	var t BatchResponse
+	if err := json.Unmarshal(src, &t); err != nil {
+		return wrapErr(err, "json unmarshal failed")
+	}
+	*br = t
+	return nil
+}
+
+func (BatchResponse) ContentType() ContentType {
+	return ContentTypeJSON
+}
+
+// Headers of the batch request sub-requests don't inherit. The
+// conditional, range and idempotency headers describe one request,
+// not every request in the batch.
+var batchSkipHeaders = map[string]bool{
+	HeaderContentType:       true,
+	HeaderContentLength:     true,
+	HeaderContentEncoding:   true,
+	HeaderAccept:            true,
+	HeaderIfMatch:           true,
+	HeaderIfNoneMatch:       true,
+	HeaderIfModifiedSince:   true,
+	HeaderIfUnmodifiedSince: true,
+	HeaderIfRange:           true,
+	HeaderRange:             true,
+	HeaderIdempotencyKey:    true,
+	HeaderCacheControl:      true,
+}
+
+// Registers a POST endpoint serving many requests in one round trip.
+// The body is a BatchRequest as JSON, or as a protobuf encoded
+// google.protobuf.Struct of the same shape. Each sub-request is
+// dispatched through the router, and so through the full middleware
+// chain, with the headers of the batch request plus its own. The
+// BatchResponse is encoded like health reports: protobuf when the
+// client accepts it, JSON otherwise. A sub-request failing doesn't
+// fail the batch; its status tells.
+func (app *App) Batch(opts BatchOptions) error {
+	if app == nil || app.router == nil {
+		return wrapErr(fmt.Errorf("app not initialized"))
+	}
+	if opts.Path == "" {
+		opts.Path = "/batch"
+	}
+	opts.Path = "/" + strings.Trim(opts.Path, "/")
+	if opts.MaxItems <= 0 {
+		opts.MaxItems = 20
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = 1 << 20
+	}
+	if opts.Parallelism <= 0 {
+		opts.Parallelism = 1
+	}
+
+	app.POST(NewEndpointConfig(opts.Path, func(rc *RequestCtx, _ *RequestData) (protoreflect.ProtoMessage, error) {
+		br, err := readBatch(rc.Request, opts)
+		if err != nil {
+			return nil, err
+		}
+		results := make([]BatchResult, len(br.Requests))
+		sem := make(chan struct{}, opts.Parallelism)
+		var wg sync.WaitGroup
+		for i, item := range br.Requests {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int, item BatchItem) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				// Outside the router's panic handling
+				defer func() {
+					if p := recover(); p != nil {
+						log.Println(wrapErr(fmt.Errorf("%v", p), "batch item "+item.Path+" panicked"))
+						results[i] = batchError(StatusInternalServerError, httpStatusMessage[StatusInternalServerError])
+					}
+				}()
+				results[i] = app.serveBatchItem(rc.Request, item, opts)
+			}(i, item)
+		}
+		wg.Wait()
+		return nil, writeBatchResponse(rc, BatchResponse{Responses: results})
+	}).WithExclude(opts.ExcludeMiddlewares...))
+	return nil
+}
+
+func readBatch(r *http.Request, opts BatchOptions) (BatchRequest, error) {
+	var br BatchRequest
+	bs, err := io.ReadAll(io.LimitReader(r.Body, opts.MaxSize+1))
+	if err != nil {
+		return br, NewError(StatusBadRequest, "connection error")
+	}
+	if int64(len(bs)) > opts.MaxSize {
+		return br, NewError(StatusRequestEntityTooLarge,
+			fmt.Sprintf("batch larger than %d bytes", opts.MaxSize))
+	}
+
+	if mediaType(r) == ContentTypePROTO.String() {
+		var s structpb.Struct
+		if err := proto.Unmarshal(bs, &s); err != nil {
+			return br, NewError(StatusBadRequest, "invalid payload")
+		}
+		if bs, err = json.Marshal(s.AsMap()); err != nil {
+			return br, wrapErr(err)
+		}
+	}
+	if err := br.Unmarshal(bs); err != nil {
+		return br, NewError(StatusBadRequest, "invalid batch")
+	}
+	if len(br.Requests) == 0 {
+		return br, NewError(StatusBadRequest, "empty batch")
+	}
+	if len(br.Requests) > opts.MaxItems {
+		return br, NewError(StatusRequestEntityTooLarge,
+			fmt.Sprintf("more than %d requests in batch", opts.MaxItems))
+	}
+	return br, nil
+}
+
+func batchError(code int, msg string) BatchResult {
+	return BatchResult{
+		Status:  code,
+		Headers: map[string]string{HeaderContentType: "text/plain; charset=utf-8"},
+		Body:    []byte(msg),
+	}
+}
+
+func (app *App) serveBatchItem(parent *http.Request, item BatchItem, opts BatchOptions) BatchResult {
+	method := strings.ToUpper(item.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	u, err := url.Parse(item.Path)
+	if err != nil || !strings.HasPrefix(u.Path, "/") || u.Host != "" {
+		return batchError(StatusBadRequest, "invalid path")
+	}
+	if strings.TrimRight(u.Path, "/") == opts.Path {
+		return batchError(StatusBadRequest, "batches can't be nested")
+	}
+
+	r, err := http.NewRequestWithContext(parent.Context(), method, u.RequestURI(), bytes.NewReader(item.Body))
+	if err != nil {
+		return batchError(StatusBadRequest, "invalid request")
+	}
+	for k, vs := range parent.Header {
+		if !batchSkipHeaders[k] {
+			r.Header[k] = append([]string{}, vs...)
+		}
+	}
+	for k, v := range item.Headers {
+		r.Header.Set(k, v)
+	}
+	r.Host = parent.Host
+	r.RemoteAddr = parent.RemoteAddr
+	r.TLS = parent.TLS
+
+	rec := newResponseRecorder()
+	app.router.ServeHTTP(rec, r)
+	res := rec.result()
+	br := BatchResult{Status: res.Status, Body: res.Body}
+	if len(res.Header) > 0 {
+		br.Headers = make(map[string]string, len(res.Header))
+		for k, vs := range res.Header {
+			br.Headers[k] = strings.Join(vs, ", ")
+		}
+	}
+	return br
+}
+
+func writeBatchResponse(rc *RequestCtx, br BatchResponse) error {
+	bs, err := br.Marshal()
+	if err != nil {
+		return wrapErr(err)
+	}
+	return writeJSONOrStruct(rc, StatusOK, bs)
+}
@@ -0,0 +1,169 @@
+package prate
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/daimaou92/prate/pb/fortest"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestBatch(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seen int32
+	if err := app.Apply(&Middleware{
+		ID: "count",
+		Handler: func(h Handler) Handler {
+			return func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+				atomic.AddInt32(&seen, 1)
+				if rc.Request.Header.Get("X-Token") != "secret" {
+					return nil, ErrUnauthorized
+				}
+				return h(rc, rd)
+			}
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Batch(BatchOptions{MaxItems: 4, MaxSize: 1024, Parallelism: 3, ExcludeMiddlewares: []string{"count"}}); err != nil {
+		t.Fatal(err)
+	}
+	app.GET(NewEndpointConfig("/items/:id", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		return &fortest.TestRes{Key: rd.Params.ByName("id"), Value: rc.Request.URL.Query().Get("v")}, nil
+	}))
+	app.POST(NewEndpointConfig("/echo", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		req := rd.Body.(*fortest.TestReq)
+		return &fortest.TestRes{Key: req.Key, Value: req.Value}, nil
+	}).WithRequestPayloadType(&fortest.TestReq{}))
+	app.mountEndpoints()
+
+	body, _ := proto.Marshal(&fortest.TestReq{Key: "k", Value: "echoed"})
+	br := BatchRequest{Requests: []BatchItem{
+		{Method: "GET", Path: "/items/a?v=1"},
+		{Method: "POST", Path: "/echo", Body: body},
+		{Method: "GET", Path: "/nope"},
+		{Method: "POST", Path: "/batch"},
+	}}
+	bs, _ := br.Marshal()
+	r := httptest.NewRequest(http.MethodPost, "/batch", bytes.NewReader(bs))
+	r.Header.Set("X-Token", "secret")
+	w := testServe(app, r)
+	if w.Code != StatusOK {
+		t.Fatalf("batch wanted: %d. got: %d %s", StatusOK, w.Code, w.Body.String())
+	}
+	var res BatchResponse
+	if err := res.Unmarshal(w.Body.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	codes := []int{StatusOK, StatusOK, StatusNotFound, StatusBadRequest}
+	if len(res.Responses) != len(codes) {
+		t.Fatalf("wanted %d responses. got: %d", len(codes), len(res.Responses))
+	}
+	for i, c := range codes {
+		if res.Responses[i].Status != c {
+			t.Fatalf("item %d wanted: %d. got: %d", i, c, res.Responses[i].Status)
+		}
+	}
+	var tr fortest.TestRes
+	if err := proto.Unmarshal(res.Responses[1].Body, &tr); err != nil || tr.Value != "echoed" {
+		t.Fatalf("unexpected echo %v %v", &tr, err)
+	}
+	if err := proto.Unmarshal(res.Responses[0].Body, &tr); err != nil || tr.Key != "a" || tr.Value != "1" {
+		t.Fatalf("unexpected item %v %v", &tr, err)
+	}
+	if atomic.LoadInt32(&seen) != 2 {
+		t.Fatalf("middleware wanted 2 calls. got: %d", seen)
+	}
+
+	// Sub-requests carry their own headers on top of the batch's
+	r = httptest.NewRequest(http.MethodPost, "/batch",
+		strings.NewReader(`{"requests":[{"path":"/items/b","headers":{"X-Token":"wrong"}}]}`))
+	r.Header.Set("X-Token", "secret")
+	if err := res.Unmarshal(testServe(app, r).Body.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if res.Responses[0].Status != StatusUnauthorized {
+		t.Fatalf("header override wanted: %d. got: %d", StatusUnauthorized, res.Responses[0].Status)
+	}
+
+	// Protobuf in and out
+	m := map[string]interface{}{}
+	json.Unmarshal([]byte(`{"requests":[{"path":"/items/c"}]}`), &m)
+	s, _ := structpb.NewStruct(m)
+	bs, _ = proto.Marshal(s)
+	r = httptest.NewRequest(http.MethodPost, "/batch", bytes.NewReader(bs))
+	r.Header.Set(HeaderContentType, ContentTypePROTO.String())
+	r.Header.Set(HeaderAccept, ContentTypePROTO.String())
+	r.Header.Set("X-Token", "secret")
+	w = testServe(app, r)
+	var out structpb.Struct
+	if err := proto.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	status := out.Fields["responses"].GetListValue().Values[0].GetStructValue().Fields["status"].GetNumberValue()
+	if status != StatusOK {
+		t.Fatalf("protobuf batch item wanted: %d. got: %v", StatusOK, status)
+	}
+
+	for name, body := range map[string]string{
+		"too many":  `{"requests":[{"path":"/a"},{"path":"/b"},{"path":"/c"},{"path":"/d"},{"path":"/e"}]}`,
+		"too large": `{"requests":[{"path":"/items/` + strings.Repeat("x", 1024) + `"}]}`,
+	} {
+		w := testServe(app, httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(body)))
+		if w.Code != StatusRequestEntityTooLarge {
+			t.Fatalf("%s wanted: %d. got: %d", name, StatusRequestEntityTooLarge, w.Code)
+		}
+	}
+	if w := testServe(app, httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(`{}`))); w.Code != StatusBadRequest {
+		t.Fatalf("empty batch wanted: %d. got: %d", StatusBadRequest, w.Code)
+	}
+}
+
+func TestBatchIsolation(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Batch(BatchOptions{Parallelism: 2}); err != nil {
+		t.Fatal(err)
+	}
+	app.GET(NewEndpointConfig("/boom", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		panic("boom")
+	}))
+	app.GET(NewEndpointConfig("/headers", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		hd := rc.Request.Header
+		return &fortest.TestRes{Key: hd.Get(HeaderIfMatch) + hd.Get(HeaderIdempotencyKey), Value: hd.Get("X-Token")}, nil
+	}))
+	app.mountEndpoints()
+
+	r := httptest.NewRequest(http.MethodPost, "/batch",
+		strings.NewReader(`{"requests":[{"path":"/boom"},{"path":"/headers"}]}`))
+	r.Header.Set(HeaderIfMatch, `"abc"`)
+	r.Header.Set(HeaderIdempotencyKey, "k1")
+	r.Header.Set("X-Token", "secret")
+	w := testServe(app, r)
+	var res BatchResponse
+	if err := res.Unmarshal(w.Body.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if res.Responses[0].Status != StatusInternalServerError {
+		t.Fatalf("panic wanted: %d. got: %d", StatusInternalServerError, res.Responses[0].Status)
+	}
+	var tr fortest.TestRes
+	if err := proto.Unmarshal(res.Responses[1].Body, &tr); err != nil {
+		t.Fatal(err)
+	}
+	if tr.Key != "" || tr.Value != "secret" {
+		t.Fatalf("unexpected inherited headers %v", &tr)
+	}
+}
@@ -0,0 +1,441 @@
+package prate
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Declares how the responses of an endpoint are cached
+type CachePolicy struct {
+	// How long a response is served without running the handler
+	TTL time.Duration
+	// How long past TTL a stale response is still served while a
+	// fresh one is computed in the background
+	StaleWhileRevalidate time.Duration
+	// Request headers that take part in the cache key, for example
+	// "Accept-Language" or "Authorization" for per user responses
+	VaryHeaders []string
+	// Leave the query string out of the cache key
+	IgnoreQuery bool
+	// Tags attached to every response of the endpoint. Handlers can
+	// add more with RequestCtx.CacheTags.
+	Tags []string
+}
+
+// A response held by a CacheStore
+type CachedResponse struct {
+	Status   int
+	Header   http.Header
+	Body     []byte
+	Tags     []string
+	StoredAt time.Time
+	// Fresh until Expires, servable while revalidating until StaleUntil
+	Expires    time.Time
+	StaleUntil time.Time
+}
+
+// Storage for cached responses. Implementations backed by a shared
+// store let several instances of a service share one cache.
+type CacheStore interface {
+	Get(ctx context.Context, key string) (*CachedResponse, bool, error)
+	Set(ctx context.Context, key string, cr *CachedResponse) error
+	// Drops every entry carrying any of tags
+	InvalidateTags(ctx context.Context, tags ...string) error
+}
+
+type lruCacheEntry struct {
+	key string
+	cr  *CachedResponse
+}
+
+// In-memory CacheStore evicting the least recently used
+// entry once full
+type LRUCacheStore struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	lru        *list.List
+	tags       map[string]map[string]struct{}
+}
+
+func NewLRUCacheStore(maxEntries int) *LRUCacheStore {
+	return &LRUCacheStore{
+		maxEntries: maxEntries,
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+		tags:       map[string]map[string]struct{}{},
+	}
+}
+
+func (s *LRUCacheStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+func (s *LRUCacheStore) Get(_ context.Context, key string) (*CachedResponse, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	e := el.Value.(*lruCacheEntry)
+	if time.Now().After(e.cr.StaleUntil) {
+		s.remove(el)
+		return nil, false, nil
+	}
+	s.lru.MoveToFront(el)
+	return e.cr, true, nil
+}
+
+func (s *LRUCacheStore) Set(_ context.Context, key string, cr *CachedResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.entries[key]; ok {
+		s.remove(el)
+	}
+	for s.maxEntries > 0 && s.lru.Len() >= s.maxEntries {
+		s.remove(s.lru.Back())
+	}
+	s.entries[key] = s.lru.PushFront(&lruCacheEntry{key: key, cr: cr})
+	for _, t := range cr.Tags {
+		if s.tags[t] == nil {
+			s.tags[t] = map[string]struct{}{}
+		}
+		s.tags[t][key] = struct{}{}
+	}
+	return nil
+}
+
+func (s *LRUCacheStore) InvalidateTags(_ context.Context, tags ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range tags {
+		for key := range s.tags[t] {
+			if el, ok := s.entries[key]; ok {
+				s.remove(el)
+			}
+		}
+		delete(s.tags, t)
+	}
+	return nil
+}
+
+// Must be called with mu held
+func (s *LRUCacheStore) remove(el *list.Element) {
+	e := el.Value.(*lruCacheEntry)
+	s.lru.Remove(el)
+	delete(s.entries, e.key)
+	for _, t := range e.cr.Tags {
+		if keys, ok := s.tags[t]; ok {
+			delete(keys, e.key)
+			if len(keys) == 0 {
+				delete(s.tags, t)
+			}
+		}
+	}
+}
+
+// Tags the response being produced so it can later be dropped
+// with RequestCtx.InvalidateCache
+func (rc *RequestCtx) CacheTags(tags ...string) {
+	rc.cacheTags = append(rc.cacheTags, tags...)
+}
+
+// Drops every cached response carrying any of tags
+func (rc *RequestCtx) InvalidateCache(tags ...string) error {
+	if rc.endpoint == nil || rc.endpoint.app == nil {
+		return nil
+	}
+	return rc.endpoint.app.InvalidateCache(rc.Context(), tags...)
+}
+
+// Drops every cached response carrying any of tags
+func (app *App) InvalidateCache(ctx context.Context, tags ...string) error {
+	if app.cache == nil {
+		return nil
+	}
+	if err := app.cache.store.InvalidateTags(ctx, tags...); err != nil {
+		return wrapErr(err)
+	}
+	return nil
+}
+
+type cacheControl struct {
+	noStore      bool
+	noCache      bool
+	onlyIfCached bool
+	maxAge       time.Duration
+	hasMaxAge    bool
+}
+
+func parseCacheControl(v string) cacheControl {
+	var cc cacheControl
+	for _, d := range strings.Split(v, ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		name, val, _ := strings.Cut(d, "=")
+		switch name {
+		case "no-store":
+			cc.noStore = true
+		case "no-cache":
+			cc.noCache = true
+		case "only-if-cached":
+			cc.onlyIfCached = true
+		case "max-age":
+			if s, err := strconv.Atoi(strings.Trim(val, `"`)); err == nil && s >= 0 {
+				cc.maxAge = time.Duration(s) * time.Second
+				cc.hasMaxAge = true
+			}
+		}
+	}
+	return cc
+}
+
+type responseCache struct {
+	store CacheStore
+	mu    sync.Mutex
+	// Keys being revalidated in the background
+	refreshing map[string]bool
+}
+
+func cacheKey(rc *RequestCtx, rd *RequestData, cp *CachePolicy) string {
+	var sb strings.Builder
+	sb.WriteString(rc.Request.Method)
+	sb.WriteByte(' ')
+	sb.WriteString(rc.Route())
+	params := append(httprouter.Params{}, rd.Params...)
+	sort.Slice(params, func(i, j int) bool { return params[i].Key < params[j].Key })
+	for _, p := range params {
+		fmt.Fprintf(&sb, "|%s=%s", p.Key, p.Value)
+	}
+	if !cp.IgnoreQuery {
+		sb.WriteString("|?")
+		sb.WriteString(rc.Request.URL.Query().Encode())
+	}
+	hs := append([]string{}, cp.VaryHeaders...)
+	sort.Strings(hs)
+	for _, h := range hs {
+		fmt.Fprintf(&sb, "|%s:%s", http.CanonicalHeaderKey(h), strings.Join(rc.Request.Header.Values(h), ","))
+	}
+	return sb.String()
+}
+
+func (c *responseCache) middleware() *Middleware {
+	return &Middleware{
+		ID: "cache",
+		Handler: func(h Handler) Handler {
+			return func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+				r := rc.Request
+				if rc.endpoint == nil || rc.endpoint.config.Cache == nil ||
+					(r.Method != http.MethodGet && r.Method != http.MethodHead) {
+					return h(rc, rd)
+				}
+				cp := rc.endpoint.config.Cache
+				cc := parseCacheControl(r.Header.Get(HeaderCacheControl))
+				if cc.noStore {
+					return h(rc, rd)
+				}
+
+				ctx := rc.Context()
+				key := cacheKey(rc, rd, cp)
+				now := time.Now()
+				if !cc.noCache {
+					cr, ok, err := c.store.Get(ctx, key)
+					if err != nil {
+						log.Println(wrapErr(err))
+					}
+					if ok && (!cc.hasMaxAge || now.Sub(cr.StoredAt) <= cc.maxAge) {
+						if now.Before(cr.Expires) {
+							c.serve(rc, cr, now)
+							return nil, nil
+						}
+						if now.Before(cr.StaleUntil) {
+							c.revalidate(rc, rd, h, key, cp)
+							c.serve(rc, cr, now)
+							return nil, nil
+						}
+					}
+				}
+				if cc.onlyIfCached {
+					return nil, ErrGatewayTimeout
+				}
+
+				rec := c.fill(ctx, rc, rd, h, key, cp)
+				rc.ResponseWriter.Header().Set(HeaderXCache, "MISS")
+				rec.replay(rc.ResponseWriter)
+				return nil, nil
+			}
+		},
+	}
+}
+
+func (c *responseCache) serve(rc *RequestCtx, cr *CachedResponse, now time.Time) {
+	hd := rc.ResponseWriter.Header()
+	hd.Set(HeaderAge, strconv.Itoa(int(now.Sub(cr.StoredAt)/time.Second)))
+	hd.Set(HeaderXCache, "HIT")
+	rec := recordedResponse{
+		Status: cr.Status,
+		Header: cr.Header,
+		Body:   cr.Body,
+	}
+	rec.replay(rc.ResponseWriter)
+}
+
+// Headers about the connection a response went out on or the
+// request that produced it, left out of cached responses
+var uncachedHeaders = []string{
+	HeaderConnection,
+	HeaderKeepAlive,
+	HeaderProxyAuthenticate,
+	"Proxy-Connection",
+	HeaderTE,
+	HeaderTrailer,
+	HeaderTransferEncoding,
+	HeaderUpgrade,
+	HeaderSetCookie,
+	HeaderXRequestID,
+	HeaderRetryAfter,
+}
+
+// Prefixes of per request headers such as rate limit counters,
+// in canonical form
+var uncachedHeaderPrefixes = []string{
+	http.CanonicalHeaderKey("RateLimit-"),
+	http.CanonicalHeaderKey("X-RateLimit-"),
+}
+
+// Returns the headers of a response worth serving to other requests
+func cacheableHeader(h http.Header) http.Header {
+	out := h.Clone()
+	// As well as those the response names hop-by-hop itself
+	for _, v := range h.Values(HeaderConnection) {
+		for _, k := range strings.Split(v, ",") {
+			out.Del(strings.TrimSpace(k))
+		}
+	}
+	for _, k := range uncachedHeaders {
+		out.Del(k)
+	}
+	for k := range out {
+		for _, p := range uncachedHeaderPrefixes {
+			if strings.HasPrefix(k, p) {
+				delete(out, k)
+			}
+		}
+	}
+	return out
+}
+
+// Runs the handler and stores successful responses. Responses
+// setting cookies are never stored.
+func (c *responseCache) fill(
+	ctx context.Context,
+	rc *RequestCtx, rd *RequestData, h Handler,
+	key string, cp *CachePolicy,
+) *recordedResponse {
+	rc.cacheTags = nil
+	rec := captureResponse(rc, rd, h)
+	if rec.Status != StatusOK || len(rec.Header.Values(HeaderSetCookie)) > 0 {
+		return rec
+	}
+	now := time.Now()
+	cr := &CachedResponse{
+		Status:     rec.Status,
+		Header:     cacheableHeader(rec.Header),
+		Body:       rec.Body,
+		Tags:       append(append([]string{}, cp.Tags...), rc.cacheTags...),
+		StoredAt:   now,
+		Expires:    now.Add(cp.TTL),
+		StaleUntil: now.Add(cp.TTL + cp.StaleWhileRevalidate),
+	}
+	if err := c.store.Set(ctx, key, cr); err != nil {
+		log.Println(wrapErr(err))
+	}
+	return rec
+}
+
+// Refreshes an entry in the background with a copy of the request.
+// At most one refresh per key runs at a time.
+func (c *responseCache) revalidate(rc *RequestCtx, rd *RequestData, h Handler, key string, cp *CachePolicy) {
+	c.mu.Lock()
+	if c.refreshing[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.refreshing[key] = true
+	c.mu.Unlock()
+
+	timeout := 30 * time.Second
+	if rc.endpoint.config.Timeout > 0 {
+		timeout = rc.endpoint.config.Timeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	rc2 := &RequestCtx{
+		Request:        rc.Request.Clone(ctx),
+		ResponseWriter: NewResponseWriter(newResponseRecorder()),
+		endpoint:       rc.endpoint,
+		principal:      rc.principal,
+	}
+	rd2 := &RequestData{
+		Params: append(httprouter.Params{}, rd.Params...),
+		Custom: map[string]interface{}{},
+	}
+	for k, v := range rd.Custom {
+		rd2.Custom[k] = v
+	}
+	if rd.Body != nil {
+		rd2.Body = proto.Clone(rd.Body)
+	}
+
+	go func() {
+		defer func() {
+			// Nothing recovers panics on this goroutine. The stale
+			// entry stays until the next refresh.
+			if p := recover(); p != nil {
+				log.Println(wrapErr(fmt.Errorf("%v", p), "cache refresh of "+key+" panicked"))
+			}
+			cancel()
+			c.mu.Lock()
+			delete(c.refreshing, key)
+			c.mu.Unlock()
+		}()
+		c.fill(ctx, rc2, rd2, h, key, cp)
+	}()
+}
+
+// Enables response caching for every endpoint declaring a
+// CachePolicy through EndpointConfig.WithCache. Installs a
+// middleware with ID "cache". Responses are cached after every
+// middleware applied before it has run, so apply it after
+// authentication. Responses setting cookies aren't cached, and
+// hop-by-hop and per request headers such as X-Request-ID or
+// RateLimit-Remaining are left out of those that are.
+func (app *App) UseCache(store CacheStore) error {
+	if app == nil || app.router == nil {
+		return wrapErr(fmt.Errorf("app not initialized"))
+	}
+	if store == nil {
+		store = NewLRUCacheStore(10000)
+	}
+	app.cache = &responseCache{
+		store:      store,
+		refreshing: map[string]bool{},
+	}
+	if err := app.Apply(app.cache.middleware()); err != nil {
+		return wrapErr(err)
+	}
+	return nil
+}
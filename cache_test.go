@@ -0,0 +1,173 @@
+package prate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daimaou92/prate/pb/fortest"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func TestResponseCache(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int32
+	app.GET(NewEndpointConfig("/items/:id", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		n := atomic.AddInt32(&calls, 1)
+		rc.CacheTags("item:" + rd.Params.ByName("id"))
+		return &fortest.TestRes{Key: rd.Params.ByName("id"), Value: strconv.Itoa(int(n))}, nil
+	}).WithCache(CachePolicy{TTL: time.Minute, VaryHeaders: []string{HeaderAcceptLanguage}}))
+	app.POST(NewEndpointConfig("/items/:id", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		return &fortest.TestRes{}, rc.InvalidateCache("item:" + rd.Params.ByName("id"))
+	}))
+	if err := app.UseCache(NewLRUCacheStore(10)); err != nil {
+		t.Fatal(err)
+	}
+	app.mountEndpoints()
+
+	get := func(path string, hdr map[string]string) (string, string) {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range hdr {
+			r.Header.Set(k, v)
+		}
+		w := testServe(app, r)
+		if w.Code != StatusOK {
+			t.Fatalf("statuscode wanted: %d. got: %d", StatusOK, w.Code)
+		}
+		var res fortest.TestRes
+		if err := proto.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res.Value, w.Header().Get(HeaderXCache)
+	}
+
+	if v, x := get("/items/1", nil); v != "1" || x != "MISS" {
+		t.Fatalf("first request wanted 1 MISS. got: %s %s", v, x)
+	}
+	if v, x := get("/items/1", nil); v != "1" || x != "HIT" {
+		t.Fatalf("second request wanted 1 HIT. got: %s %s", v, x)
+	}
+	if v, _ := get("/items/1", map[string]string{HeaderAcceptLanguage: "fr"}); v != "2" {
+		t.Fatalf("vary header should miss. got: %s", v)
+	}
+	if v, _ := get("/items/1", map[string]string{HeaderCacheControl: "no-cache"}); v != "3" {
+		t.Fatalf("no-cache should bypass lookup. got: %s", v)
+	}
+	if v, _ := get("/items/1", nil); v != "3" {
+		t.Fatalf("no-cache response should be stored. got: %s", v)
+	}
+
+	testServe(app, httptest.NewRequest(http.MethodPost, "/items/1", nil))
+	if v, x := get("/items/1", nil); v != "4" || x != "MISS" {
+		t.Fatalf("invalidated entry wanted 4 MISS. got: %s %s", v, x)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/items/2", nil)
+	r.Header.Set(HeaderCacheControl, "only-if-cached")
+	if w := testServe(app, r); w.Code != StatusGatewayTimeout {
+		t.Fatalf("only-if-cached miss wanted: %d. got: %d", StatusGatewayTimeout, w.Code)
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int32
+	refreshed := make(chan struct{}, 1)
+	app.GET(NewEndpointConfig("/slow", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		n := atomic.AddInt32(&calls, 1)
+		if n > 1 {
+			defer func() { refreshed <- struct{}{} }()
+		}
+		if n == 2 {
+			panic("refresh failed")
+		}
+		return &fortest.TestRes{Value: strconv.Itoa(int(n))}, nil
+	}).WithCache(CachePolicy{TTL: time.Millisecond, StaleWhileRevalidate: time.Minute}))
+	store := NewLRUCacheStore(10)
+	if err := app.UseCache(store); err != nil {
+		t.Fatal(err)
+	}
+	app.mountEndpoints()
+
+	testServe(app, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	time.Sleep(5 * time.Millisecond)
+	w := testServe(app, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	var res fortest.TestRes
+	proto.Unmarshal(w.Body.Bytes(), &res)
+	if res.Value != "1" || w.Header().Get(HeaderXCache) != "HIT" {
+		t.Fatalf("stale response wanted 1 HIT. got: %s %s", res.Value, w.Header().Get(HeaderXCache))
+	}
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatalf("background revalidation did not run")
+	}
+
+	// The panicking refresh is dropped and the next one runs
+	time.Sleep(10 * time.Millisecond)
+	w = testServe(app, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	res.Reset()
+	proto.Unmarshal(w.Body.Bytes(), &res)
+	if res.Value != "1" {
+		t.Fatalf("stale response after failed refresh wanted 1. got: %s", res.Value)
+	}
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatalf("revalidation did not run after a panic")
+	}
+}
+
+func TestResponseCacheHeaders(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int32
+	app.GET(NewEndpointConfig("/items/:id", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		n := atomic.AddInt32(&calls, 1)
+		hd := rc.ResponseWriter.Header()
+		hd.Set(HeaderXRequestID, strconv.Itoa(int(n)))
+		hd.Set(HeaderRateLimitRemaining, "9")
+		hd.Set(HeaderConnection, "X-Hop")
+		hd.Set("X-Hop", "1")
+		hd.Set(HeaderContentLanguage, "en")
+		if rd.Params.ByName("id") == "session" {
+			hd.Set(HeaderSetCookie, "sid="+strconv.Itoa(int(n)))
+		}
+		return &fortest.TestRes{Value: strconv.Itoa(int(n))}, nil
+	}).WithCache(CachePolicy{TTL: time.Minute}))
+	if err := app.UseCache(NewLRUCacheStore(10)); err != nil {
+		t.Fatal(err)
+	}
+	app.mountEndpoints()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		return testServe(app, httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	get("/items/1")
+	w := get("/items/1")
+	if w.Header().Get(HeaderXCache) != "HIT" || w.Header().Get(HeaderContentLanguage) != "en" {
+		t.Fatalf("wanted a hit keeping Content-Language. got: %v", w.Header())
+	}
+	for _, k := range []string{HeaderXRequestID, HeaderRateLimitRemaining, HeaderConnection, "X-Hop"} {
+		if v := w.Header().Get(k); v != "" {
+			t.Fatalf("%s should not be cached. got: %q", k, v)
+		}
+	}
+
+	get("/items/session")
+	if w := get("/items/session"); w.Header().Get(HeaderXCache) != "MISS" || w.Header().Get(HeaderSetCookie) != "sid=3" {
+		t.Fatalf("responses setting cookies should not be cached. got: %v", w.Header())
+	}
+}
@@ -0,0 +1,155 @@
+package prate
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+type flight struct {
+	done chan struct{}
+	// False when the shared execution panicked
+	ok     bool
+	resp   protoreflect.ProtoMessage
+	err    error
+	status int
+	// What the handler set or wrote on the ResponseWriter
+	rec     *recordedResponse
+	written bool
+}
+
+// Hands the outcome of the shared execution to one request. Unless
+// the handler wrote the response itself the message is returned, so
+// each request still goes through the usual ETag checks and encoding.
+func (f *flight) share(rc *RequestCtx) (protoreflect.ProtoMessage, error) {
+	if !f.ok {
+		return nil, ErrInternalServerError
+	}
+	if f.written {
+		f.rec.replay(rc.ResponseWriter)
+		return nil, nil
+	}
+	hd := rc.ResponseWriter.Header()
+	for k, vs := range f.rec.Header {
+		hd[k] = append([]string{}, vs...)
+	}
+	if f.status != 0 {
+		rc.SetStatus(f.status)
+	}
+	return f.resp, f.err
+}
+
+// Keeps the values of a context but not its deadline or cancellation
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// Collapses identical concurrent requests into a single
+// handler execution
+type coalescer struct {
+	headers []string
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+func newCoalescer(headers []string) *coalescer {
+	hs := make([]string, len(headers))
+	for i, h := range headers {
+		hs[i] = http.CanonicalHeaderKey(h)
+	}
+	sort.Strings(hs)
+	return &coalescer{
+		headers: hs,
+		flights: map[string]*flight{},
+	}
+}
+
+func (c *coalescer) key(r *http.Request) string {
+	var sb strings.Builder
+	sb.WriteString(r.Method)
+	sb.WriteByte(' ')
+	sb.WriteString(r.URL.Path)
+	sb.WriteByte('?')
+	sb.WriteString(r.URL.Query().Encode())
+	for _, h := range c.headers {
+		sb.WriteByte('|')
+		sb.WriteString(h)
+		sb.WriteByte(':')
+		sb.WriteString(strings.Join(r.Header.Values(h), ","))
+	}
+	return sb.String()
+}
+
+// The first request for a key runs h. Requests arriving while it
+// runs wait and get the same response. h runs on a context detached
+// from the first request, so that request going away doesn't fail
+// the others, bounded by the timeout configured for the endpoint.
+func (c *coalescer) wrap(h Handler) Handler {
+	return func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		r := rc.Request
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			return h(rc, rd)
+		}
+		key := c.key(r)
+
+		c.mu.Lock()
+		if f, ok := c.flights[key]; ok {
+			c.mu.Unlock()
+			select {
+			case <-f.done:
+			case <-rc.Context().Done():
+				return nil, wrapErr(rc.Context().Err())
+			}
+			return f.share(rc)
+		}
+		f := &flight{done: make(chan struct{})}
+		c.flights[key] = f
+		c.mu.Unlock()
+
+		orig := rc.ResponseWriter
+		rec := newResponseRecorder()
+		rc.ResponseWriter = NewResponseWriter(rec)
+		ctx := context.Context(detachedContext{r.Context()})
+		if rc.endpoint != nil {
+			if d := rc.endpoint.limit(); d > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, d)
+				defer cancel()
+			}
+		}
+		rc.Request = r.WithContext(ctx)
+		defer func() {
+			rc.ResponseWriter, rc.Request = orig, r
+			c.mu.Lock()
+			delete(c.flights, key)
+			c.mu.Unlock()
+			close(f.done)
+		}()
+		f.resp, f.err = h(rc, rd)
+		f.status = rc.status
+		f.written = rc.ResponseWriter.written
+		f.rec = rec.result()
+		f.ok = true
+
+		rc.ResponseWriter, rc.Request = orig, r
+		return f.share(rc)
+	}
+}
+
+// Wraps the handler so identical in-flight GET requests share one
+// execution
+func (ec *EndpointConfig) applyCoalescing() {
+	if ec.Coalesce == nil {
+		return
+	}
+	ec.Handler = newCoalescer(ec.Coalesce.Headers).wrap(ec.Handler)
+}
@@ -0,0 +1,137 @@
+package prate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daimaou92/prate/pb/fortest"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func TestCoalescing(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int32
+	release := make(chan struct{})
+	app.GET(NewEndpointConfig("/hot", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		rc.ResponseWriter.Header().Set("X-Computed", "yes")
+		return &fortest.TestRes{Value: rc.Request.URL.Query().Get("q")}, nil
+	}).WithCoalescing(CoalesceOptions{Headers: []string{"X-Tenant"}}))
+	if err := app.Apply(ETags()); err != nil {
+		t.Fatal(err)
+	}
+	app.mountEndpoints()
+	etag, _ := ProtoETag(&fortest.TestRes{Value: "a"})
+
+	var wg sync.WaitGroup
+	results := make([]*httptest.ResponseRecorder, 6)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodGet, "/hot?q=a", nil)
+			switch i {
+			case 4:
+				r.Header.Set(HeaderIfNoneMatch, etag)
+			case 5:
+				r.Header.Set("X-Tenant", "other")
+			}
+			results[i] = testServe(app, r)
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("handler executions wanted: 2. got: %d", n)
+	}
+	for i, w := range results {
+		if w.Header().Get(HeaderETag) != etag {
+			t.Fatalf("response %d without etag: %v", i, w.Header())
+		}
+		if i == 4 {
+			if w.Code != StatusNotModified {
+				t.Fatalf("conditional request wanted: %d. got: %d", StatusNotModified, w.Code)
+			}
+			continue
+		}
+		var res fortest.TestRes
+		if err := proto.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != StatusOK || res.Value != "a" || w.Header().Get("X-Computed") != "yes" {
+			t.Fatalf("response %d not replayed: %d %v %q", i, w.Code, w.Header(), res.Value)
+		}
+	}
+}
+
+func TestCoalescingDetached(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	app.GET(NewEndpointConfig("/hot", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		<-release
+		if err := rc.Context().Err(); err != nil {
+			return nil, err
+		}
+		return &fortest.TestRes{Value: "shared"}, nil
+	}).WithCoalescing(CoalesceOptions{}))
+	app.mountEndpoints()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan struct{})
+	go func() {
+		testServe(app, httptest.NewRequest(http.MethodGet, "/hot", nil).WithContext(ctx))
+		close(leader)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	follower := make(chan *httptest.ResponseRecorder)
+	go func() {
+		follower <- testServe(app, httptest.NewRequest(http.MethodGet, "/hot", nil))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	close(release)
+
+	w := <-follower
+	<-leader
+	var res fortest.TestRes
+	if err := proto.Unmarshal(w.Body.Bytes(), &res); err != nil || w.Code != StatusOK || res.Value != "shared" {
+		t.Fatalf("follower wanted 200 shared. got: %d %q %v", w.Code, res.Value, err)
+	}
+}
+
+func TestCoalescingDeadline(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.GET(NewEndpointConfig("/hot", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		deadline, ok := rc.Context().Deadline()
+		if !ok || time.Until(deadline) > time.Second {
+			return nil, ErrConflict
+		}
+		return &fortest.TestRes{Value: "shared"}, nil
+	}).WithCoalescing(CoalesceOptions{}).WithTimeout(time.Second))
+	app.mountEndpoints()
+
+	// The client asks for longer than the endpoint allows
+	r := httptest.NewRequest(http.MethodGet, "/hot", nil)
+	r.Header.Set(HeaderXRequestTimeout, "5s")
+	if w := testServe(app, r); w.Code != StatusOK {
+		t.Fatalf("shared execution wanted the endpoint timeout. got: %d", w.Code)
+	}
+}
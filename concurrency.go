@@ -0,0 +1,283 @@
+package prate
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Decides how an endpoint is treated once a concurrency limit
+// is reached
+type Priority int
+
+const (
+	// Queued in arrival order behind PriorityHigh requests
+	PriorityNormal Priority = iota
+	// Never queued. Rejected as soon as the limit is reached.
+	PriorityLow
+	// Queued ahead of PriorityNormal requests
+	PriorityHigh
+	// Bypasses concurrency limits entirely. Meant for health
+	// checks and admin routes.
+	PriorityCritical
+)
+
+type AdaptiveMode int
+
+const (
+	// The limit stays at ConcurrencyOptions.Limit
+	AdaptiveNone AdaptiveMode = iota
+	// Additive increase, multiplicative decrease. The limit grows by
+	// one every Limit successful requests and is cut by BackoffRatio
+	// whenever a request fails or is slower than LatencyThreshold.
+	AdaptiveAIMD
+	// Scales the limit by the ratio between the long term average
+	// latency and the latest sample so that rising latency, a sign
+	// of queueing downstream, shrinks the limit.
+	AdaptiveGradient
+)
+
+type ConcurrencyOptions struct {
+	// Concurrent requests allowed. With an adaptive mode this is the
+	// starting point.
+	Limit int
+	// Requests allowed to wait for a slot. Zero rejects immediately.
+	QueueSize int
+	// Longest a request waits in the queue. Defaults to one second.
+	QueueTimeout time.Duration
+	// Value of the Retry-After header sent along a 503. Defaults to
+	// one second.
+	RetryAfter time.Duration
+
+	Adaptive AdaptiveMode
+	// Bounds for the adaptive limit. Default to 1 and 10 x Limit.
+	MinLimit int
+	MaxLimit int
+	// AIMD only. Defaults to one second.
+	LatencyThreshold time.Duration
+	// AIMD only. Defaults to 0.9.
+	BackoffRatio float64
+}
+
+type waiter struct {
+	ready chan struct{}
+}
+
+type concurrencyLimiter struct {
+	mu       sync.Mutex
+	opts     ConcurrencyOptions
+	limit    float64
+	inflight int
+	high     *list.List
+	normal   *list.List
+	longRTT  float64
+}
+
+func newConcurrencyLimiter(opts ConcurrencyOptions) *concurrencyLimiter {
+	if opts.Limit <= 0 {
+		opts.Limit = 1
+	}
+	if opts.QueueTimeout <= 0 {
+		opts.QueueTimeout = time.Second
+	}
+	if opts.RetryAfter <= 0 {
+		opts.RetryAfter = time.Second
+	}
+	if opts.MinLimit <= 0 {
+		opts.MinLimit = 1
+	}
+	if opts.MaxLimit <= 0 {
+		opts.MaxLimit = 10 * opts.Limit
+	}
+	if opts.LatencyThreshold <= 0 {
+		opts.LatencyThreshold = time.Second
+	}
+	if opts.BackoffRatio <= 0 || opts.BackoffRatio >= 1 {
+		opts.BackoffRatio = 0.9
+	}
+	return &concurrencyLimiter{
+		opts:   opts,
+		limit:  float64(opts.Limit),
+		high:   list.New(),
+		normal: list.New(),
+	}
+}
+
+// Current limit. Changes over time in adaptive modes.
+func (cl *concurrencyLimiter) Limit() int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return int(cl.limit)
+}
+
+var errShed = errors.New("request shed")
+
+// Waits for a slot. The returned func must be called once the
+// request completes.
+func (cl *concurrencyLimiter) acquire(ctx context.Context, p Priority) (func(time.Duration, bool), error) {
+	if p == PriorityCritical {
+		return func(time.Duration, bool) {}, nil
+	}
+
+	cl.mu.Lock()
+	if cl.inflight < int(cl.limit) {
+		cl.inflight++
+		cl.mu.Unlock()
+		return cl.release, nil
+	}
+	queued := cl.high.Len() + cl.normal.Len()
+	if p == PriorityLow || queued >= cl.opts.QueueSize {
+		cl.mu.Unlock()
+		return nil, errShed
+	}
+	w := &waiter{ready: make(chan struct{})}
+	q := cl.normal
+	if p == PriorityHigh {
+		q = cl.high
+	}
+	el := q.PushBack(w)
+	cl.mu.Unlock()
+
+	timer := time.NewTimer(cl.opts.QueueTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-w.ready:
+		return cl.release, nil
+	case <-timer.C:
+		err = errShed
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	select {
+	case <-w.ready:
+		// Handed a slot while giving up. Pass it on.
+		cl.inflight--
+		cl.wake()
+	default:
+		q.Remove(el)
+	}
+	return nil, err
+}
+
+// Records the outcome of a request and frees its slot
+func (cl *concurrencyLimiter) release(latency time.Duration, failed bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.inflight--
+	cl.adapt(latency, failed)
+	cl.wake()
+}
+
+// Hands free slots to waiters, high priority first. Must be
+// called with mu held.
+func (cl *concurrencyLimiter) wake() {
+	for cl.inflight < int(cl.limit) {
+		q := cl.high
+		if q.Len() == 0 {
+			q = cl.normal
+		}
+		el := q.Front()
+		if el == nil {
+			return
+		}
+		q.Remove(el)
+		cl.inflight++
+		close(el.Value.(*waiter).ready)
+	}
+}
+
+// Must be called with mu held
+func (cl *concurrencyLimiter) adapt(latency time.Duration, failed bool) {
+	min, max := float64(cl.opts.MinLimit), float64(cl.opts.MaxLimit)
+	switch cl.opts.Adaptive {
+	case AdaptiveAIMD:
+		if failed || latency > cl.opts.LatencyThreshold {
+			cl.limit *= cl.opts.BackoffRatio
+		} else {
+			cl.limit += 1 / cl.limit
+		}
+	case AdaptiveGradient:
+		rtt := float64(latency)
+		if rtt <= 0 {
+			return
+		}
+		if cl.longRTT == 0 {
+			cl.longRTT = rtt
+		}
+		cl.longRTT = cl.longRTT*0.95 + rtt*0.05
+		// Tolerate some jitter before backing off
+		gradient := math.Max(0.5, math.Min(1, 1.5*cl.longRTT/rtt))
+		next := cl.limit*gradient + math.Sqrt(cl.limit)
+		cl.limit = cl.limit*0.8 + next*0.2
+	default:
+		return
+	}
+	cl.limit = math.Max(min, math.Min(max, cl.limit))
+}
+
+func (cl *concurrencyLimiter) wrap(priority func(*RequestCtx) Priority, h Handler) Handler {
+	return func(rc *RequestCtx, rd *RequestData) (resp protoreflect.ProtoMessage, err error) {
+		done, err := cl.acquire(rc.Context(), priority(rc))
+		if err != nil {
+			if errors.Is(err, errShed) {
+				rc.ResponseWriter.Header().Set(HeaderRetryAfter, strconv.Itoa(ceilSeconds(cl.opts.RetryAfter)))
+				return nil, ErrServiceUnavailable
+			}
+			return nil, wrapErr(err)
+		}
+		start := time.Now()
+		// Deferred so a panicking handler, counted as failed, still
+		// gives its slot back
+		panicked := true
+		defer func() {
+			done(time.Since(start), panicked || failedRequest(err))
+		}()
+		resp, err = h(rc, rd)
+		panicked = false
+		return resp, err
+	}
+}
+
+// Failures that hint at overload: server errors and timeouts
+func failedRequest(err error) bool {
+	if err == nil {
+		return false
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code >= StatusInternalServerError
+	}
+	return true
+}
+
+func endpointPriority(rc *RequestCtx) Priority {
+	if rc.endpoint == nil {
+		return PriorityNormal
+	}
+	return rc.endpoint.config.Priority
+}
+
+// Returns a middleware with ID "concurrency" that caps the number of
+// requests served at once across every endpoint it is applied to.
+// Requests over the limit wait in a bounded queue and are rejected
+// with a 503 once it is full. Endpoints can cap themselves further
+// with EndpointConfig.WithConcurrencyLimit.
+func ConcurrencyLimiter(opts ConcurrencyOptions) *Middleware {
+	cl := newConcurrencyLimiter(opts)
+	return &Middleware{
+		ID: "concurrency",
+		Handler: func(h Handler) Handler {
+			return cl.wrap(endpointPriority, h)
+		},
+	}
+}
@@ -0,0 +1,140 @@
+package prate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daimaou92/prate/pb/fortest"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	cl := newConcurrencyLimiter(ConcurrencyOptions{Limit: 1, QueueSize: 2, QueueTimeout: time.Second})
+	ctx := context.TODO()
+
+	done, err := cl.acquire(ctx, PriorityNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.acquire(ctx, PriorityLow); err != errShed {
+		t.Fatalf("low priority wanted: %v. got: %v", errShed, err)
+	}
+	if d, err := cl.acquire(ctx, PriorityCritical); err != nil {
+		t.Fatalf("critical priority shed: %v", err)
+	} else {
+		d(0, false)
+	}
+
+	// A high priority waiter overtakes a normal one queued first
+	var (
+		mu    sync.Mutex
+		order []Priority
+		wg    sync.WaitGroup
+	)
+	for _, p := range []Priority{PriorityNormal, PriorityHigh} {
+		wg.Add(1)
+		go func(p Priority) {
+			defer wg.Done()
+			d, err := cl.acquire(ctx, p)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			order = append(order, p)
+			mu.Unlock()
+			d(0, false)
+		}(p)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := cl.acquire(ctx, PriorityNormal); err != errShed {
+		t.Fatalf("full queue wanted: %v. got: %v", errShed, err)
+	}
+	done(0, false)
+	wg.Wait()
+	if len(order) != 2 || order[0] != PriorityHigh {
+		t.Fatalf("high priority not served first: %v", order)
+	}
+}
+
+func TestAdaptiveConcurrency(t *testing.T) {
+	cl := newConcurrencyLimiter(ConcurrencyOptions{
+		Limit: 10, Adaptive: AdaptiveAIMD, LatencyThreshold: 100 * time.Millisecond,
+	})
+	for i := 0; i < 5; i++ {
+		d, _ := cl.acquire(context.TODO(), PriorityNormal)
+		d(time.Second, false)
+	}
+	if l := cl.Limit(); l >= 10 {
+		t.Fatalf("limit should shrink on slow requests. got: %d", l)
+	}
+	before := cl.Limit()
+	for i := 0; i < 50; i++ {
+		d, _ := cl.acquire(context.TODO(), PriorityNormal)
+		d(time.Millisecond, false)
+	}
+	if l := cl.Limit(); l <= before {
+		t.Fatalf("limit should grow on fast requests. got: %d", l)
+	}
+}
+
+func TestEndpointConcurrencyLimit(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := make(chan struct{})
+	started := make(chan struct{})
+	app.GET(NewEndpointConfig("/work", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		started <- struct{}{}
+		<-block
+		return &fortest.TestRes{}, nil
+	}).WithConcurrencyLimit(ConcurrencyOptions{Limit: 1}))
+	app.mountEndpoints()
+
+	go testServe(app, httptest.NewRequest(http.MethodGet, "/work", nil))
+	<-started
+	w := testServe(app, httptest.NewRequest(http.MethodGet, "/work", nil))
+	close(block)
+	if w.Code != StatusServiceUnavailable {
+		t.Fatalf("statuscode wanted: %d. got: %d", StatusServiceUnavailable, w.Code)
+	}
+	if w.Header().Get(HeaderRetryAfter) != "1" {
+		t.Fatalf("retry-after wanted: 1. got: %s", w.Header().Get(HeaderRetryAfter))
+	}
+}
+
+func TestConcurrencyLimitPanics(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.SetPanicHandler(func(w http.ResponseWriter, _ *http.Request, _ interface{}) {
+		w.WriteHeader(StatusInternalServerError)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	const limit = 2
+	var calls int32
+	app.GET(NewEndpointConfig("/flaky", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		if atomic.AddInt32(&calls, 1) <= limit+1 {
+			panic("boom")
+		}
+		return &fortest.TestRes{}, nil
+	}).WithConcurrencyLimit(ConcurrencyOptions{Limit: limit}))
+	app.mountEndpoints()
+
+	for i := 0; i < limit+1; i++ {
+		if w := testServe(app, httptest.NewRequest(http.MethodGet, "/flaky", nil)); w.Code != StatusInternalServerError {
+			t.Fatalf("panic %d wanted: %d. got: %d", i, StatusInternalServerError, w.Code)
+		}
+	}
+	if w := testServe(app, httptest.NewRequest(http.MethodGet, "/flaky", nil)); w.Code != StatusOK {
+		t.Fatalf("after panics wanted: %d. got: %d", StatusOK, w.Code)
+	}
+}
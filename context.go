@@ -20,11 +20,14 @@ import (
 )
 
 type Pagination struct {
-	Page       int32 `json:"page"`
-	ItemCount  int8  `json:"item_count"`
-	TotalItems int32 `json:"total_items"`
-	Pages      int32 `json:"pages"`
-	HasNext    bool  `json:"has_next"`
+	Page       int32  `json:"page"`
+	PageSize   int32  `json:"page_size"`
+	ItemCount  int32  `json:"item_count"`
+	TotalItems int64  `json:"total_items"`
+	Pages      int32  `json:"pages"`
+	HasNext    bool   `json:"has_next"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	PrevCursor string `json:"prev_cursor,omitempty"`
 }
 
 func (p Pagination) Marshal() ([]byte, error) {
@@ -52,6 +55,13 @@ type RequestData struct {
 	Params httprouter.Params
 	Body   proto.Message
 	Custom map[string]interface{}
+	// Files of a multipart/form-data request, by field name
+	Files map[string][]*UploadedFile
+	// Pending JSON patch document and its media type
+	patch     []byte
+	patchType string
+	// What the patch was applied to
+	patchBase protoreflect.ProtoMessage
 }
 
 type Handler func(*RequestCtx, *RequestData) (protoreflect.ProtoMessage, error)
@@ -142,6 +152,13 @@ func NewResponseWriter(w http.ResponseWriter) *ResponseWriter {
 type RequestCtx struct {
 	Request        *http.Request
 	ResponseWriter *ResponseWriter
+	endpoint       *endpoint
+	cspNonce       string
+	principal      *Principal
+	cacheTags      []string
+	page           *PageRequest
+	pageResult     *PageResult
+	status         int
 }
 
 // Must happen after payload unmarshal
@@ -155,6 +172,41 @@ func (rc *RequestCtx) update(rw http.ResponseWriter, r *http.Request) {
 func (rc *RequestCtx) reset() {
 	rc.Request = nil
 	rc.ResponseWriter = nil
+	rc.endpoint = nil
+	rc.cspNonce = ""
+	rc.principal = nil
+	rc.cacheTags = nil
+	rc.page = nil
+	rc.pageResult = nil
+	rc.status = 0
+}
+
+// Returns the caller authenticated by the Authentication
+// middleware. Nil for anonymous requests.
+func (rc *RequestCtx) Principal() *Principal {
+	return rc.principal
+}
+
+// Returns the route pattern the request matched, for example
+// "/users/:id". Empty for requests not served by an endpoint.
+func (rc *RequestCtx) Route() string {
+	if rc.endpoint == nil {
+		return ""
+	}
+	return rc.endpoint.path
+}
+
+// Returns the nonce generated for this request by the SecureHeaders
+// middleware. Empty unless the Content-Security-Policy in effect
+// contains the CSPNonce placeholder.
+func (rc *RequestCtx) CSPNonce() string {
+	return rc.cspNonce
+}
+
+// Sets the status code written along with the message a handler
+// returns, for example StatusCreated. Defaults to StatusOK.
+func (rc *RequestCtx) SetStatus(code int) {
+	rc.status = code
 }
 
 // Will return 0 until Write or Writeheader is called
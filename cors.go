@@ -0,0 +1,309 @@
+package prate
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// CORSOptions configures the middleware installed by App.CORS
+type CORSOptions struct {
+	// Origins allowed to make cross origin requests. Entries can be
+	// an exact origin ("https://example.com"), "*" to allow any origin
+	// or a wildcard pattern ("https://*.example.com").
+	AllowOrigins []string
+
+	// Regular expressions matched against the Origin header.
+	AllowOriginPatterns []*regexp.Regexp
+
+	// Called when none of AllowOrigins or AllowOriginPatterns match.
+	AllowOriginFunc func(origin string) bool
+
+	// Methods allowed in preflight responses. When empty the methods
+	// registered on the App for the requested path are used.
+	AllowMethods []string
+
+	// Headers allowed in preflight responses. When empty the headers
+	// listed in Access-Control-Request-Headers are echoed back.
+	AllowHeaders []string
+
+	// Response headers the browser is allowed to expose to scripts.
+	ExposeHeaders []string
+
+	AllowCredentials bool
+
+	// How long the results of a preflight request can be cached.
+	// Zero omits the Access-Control-Max-Age header.
+	MaxAge time.Duration
+}
+
+type corsPolicy struct {
+	app       *App
+	opts      CORSOptions
+	any       bool
+	exact     map[string]bool
+	wildcards []*regexp.Regexp
+}
+
+func newCORSPolicy(app *App, opts CORSOptions) (*corsPolicy, error) {
+	cp := &corsPolicy{
+		app:   app,
+		opts:  opts,
+		exact: map[string]bool{},
+	}
+	for _, o := range opts.AllowOrigins {
+		o = strings.TrimSpace(o)
+		switch {
+		case o == "":
+			continue
+		case o == "*":
+			cp.any = true
+		case strings.Contains(o, "*"):
+			parts := strings.Split(o, "*")
+			for i, p := range parts {
+				parts[i] = regexp.QuoteMeta(strings.ToLower(p))
+			}
+			re, err := regexp.Compile("^" + strings.Join(parts, "[^/]*") + "$")
+			if err != nil {
+				return nil, wrapErr(err, fmt.Sprintf("invalid origin pattern %q", o))
+			}
+			cp.wildcards = append(cp.wildcards, re)
+		default:
+			cp.exact[strings.ToLower(o)] = true
+		}
+	}
+	return cp, nil
+}
+
+func (cp *corsPolicy) originAllowed(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	if cp.any {
+		return true
+	}
+	o := strings.ToLower(origin)
+	if cp.exact[o] {
+		return true
+	}
+	for _, re := range cp.wildcards {
+		if re.MatchString(o) {
+			return true
+		}
+	}
+	for _, re := range cp.opts.AllowOriginPatterns {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	if cp.opts.AllowOriginFunc != nil {
+		return cp.opts.AllowOriginFunc(origin)
+	}
+	return false
+}
+
+// The response varies on Origin unless every origin
+// gets the same literal "*" back.
+func (cp *corsPolicy) variesByOrigin() bool {
+	return !cp.any || cp.opts.AllowCredentials
+}
+
+func (cp *corsPolicy) setOrigin(h http.Header, origin string) {
+	if cp.any && !cp.opts.AllowCredentials {
+		h.Set(HeaderAccessControlAllowOrigin, "*")
+	} else {
+		h.Set(HeaderAccessControlAllowOrigin, origin)
+	}
+	if cp.opts.AllowCredentials {
+		h.Set(HeaderAccessControlAllowCredentials, "true")
+	}
+}
+
+func (cp *corsPolicy) methods(path string) []string {
+	if len(cp.opts.AllowMethods) > 0 {
+		return cp.opts.AllowMethods
+	}
+	return cp.app.routeMethods(path)
+}
+
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		r.Header.Get(HeaderOrigin) != "" &&
+		r.Header.Get(HeaderAccessControlRequestMethod) != ""
+}
+
+// Writes the response to a preflight request. CORS headers are
+// left out when the origin or the requested method isn't allowed.
+func (cp *corsPolicy) preflight(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	addVary(
+		h, HeaderOrigin,
+		HeaderAccessControlRequestMethod,
+		HeaderAccessControlRequestHeaders,
+	)
+	defer w.WriteHeader(StatusNoContent)
+
+	origin := r.Header.Get(HeaderOrigin)
+	if !cp.originAllowed(origin) {
+		return
+	}
+
+	reqMethod := strings.ToUpper(r.Header.Get(HeaderAccessControlRequestMethod))
+	methods := cp.methods(r.URL.Path)
+	allowed := false
+	for _, m := range methods {
+		if m == reqMethod {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return
+	}
+
+	cp.setOrigin(h, origin)
+	h.Set(HeaderAccessControlAllowMethods, strings.Join(methods, ", "))
+	if len(cp.opts.AllowHeaders) > 0 {
+		h.Set(HeaderAccessControlAllowHeaders, strings.Join(cp.opts.AllowHeaders, ", "))
+	} else if rh := r.Header.Get(HeaderAccessControlRequestHeaders); rh != "" {
+		h.Set(HeaderAccessControlAllowHeaders, rh)
+	}
+	if cp.opts.MaxAge > 0 {
+		h.Set(HeaderAccessControlMaxAge, strconv.Itoa(int(cp.opts.MaxAge/time.Second)))
+	}
+}
+
+// Decorates an actual (non preflight) cross origin response
+func (cp *corsPolicy) decorate(h http.Header, r *http.Request) {
+	if cp.variesByOrigin() {
+		addVary(h, HeaderOrigin)
+	}
+	origin := r.Header.Get(HeaderOrigin)
+	if !cp.originAllowed(origin) {
+		return
+	}
+	cp.setOrigin(h, origin)
+	if len(cp.opts.ExposeHeaders) > 0 {
+		h.Set(HeaderAccessControlExposeHeaders, strings.Join(cp.opts.ExposeHeaders, ", "))
+	}
+}
+
+func (cp *corsPolicy) middleware() *Middleware {
+	return &Middleware{
+		ID: "cors",
+		Handler: func(h Handler) Handler {
+			return func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+				if isPreflight(rc.Request) {
+					cp.preflight(rc.ResponseWriter, rc.Request)
+					return nil, nil
+				}
+				cp.decorate(rc.ResponseWriter.Header(), rc.Request)
+				return h(rc, rd)
+			}
+		},
+	}
+}
+
+// Enables CORS for every endpoint on the App. Preflight requests
+// are answered automatically using the methods registered for the
+// requested path. Endpoints can opt out by excluding the middleware
+// with ID "cors".
+func (app *App) CORS(opts CORSOptions) error {
+	if app == nil || app.router == nil {
+		return wrapErr(fmt.Errorf("app not initialized"))
+	}
+	cp, err := newCORSPolicy(app, opts)
+	if err != nil {
+		return wrapErr(err)
+	}
+	if err := app.Apply(cp.middleware()); err != nil {
+		return wrapErr(err)
+	}
+
+	next := app.router.GlobalOPTIONS
+	app.router.HandleOPTIONS = true
+	app.router.GlobalOPTIONS = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPreflight(r) {
+			cp.preflight(w, r)
+			return
+		}
+		if next != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.WriteHeader(StatusNoContent)
+	})
+	return nil
+}
+
+// Returns the methods registered for a request path, sorted
+// and including OPTIONS.
+func (app *App) routeMethods(path string) []string {
+	seen := map[string]bool{http.MethodOptions: true}
+	for _, v := range app.epCache {
+		if matchRoute(v.ec.Path, path) {
+			seen[v.ec.method] = true
+		}
+	}
+	ms := make([]string, 0, len(seen))
+	for m := range seen {
+		ms = append(ms, m)
+	}
+	sort.Strings(ms)
+	return ms
+}
+
+// Reports whether path matches an httprouter style pattern
+// with :named and *catchAll parameters.
+func matchRoute(pattern, path string) bool {
+	for {
+		if pattern == "" || path == "" {
+			return pattern == path
+		}
+		switch pattern[0] {
+		case ':':
+			i := strings.IndexByte(pattern, '/')
+			j := strings.IndexByte(path, '/')
+			if j == 0 {
+				return false
+			}
+			if i < 0 {
+				return j < 0
+			}
+			if j < 0 {
+				return false
+			}
+			pattern, path = pattern[i:], path[j:]
+		case '*':
+			return true
+		default:
+			if pattern[0] != path[0] {
+				return false
+			}
+			pattern, path = pattern[1:], path[1:]
+		}
+	}
+}
+
+// Adds values to the Vary header skipping the ones already present
+func addVary(h http.Header, values ...string) {
+	existing := map[string]bool{}
+	for _, v := range h.Values(HeaderVary) {
+		for _, p := range strings.Split(v, ",") {
+			existing[http.CanonicalHeaderKey(strings.TrimSpace(p))] = true
+		}
+	}
+	for _, v := range values {
+		if existing[http.CanonicalHeaderKey(v)] {
+			continue
+		}
+		existing[http.CanonicalHeaderKey(v)] = true
+		h.Add(HeaderVary, v)
+	}
+}
@@ -0,0 +1,116 @@
+package prate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/daimaou92/prate/pb/fortest"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func TestMatchRoute(t *testing.T) {
+	tsts := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"/users", "/users", true},
+		{"/users", "/users/", false},
+		{"/users/:id", "/users/42", true},
+		{"/users/:id", "/users/", false},
+		{"/users/:id", "/users/42/orders", false},
+		{"/users/:id/orders", "/users/42/orders", true},
+		{"/static/*filepath", "/static/css/app.css", true},
+		{"/static/*filepath", "/assets/app.css", false},
+	}
+	for _, tst := range tsts {
+		if got := matchRoute(tst.pattern, tst.path); got != tst.want {
+			t.Fatalf("matchRoute(%q, %q) wanted: %v. got: %v", tst.pattern, tst.path, tst.want, got)
+		}
+	}
+}
+
+func TestCORS(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		return &fortest.TestRes{}, nil
+	}
+	app.GET(NewEndpointConfig("/items/:id", h))
+	app.DELETE(NewEndpointConfig("/items/:id", h))
+	if err := app.CORS(CORSOptions{
+		AllowOrigins:  []string{"https://example.com", "https://*.example.org"},
+		ExposeHeaders: []string{"X-Total-Count"},
+		MaxAge:        10 * time.Minute,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	app.mountEndpoints()
+
+	t.Run("preflight", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodOptions, "/items/1", nil)
+		r.Header.Set(HeaderOrigin, "https://api.example.org")
+		r.Header.Set(HeaderAccessControlRequestMethod, http.MethodDelete)
+		r.Header.Set(HeaderAccessControlRequestHeaders, "X-Custom")
+		w := testServe(app, r)
+		if w.Code != StatusNoContent {
+			t.Fatalf("statuscode wanted: %d. got: %d", StatusNoContent, w.Code)
+		}
+		if v := w.Header().Get(HeaderAccessControlAllowOrigin); v != "https://api.example.org" {
+			t.Fatalf("allow origin wanted: https://api.example.org. got: %s", v)
+		}
+		if v := w.Header().Get(HeaderAccessControlAllowMethods); v != "DELETE, GET, OPTIONS" {
+			t.Fatalf("allow methods wanted: DELETE, GET, OPTIONS. got: %s", v)
+		}
+		if v := w.Header().Get(HeaderAccessControlAllowHeaders); v != "X-Custom" {
+			t.Fatalf("allow headers wanted: X-Custom. got: %s", v)
+		}
+		if v := w.Header().Get(HeaderAccessControlMaxAge); v != "600" {
+			t.Fatalf("max age wanted: 600. got: %s", v)
+		}
+	})
+
+	t.Run("preflight unregistered method", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodOptions, "/items/1", nil)
+		r.Header.Set(HeaderOrigin, "https://example.com")
+		r.Header.Set(HeaderAccessControlRequestMethod, http.MethodPut)
+		w := testServe(app, r)
+		if v := w.Header().Get(HeaderAccessControlAllowOrigin); v != "" {
+			t.Fatalf("allow origin wanted empty. got: %s", v)
+		}
+	})
+
+	t.Run("simple request", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/items/1", nil)
+		r.Header.Set(HeaderOrigin, "https://example.com")
+		w := testServe(app, r)
+		if w.Code != StatusOK {
+			t.Fatalf("statuscode wanted: %d. got: %d", StatusOK, w.Code)
+		}
+		if v := w.Header().Get(HeaderAccessControlAllowOrigin); v != "https://example.com" {
+			t.Fatalf("allow origin wanted: https://example.com. got: %s", v)
+		}
+		if v := w.Header().Get(HeaderAccessControlExposeHeaders); v != "X-Total-Count" {
+			t.Fatalf("expose headers wanted: X-Total-Count. got: %s", v)
+		}
+		if v := w.Header().Get(HeaderVary); v != HeaderOrigin {
+			t.Fatalf("vary wanted: Origin. got: %s", v)
+		}
+	})
+
+	t.Run("disallowed origin", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/items/1", nil)
+		r.Header.Set(HeaderOrigin, "https://evil.com")
+		w := testServe(app, r)
+		if v := w.Header().Get(HeaderAccessControlAllowOrigin); v != "" {
+			t.Fatalf("allow origin wanted empty. got: %s", v)
+		}
+		if v := w.Header().Get(HeaderVary); v != HeaderOrigin {
+			t.Fatalf("vary wanted: Origin. got: %s", v)
+		}
+	})
+}
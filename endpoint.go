@@ -1,12 +1,14 @@
 package prate
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"reflect"
 	"sync"
+	"time"
 
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
@@ -28,6 +30,8 @@ type endpoint struct {
 	// responsePayload protoreflect.ProtoMessage
 	mexclusions []string
 	requestPool sync.Pool
+	config      EndpointConfig
+	app         *App
 }
 
 func (ep *endpoint) initPools() {
@@ -93,31 +97,81 @@ func (ep *endpoint) initPools() {
 // }
 
 func (ep *endpoint) handle(f func(string, httprouter.Handle)) {
-	f(ep.path, func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	serve := func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 		rd, ok := requestDataPool.Get().(*RequestData)
 		if !ok {
 			panic(wrapErr(fmt.Errorf("requestDataPool returned not *RequestData.... aaaaaaa")))
 		}
+		// Set when a timed out handler is left running. Whatever it
+		// still references must not go back to the pools.
+		var abandoned bool
+		// Run by an abandoned handler once it returns
+		var release func()
 		defer func() {
+			if abandoned {
+				return
+			}
 			rd.Custom = nil
+			rd.Files = nil
+			rd.patch = nil
+			rd.patchType = ""
+			rd.patchBase = nil
 			requestDataPool.Put(rd)
 		}()
 		rd.Custom = map[string]interface{}{}
 		rd.Params = params
 
-		badrequest := func(msg string) {
+		reject := func(code int, msg string) {
 			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-			w.WriteHeader(StatusBadRequest)
+			w.WriteHeader(code)
 			w.Write([]byte(msg))
 		}
+		badrequest := func(msg string) {
+			reject(StatusBadRequest, msg)
+		}
 
-		// Request Payload
-		if ep.requestPayload != nil {
+		if ep.config.Multipart != nil && isMultipartForm(r) {
+			var body proto.Message
+			if ep.requestPayload != nil {
+				pv := ep.requestPool.Get().(reflect.Value)
+				defer func() {
+					if !abandoned {
+						ep.requestPool.Put(pv)
+					}
+				}()
+				reflect.ValueOf(rd).Elem().FieldByName("Body").Set(pv)
+				body = rd.Body
+			}
+			mf, err := parseMultipart(r, body, *ep.config.Multipart)
+			if err != nil {
+				e, ok := err.(*Error)
+				if !ok {
+					log.Println(err)
+					e = NewError(StatusInternalServerError)
+				}
+				reject(e.Code, e.Error())
+				return
+			}
+			// An abandoned handler may still be reading spilled
+			// files. They're removed once it returns.
+			release = mf.cleanup
+			defer func() {
+				if !abandoned {
+					mf.cleanup()
+				}
+			}()
+			rd.Files = mf.files
+		} else if ep.requestPayload != nil {
+			// Request Payload
 			pv := ep.requestPool.Get()
 			if pv == nil {
 				panic(wrapErr(fmt.Errorf("requestPayload Pool returned nil....aaaaaaaa")))
 			}
-			defer ep.requestPool.Put(pv)
+			defer func() {
+				if !abandoned {
+					ep.requestPool.Put(pv)
+				}
+			}()
 
 			v, ok := pv.(reflect.Value)
 			if !ok {
@@ -135,7 +189,15 @@ func (ep *endpoint) handle(f func(string, httprouter.Handle)) {
 				}
 			}
 
-			if len(bs) > 0 {
+			if len(bs) > 0 && ep.config.PatchLoader != nil && isPatchDocument(r) {
+				// Applied to the loaded resource once the
+				// middlewares have run. Body is pooled and
+				// would otherwise carry a previous request.
+				proto.Reset(rd.Body)
+				rd.patch = bs
+				rd.patchType = mediaType(r)
+			} else if len(bs) > 0 || rpcCallFrom(r) != nil {
+				// RPC clients send empty messages as empty bodies
 				if err := proto.Unmarshal(bs, rd.Body); err != nil {
 					log.Println(wrapErr(err, "request unmarshal failed"))
 					badrequest("invalid payload")
@@ -147,44 +209,74 @@ func (ep *endpoint) handle(f func(string, httprouter.Handle)) {
 			}
 		}
 
+		var tw *timeoutWriter
+		if d := ep.timeout(r); d > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			r = r.WithContext(ctx)
+			tw = newTimeoutWriter(w)
+			w = tw
+		}
+
 		rc, ok := rcPool.Get().(*RequestCtx)
 		if !ok {
 			panic(`rcpool returned something thats not a RequestCtx... aaaaaaaaa!!`)
 		}
 		defer func() {
+			if abandoned {
+				return
+			}
 			rc.reset()
 			rcPool.Put(rc)
 		}()
 		rc.update(w, r)
+		rc.endpoint = ep
 
-		resp, err := ep.handler(rc, rd)
-		if err != nil {
-			if err := errorHandler(rc, err); err != nil {
-				log.Println(wrapErr(err))
-			}
+		if tw != nil {
+			abandoned = !ep.serveWithTimeout(tw, rc, rd, release)
 			return
 		}
+		resp, err := ep.handler(rc, rd)
+		writeResponse(rc, resp, err)
+	}
+	f(ep.path, ep.withRPC(serve))
+}
 
-		if rc.ResponseWriter.written {
-			return
+// Writes the outcome of a Handler unless the handler
+// already wrote the response itself.
+func writeResponse(rc *RequestCtx, resp protoreflect.ProtoMessage, err error) {
+	if err != nil {
+		if err := errorHandler(rc, err); err != nil {
+			log.Println(wrapErr(err))
 		}
+		return
+	}
 
-		var resBody []byte
-		err = nil
-		if resp != nil {
-			resBody, err = proto.Marshal(resp)
-			if err != nil {
+	if rc.ResponseWriter.written {
+		return
+	}
+	if call := rpcCallFrom(rc.Request); call != nil {
+		call.setResponse(resp)
+	}
+
+	var resBody []byte
+	if resp != nil {
+		resBody, err = proto.Marshal(resp)
+		if err != nil {
+			log.Println(wrapErr(err))
+			if err := errorHandler(rc, NewError(StatusInternalServerError)); err != nil {
 				log.Println(wrapErr(err))
-				if err := errorHandler(rc, NewError(StatusInternalServerError)); err != nil {
-					log.Println(wrapErr(err))
-				}
-				return
 			}
-			rc.ResponseWriter.Header().Set("Content-Type", ContentTypePROTO.String())
+			return
 		}
-		rc.ResponseWriter.WriteHeader(StatusOK)
-		rc.ResponseWriter.Write(resBody)
-	})
+		rc.ResponseWriter.Header().Set("Content-Type", ContentTypePROTO.String())
+	}
+	code := StatusOK
+	if rc.status != 0 {
+		code = rc.status
+	}
+	rc.ResponseWriter.WriteHeader(code)
+	rc.ResponseWriter.Write(resBody)
 }
 
 // func (ep *endpoint) pathItem() (*openapi3.PathItem, error) {
@@ -212,8 +304,27 @@ type EndpointConfig struct {
 	Path               string
 	Handler            Handler
 	RequestPayloadType protoreflect.ProtoMessage
-	ExcludeMiddlewares []string
-	method             string
+	// The message the handler returns. Optional, used where the
+	// response has to be decoded again, such as Connect JSON
+	// responses served from a cache.
+	ResponsePayloadType protoreflect.ProtoMessage
+	ExcludeMiddlewares  []string
+	SecureHeaders       *SecureHeadersConfig
+	RateLimit           *RateLimit
+	Auth                AuthMode
+	Policies            []Policy
+	Timeout             time.Duration
+	Concurrency         *ConcurrencyOptions
+	Priority            Priority
+	ETagLoader          ETagLoader
+	Cache               *CachePolicy
+	Coalesce            *CoalesceOptions
+	Multipart           *MultipartOptions
+	Pagination          *PaginationOptions
+	PatchLoader         PatchLoader
+	method              string
+	// Served as a Twirp method, see App.Twirp
+	twirp bool
 }
 
 func NewEndpointConfig(path string, handler Handler) EndpointConfig {
@@ -238,11 +349,95 @@ func (ec EndpointConfig) WithRequestPayloadType(pt protoreflect.ProtoMessage) En
 	return ec
 }
 
+func (ec EndpointConfig) WithResponsePayloadType(pt protoreflect.ProtoMessage) EndpointConfig {
+	ec.ResponsePayloadType = pt
+	return ec
+}
+
 func (ec EndpointConfig) WithPath(p string) EndpointConfig {
 	ec.Path = p
 	return ec
 }
 
+// Overrides the headers set by the SecureHeaders middleware for
+// this endpoint. Only the non empty fields of sh are applied.
+func (ec EndpointConfig) WithSecureHeaders(sh SecureHeadersConfig) EndpointConfig {
+	ec.SecureHeaders = &sh
+	return ec
+}
+
+// Gives the endpoint its own quota, enforced by the RateLimiter
+// middleware independently of every other endpoint.
+func (ec EndpointConfig) WithRateLimit(rl RateLimit) EndpointConfig {
+	ec.RateLimit = &rl
+	return ec
+}
+
+// Sets whether the Authentication middleware requires
+// credentials for this endpoint.
+func (ec EndpointConfig) WithAuth(m AuthMode) EndpointConfig {
+	ec.Auth = m
+	return ec
+}
+
+// Adds authorization policies. All of them must allow
+// the request for the handler to run.
+func (ec EndpointConfig) WithPolicy(ps ...Policy) EndpointConfig {
+	ec.Policies = append(append([]Policy{}, ec.Policies...), ps...)
+	return ec
+}
+
+// Sets a deadline on the handler. The handler observes it through
+// RequestCtx.Context. A handler still running once it expires gets
+// its response replaced with a 504.
+func (ec EndpointConfig) WithTimeout(d time.Duration) EndpointConfig {
+	ec.Timeout = d
+	return ec
+}
+
+// Caps the requests this endpoint serves at once, on top
+// of any app wide ConcurrencyLimiter.
+func (ec EndpointConfig) WithConcurrencyLimit(co ConcurrencyOptions) EndpointConfig {
+	ec.Concurrency = &co
+	return ec
+}
+
+// Sets how the endpoint is treated by concurrency limiters once
+// their limit is reached. PriorityCritical endpoints are never shed.
+func (ec EndpointConfig) WithPriority(p Priority) EndpointConfig {
+	ec.Priority = p
+	return ec
+}
+
+// Lets the ETags middleware check If-Match and If-Unmodified-Since
+// against the stored resource before the handler runs.
+func (ec EndpointConfig) WithETagLoader(l ETagLoader) EndpointConfig {
+	ec.ETagLoader = l
+	return ec
+}
+
+// Caches the responses of the endpoint. Requires App.UseCache.
+func (ec EndpointConfig) WithCache(cp CachePolicy) EndpointConfig {
+	ec.Cache = &cp
+	return ec
+}
+
+type CoalesceOptions struct {
+	// Request headers that must match, besides method, path and
+	// query, for two requests to share an execution
+	Headers []string
+}
+
+// Runs identical concurrent GET requests as a single handler
+// execution whose response is replayed to every caller. Only use
+// on endpoints whose response doesn't depend on anything outside
+// the key, such as the Principal, unless the headers carrying
+// it are listed.
+func (ec EndpointConfig) WithCoalescing(co CoalesceOptions) EndpointConfig {
+	ec.Coalesce = &co
+	return ec
+}
+
 func (ec *EndpointConfig) applyMiddlerwares(ms []*Middleware) {
 	exm := map[string]bool{}
 	for _, s := range ec.ExcludeMiddlewares {
@@ -265,6 +460,10 @@ func (ec EndpointConfig) endpoint() *endpoint {
 		handler:        ec.Handler,
 		requestPayload: ec.RequestPayloadType,
 		mexclusions:    ec.ExcludeMiddlewares,
+		config:         ec,
+	}
+	if ec.Concurrency != nil {
+		ep.handler = newConcurrencyLimiter(*ec.Concurrency).wrap(endpointPriority, ep.handler)
 	}
 	ep.initPools()
 	return ep
@@ -13,6 +13,13 @@ func (e *Error) Error() string {
 	return strings.Join(e.Message, "\n")
 }
 
+// Errors with the same Code match, so errors.Is(err, ErrForbidden)
+// holds for any 403 regardless of its message.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
 func NewError(code int, message ...string) *Error {
 	e := &Error{
 		Code:    code,
@@ -0,0 +1,192 @@
+package prate
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Loads the validators of the resource an unsafe request targets
+// so If-Match and If-Unmodified-Since can be checked before the
+// handler runs. An empty etag and zero time mean the resource
+// doesn't exist.
+type ETagLoader func(*RequestCtx, *RequestData) (etag string, lastModified time.Time, err error)
+
+// Sets the ETag header. Unquoted values are quoted.
+func (rc *RequestCtx) SetETag(etag string) {
+	rc.ResponseWriter.Header().Set(HeaderETag, quoteETag(etag))
+}
+
+// Sets the Last-Modified header
+func (rc *RequestCtx) SetLastModified(t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	rc.ResponseWriter.Header().Set(HeaderLastModified, t.UTC().Format(http.TimeFormat))
+}
+
+// Evaluates If-Match and If-Unmodified-Since against the current
+// validators of the resource. Returns ErrPreconditionFailed when
+// the client's copy is stale. Handlers that can't provide an
+// ETagLoader call this themselves.
+func (rc *RequestCtx) CheckPreconditions(etag string, lastModified time.Time) error {
+	r := rc.Request
+	if im := r.Header.Get(HeaderIfMatch); im != "" {
+		if !etagListMatches(im, etag, false) {
+			return ErrPreconditionFailed
+		}
+		return nil
+	}
+	if ius := r.Header.Get(HeaderIfUnmodifiedSince); ius != "" && !lastModified.IsZero() {
+		t, err := http.ParseTime(ius)
+		if err == nil && lastModified.Truncate(time.Second).After(t) {
+			return ErrPreconditionFailed
+		}
+	}
+	return nil
+}
+
+// Strong ETag of a message derived from its deterministic encoding
+func ProtoETag(m protoreflect.ProtoMessage) (string, error) {
+	bs, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+	if err != nil {
+		return "", wrapErr(err)
+	}
+	sum := sha256.Sum256(bs)
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`, nil
+}
+
+func quoteETag(etag string) string {
+	if strings.HasPrefix(etag, `"`) || strings.HasPrefix(etag, `W/"`) {
+		return etag
+	}
+	return `"` + etag + `"`
+}
+
+// Reports whether etag matches an If-Match or If-None-Match list.
+// If-None-Match uses the weak comparison, If-Match the strong one.
+func etagListMatches(list, etag string, weak bool) bool {
+	if etag == "" {
+		return false
+	}
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	if !weak && strings.HasPrefix(etag, "W/") {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Methods whose preconditions guard against lost updates
+func isUnsafeMethod(m string) bool {
+	switch m {
+	case http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// Returns a middleware with ID "etag". GET and HEAD responses get a
+// strong ETag computed from the deterministic protobuf encoding of
+// the response unless the handler set one with RequestCtx.SetETag.
+// Matching If-None-Match or If-Modified-Since requests get a 304.
+// For PUT, PATCH and DELETE endpoints with an ETagLoader a stale
+// If-Match or If-Unmodified-Since is answered with a 412 before
+// the handler runs.
+func ETags() *Middleware {
+	return &Middleware{
+		ID: "etag",
+		Handler: func(h Handler) Handler {
+			return func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+				r := rc.Request
+				if isUnsafeMethod(r.Method) {
+					if err := checkLoadedPreconditions(rc, rd); err != nil {
+						return nil, err
+					}
+					return h(rc, rd)
+				}
+				if r.Method != http.MethodGet && r.Method != http.MethodHead {
+					return h(rc, rd)
+				}
+
+				resp, err := h(rc, rd)
+				if err != nil || rc.ResponseWriter.written {
+					return resp, err
+				}
+				hd := rc.ResponseWriter.Header()
+				if hd.Get(HeaderETag) == "" && resp != nil {
+					etag, err := ProtoETag(resp)
+					if err != nil {
+						return nil, wrapErr(err)
+					}
+					hd.Set(HeaderETag, etag)
+				}
+				if notModified(r, hd) {
+					hd.Del(HeaderContentType)
+					hd.Del(HeaderContentLength)
+					rc.ResponseWriter.WriteHeader(StatusNotModified)
+					return nil, nil
+				}
+				return resp, nil
+			}
+		},
+	}
+}
+
+func checkLoadedPreconditions(rc *RequestCtx, rd *RequestData) error {
+	r := rc.Request
+	if r.Header.Get(HeaderIfMatch) == "" && r.Header.Get(HeaderIfUnmodifiedSince) == "" {
+		return nil
+	}
+	if rc.endpoint == nil || rc.endpoint.config.ETagLoader == nil {
+		return nil
+	}
+	etag, lm, err := rc.endpoint.config.ETagLoader(rc, rd)
+	if err != nil {
+		// Not wrapped so an *Error such as ErrNotFound keeps its code
+		return err
+	}
+	if etag != "" {
+		etag = quoteETag(etag)
+	}
+	return rc.CheckPreconditions(etag, lm)
+}
+
+func notModified(r *http.Request, hd http.Header) bool {
+	if inm := r.Header.Get(HeaderIfNoneMatch); inm != "" {
+		return etagListMatches(inm, hd.Get(HeaderETag), true)
+	}
+	ims := r.Header.Get(HeaderIfModifiedSince)
+	lm := hd.Get(HeaderLastModified)
+	if ims == "" || lm == "" {
+		return false
+	}
+	imsT, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	lmT, err := http.ParseTime(lm)
+	if err != nil {
+		return false
+	}
+	return !lmT.After(imsT)
+}
@@ -0,0 +1,94 @@
+package prate
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/daimaou92/prate/pb/fortest"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func TestETagListMatches(t *testing.T) {
+	tsts := []struct {
+		list, etag string
+		weak, want bool
+	}{
+		{`"a"`, `"a"`, false, true},
+		{`"b", "a"`, `"a"`, false, true},
+		{`W/"a"`, `"a"`, false, false},
+		{`W/"a"`, `"a"`, true, true},
+		{`"a"`, `W/"a"`, false, false},
+		{`*`, `"a"`, false, true},
+		{`*`, ``, false, false},
+	}
+	for _, tst := range tsts {
+		if got := etagListMatches(tst.list, tst.etag, tst.weak); got != tst.want {
+			t.Fatalf("etagListMatches(%q, %q, %v) wanted: %v. got: %v", tst.list, tst.etag, tst.weak, tst.want, got)
+		}
+	}
+}
+
+func TestETags(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := &fortest.TestRes{Key: "k", Value: "v1"}
+	modified := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	app.GET(NewEndpointConfig("/res", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		rc.SetLastModified(modified)
+		return current, nil
+	}))
+	app.PUT(NewEndpointConfig("/res", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		req := rd.Body.(*fortest.TestReq)
+		current = &fortest.TestRes{Key: req.Key, Value: req.Value}
+		return current, nil
+	}).WithRequestPayloadType(&fortest.TestReq{}).WithETagLoader(
+		func(*RequestCtx, *RequestData) (string, time.Time, error) {
+			etag, err := ProtoETag(current)
+			return etag, modified, err
+		},
+	))
+	if err := app.Apply(ETags()); err != nil {
+		t.Fatal(err)
+	}
+	app.mountEndpoints()
+
+	w := testServe(app, httptest.NewRequest(http.MethodGet, "/res", nil))
+	etag := w.Header().Get(HeaderETag)
+	if w.Code != StatusOK || etag == "" {
+		t.Fatalf("wanted 200 with etag. got: %d %q", w.Code, etag)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/res", nil)
+	r.Header.Set(HeaderIfNoneMatch, etag)
+	if w := testServe(app, r); w.Code != StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("wanted 304 without body. got: %d %d bytes", w.Code, w.Body.Len())
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/res", nil)
+	r.Header.Set(HeaderIfModifiedSince, modified.Format(http.TimeFormat))
+	if w := testServe(app, r); w.Code != StatusNotModified {
+		t.Fatalf("if-modified-since wanted 304. got: %d", w.Code)
+	}
+
+	put := func(ifMatch string) int {
+		bs, _ := proto.Marshal(&fortest.TestReq{Key: "k", Value: "v2"})
+		r := httptest.NewRequest(http.MethodPut, "/res", bytes.NewReader(bs))
+		r.Header.Set(HeaderIfMatch, ifMatch)
+		return testServe(app, r).Code
+	}
+	if code := put(`"stale"`); code != StatusPreconditionFailed {
+		t.Fatalf("stale if-match wanted: %d. got: %d", StatusPreconditionFailed, code)
+	}
+	if code := put(etag); code != StatusOK {
+		t.Fatalf("fresh if-match wanted: %d. got: %d", StatusOK, code)
+	}
+	if code := put(etag); code != StatusPreconditionFailed {
+		t.Fatalf("replayed if-match wanted: %d. got: %d", StatusPreconditionFailed, code)
+	}
+}
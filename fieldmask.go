@@ -0,0 +1,221 @@
+package prate
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// Field paths below a field of a mask. A field with no children
+// is selected whole.
+type maskTree map[protoreflect.Name]maskTree
+
+// Resolves dotted paths, by proto or JSON field names, against md.
+// Paths may go through repeated message fields when traverseLists is
+// set. Unknown paths are reported as a 400 *Error.
+func newMaskTree(md protoreflect.MessageDescriptor, paths []string, traverseLists bool) (maskTree, error) {
+	root := maskTree{}
+	for _, p := range paths {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		node := root
+		cur := md
+		names := strings.Split(p, ".")
+		for i, name := range names {
+			if cur == nil {
+				return nil, NewError(StatusBadRequest, fmt.Sprintf("invalid field path %q", p))
+			}
+			fd := cur.Fields().ByName(protoreflect.Name(name))
+			if fd == nil {
+				fd = cur.Fields().ByJSONName(name)
+			}
+			if fd == nil {
+				return nil, NewError(StatusBadRequest, fmt.Sprintf("unknown field %q in path %q", name, p))
+			}
+			last := i == len(names)-1
+			child, seen := node[fd.Name()]
+			if seen && child == nil {
+				// Already selected whole
+				break
+			}
+			if last {
+				node[fd.Name()] = nil
+				break
+			}
+			cur = nil
+			if fd.Message() != nil && !fd.IsMap() && (!fd.IsList() || traverseLists) {
+				cur = fd.Message()
+			}
+			if child == nil {
+				child = maskTree{}
+				node[fd.Name()] = child
+			}
+			node = child
+		}
+	}
+	return root, nil
+}
+
+// Clears every field of m outside the tree
+func (t maskTree) prune(m protoreflect.Message) {
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		sub, ok := t[fd.Name()]
+		switch {
+		case !ok:
+			m.Clear(fd)
+		case sub == nil:
+		case fd.IsList():
+			l := v.List()
+			for i := 0; i < l.Len(); i++ {
+				sub.prune(l.Get(i).Message())
+			}
+		default:
+			sub.prune(v.Message())
+		}
+		return true
+	})
+}
+
+// Returns a copy of m holding only the fields selected by paths.
+// Nested paths such as "author.name" keep part of a message and
+// paths through repeated messages apply to every element.
+func TrimToPaths(m proto.Message, paths []string) (proto.Message, error) {
+	t, err := trimTree(m.ProtoReflect().Descriptor(), paths)
+	if err != nil || t == nil {
+		return m, err
+	}
+	c := proto.Clone(m)
+	t.prune(c.ProtoReflect())
+	return c, nil
+}
+
+// Copies the fields selected by mask from src to dst, as expected of
+// a PATCH with an update mask. Selected fields unset in src are
+// cleared in dst. A mask that is nil, empty or "*" copies every
+// field. Paths can't go through repeated fields. Unknown paths are
+// reported as a 400 *Error.
+func ApplyFieldMask(dst, src proto.Message, mask *fieldmaskpb.FieldMask) error {
+	dm, sm := dst.ProtoReflect(), src.ProtoReflect()
+	if dm.Descriptor().FullName() != sm.Descriptor().FullName() {
+		return wrapErr(fmt.Errorf("mismatched messages %s and %s",
+			dm.Descriptor().FullName(), sm.Descriptor().FullName()))
+	}
+	paths := mask.GetPaths()
+	if len(paths) == 0 || (len(paths) == 1 && paths[0] == "*") {
+		proto.Reset(dst)
+		proto.Merge(dst, src)
+		return nil
+	}
+	t, err := newMaskTree(dm.Descriptor(), paths, false)
+	if err != nil {
+		return err
+	}
+	t.copy(dm, sm)
+	return nil
+}
+
+func (t maskTree) copy(dst, src protoreflect.Message) {
+	for name, sub := range t {
+		fd := dst.Descriptor().Fields().ByName(name)
+		if sub != nil {
+			if !src.Has(fd) && !dst.Has(fd) {
+				continue
+			}
+			// An unset src message reads as empty, clearing the
+			// nested fields in dst
+			sub.copy(dst.Mutable(fd).Message(), src.Get(fd).Message())
+			continue
+		}
+		dst.Clear(fd)
+		if !src.Has(fd) {
+			continue
+		}
+		switch {
+		case fd.IsList():
+			sl, dl := src.Get(fd).List(), dst.Mutable(fd).List()
+			for i := 0; i < sl.Len(); i++ {
+				dl.Append(cloneValue(fd, sl.Get(i)))
+			}
+		case fd.IsMap():
+			sm, dmap := src.Get(fd).Map(), dst.Mutable(fd).Map()
+			sm.Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+				dmap.Set(k, cloneValue(fd.MapValue(), v))
+				return true
+			})
+		default:
+			dst.Set(fd, cloneValue(fd, src.Get(fd)))
+		}
+	}
+}
+
+// Deep copies message values so dst and src share nothing
+func cloneValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) protoreflect.Value {
+	if fd.Message() == nil {
+		return v
+	}
+	return protoreflect.ValueOfMessage(proto.Clone(v.Message().Interface()).ProtoReflect())
+}
+
+// Reads the requested field mask from the fields query parameter,
+// or failing that the X-Field-Mask header
+func requestedFields(rc *RequestCtx) ([]string, bool) {
+	r := rc.Request
+	v := r.URL.Query().Get("fields")
+	if v == "" {
+		v = r.Header.Get(HeaderXFieldMask)
+		if v == "" {
+			return nil, false
+		}
+	}
+	return strings.Split(v, ","), true
+}
+
+// The tree of paths to trim a md message to. Nil when a path
+// is "*".
+func trimTree(md protoreflect.MessageDescriptor, paths []string) (maskTree, error) {
+	for _, p := range paths {
+		if strings.TrimSpace(p) == "*" {
+			return nil, nil
+		}
+	}
+	return newMaskTree(md, paths, true)
+}
+
+// Returns a middleware with ID "fieldmask". When a request carries
+// a fields query parameter or an X-Field-Mask header, both a comma
+// separated list of field paths, the response message is trimmed to
+// those paths before it is encoded. Paths unknown to the response
+// message are answered with a 400, before the handler runs on
+// endpoints declaring a ResponsePayloadType.
+func FieldMasks() *Middleware {
+	return &Middleware{
+		ID: "fieldmask",
+		Handler: func(h Handler) Handler {
+			return func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+				addVary(rc.ResponseWriter.Header(), HeaderXFieldMask)
+				paths, ok := requestedFields(rc)
+				if ok && rc.endpoint != nil && rc.endpoint.config.ResponsePayloadType != nil {
+					// Rejected before the handler has any side effects
+					md := rc.endpoint.config.ResponsePayloadType.ProtoReflect().Descriptor()
+					if _, err := trimTree(md, paths); err != nil {
+						return nil, err
+					}
+				}
+				resp, err := h(rc, rd)
+				if !ok || err != nil || resp == nil || rc.ResponseWriter.written {
+					return resp, err
+				}
+				trimmed, err := TrimToPaths(resp, paths)
+				if err != nil {
+					return nil, err
+				}
+				return trimmed, nil
+			}
+		},
+	}
+}
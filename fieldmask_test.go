@@ -0,0 +1,132 @@
+package prate
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/daimaou92/prate/pb/fortest"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+func TestTrimToPaths(t *testing.T) {
+	fd := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("a.proto"),
+		Package: proto.String("pkg"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("A"), Field: []*descriptorpb.FieldDescriptorProto{{Name: proto.String("x")}}},
+			{Name: proto.String("B")},
+		},
+		Options: &descriptorpb.FileOptions{JavaPackage: proto.String("j"), GoPackage: proto.String("g")},
+	}
+	got, err := TrimToPaths(fd, []string{"name", "messageType.name", "options.go_package"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &descriptorpb.FileDescriptorProto{
+		Name:        proto.String("a.proto"),
+		MessageType: []*descriptorpb.DescriptorProto{{Name: proto.String("A")}, {Name: proto.String("B")}},
+		Options:     &descriptorpb.FileOptions{GoPackage: proto.String("g")},
+	}
+	if !proto.Equal(got, want) {
+		t.Fatalf("wanted: %v. got: %v", want, got)
+	}
+	if fd.GetPackage() != "pkg" {
+		t.Fatal("original message modified")
+	}
+	if _, err := TrimToPaths(fd, []string{"name.nope"}); err == nil {
+		t.Fatal("path through a scalar accepted")
+	}
+}
+
+func TestApplyFieldMask(t *testing.T) {
+	stored := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("a.proto"),
+		Package:    proto.String("pkg"),
+		Dependency: []string{"x.proto"},
+		Options:    &descriptorpb.FileOptions{JavaPackage: proto.String("j"), GoPackage: proto.String("g")},
+	}
+	patch := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("ignored.proto"),
+		Package: proto.String("pkg2"),
+		Options: &descriptorpb.FileOptions{GoPackage: proto.String("g2")},
+	}
+	mask := &fieldmaskpb.FieldMask{Paths: []string{"package", "dependency", "options.go_package"}}
+	if err := ApplyFieldMask(stored, patch, mask); err != nil {
+		t.Fatal(err)
+	}
+	want := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("a.proto"),
+		Package: proto.String("pkg2"),
+		Options: &descriptorpb.FileOptions{JavaPackage: proto.String("j"), GoPackage: proto.String("g2")},
+	}
+	if !proto.Equal(stored, want) {
+		t.Fatalf("wanted: %v. got: %v", want, stored)
+	}
+
+	err := ApplyFieldMask(stored, patch, &fieldmaskpb.FieldMask{Paths: []string{"nope"}})
+	if e, ok := err.(*Error); !ok || e.Code != StatusBadRequest {
+		t.Fatalf("unknown path wanted a 400. got: %v", err)
+	}
+}
+
+func TestFieldMaskMiddleware(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.GET(NewEndpointConfig("/res", func(*RequestCtx, *RequestData) (protoreflect.ProtoMessage, error) {
+		return &fortest.TestRes{Key: "k", Value: "v"}, nil
+	}))
+	created := 0
+	app.POST(NewEndpointConfig("/res", func(*RequestCtx, *RequestData) (protoreflect.ProtoMessage, error) {
+		created++
+		return &fortest.TestRes{Key: "k"}, nil
+	}).WithResponsePayloadType(&fortest.TestRes{}))
+	if err := app.Apply(FieldMasks()); err != nil {
+		t.Fatal(err)
+	}
+	app.mountEndpoints()
+
+	tests := []struct {
+		query, header string
+		code          int
+		want          *fortest.TestRes
+	}{
+		{"", "", StatusOK, &fortest.TestRes{Key: "k", Value: "v"}},
+		{"?fields=key", "", StatusOK, &fortest.TestRes{Key: "k"}},
+		{"", "value", StatusOK, &fortest.TestRes{Value: "v"}},
+		{"?fields=nope", "", StatusBadRequest, nil},
+	}
+	for _, tst := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/res"+tst.query, nil)
+		if tst.header != "" {
+			r.Header.Set(HeaderXFieldMask, tst.header)
+		}
+		w := testServe(app, r)
+		if w.Code != tst.code {
+			t.Fatalf("%q %q: code wanted: %d. got: %d", tst.query, tst.header, tst.code, w.Code)
+		}
+		if tst.want == nil {
+			continue
+		}
+		var res fortest.TestRes
+		if err := proto.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(&res, tst.want) {
+			t.Fatalf("%q %q: wanted: %v. got: %v", tst.query, tst.header, tst.want, &res)
+		}
+	}
+
+	// Unknown paths are rejected before the handler runs
+	bs, _ := proto.Marshal(&fortest.TestReq{Key: "k"})
+	w := testServe(app, httptest.NewRequest(http.MethodPost, "/res?fields=nope", bytes.NewReader(bs)))
+	if w.Code != StatusBadRequest || created != 0 {
+		t.Fatalf("unknown path wanted: %d without side effects. got: %d %d", StatusBadRequest, w.Code, created)
+	}
+}
@@ -0,0 +1,168 @@
+package filter
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Reports whether m satisfies the filter. m must be of the message
+// type the filter was parsed against.
+func (f *Filter) Match(m proto.Message) bool {
+	if f == nil || f.Expr == nil {
+		return true
+	}
+	return eval(f.Expr, m.ProtoReflect())
+}
+
+func eval(e Expr, m protoreflect.Message) bool {
+	switch e := e.(type) {
+	case *Logical:
+		for _, a := range e.Args {
+			ok := eval(a, m)
+			if e.Op == Or && ok {
+				return true
+			}
+			if e.Op == And && !ok {
+				return false
+			}
+		}
+		return e.Op == And
+	case *Not:
+		return !eval(e.Arg, m)
+	case *Restriction:
+		return e.match(m)
+	}
+	return false
+}
+
+// Walks to the message holding the last field of p. Unset messages
+// along the way read as empty ones.
+func parentOf(m protoreflect.Message, p Path) protoreflect.Message {
+	for _, fd := range p.Fields[:len(p.Fields)-1] {
+		m = m.Get(fd).Message()
+	}
+	return m
+}
+
+func (r *Restriction) match(m protoreflect.Message) bool {
+	parent := parentOf(m, r.Path)
+	fd := r.Path.Leaf()
+
+	if r.Value.Present {
+		if fd.IsList() {
+			return parent.Get(fd).List().Len() > 0
+		}
+		return parent.Has(fd)
+	}
+	if fd.IsList() {
+		l := parent.Get(fd).List()
+		for i := 0; i < l.Len(); i++ {
+			if r.compare(fd, l.Get(i)) {
+				return true
+			}
+		}
+		return false
+	}
+	return r.compare(fd, parent.Get(fd))
+}
+
+// Applies the operator to a single field value
+func (r *Restriction) compare(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+	if r.Value.Wildcard {
+		ok := r.Value.pattern.MatchString(v.String())
+		if r.Op == NotEquals {
+			return !ok
+		}
+		return ok
+	}
+	var c int
+	if isTimestamp(fd) {
+		c = compareTime(timestampOf(v.Message()), r.Value.Time)
+	} else {
+		c = compareScalar(fd.Kind(), v, r.Value.Proto)
+	}
+	switch r.Op {
+	case Equals, Has:
+		return c == 0
+	case NotEquals:
+		return c != 0
+	case Less:
+		return c < 0
+	case LessEquals:
+		return c <= 0
+	case Greater:
+		return c > 0
+	case GreaterEquals:
+		return c >= 0
+	}
+	return false
+}
+
+func wildcardRegexp(pattern string) *regexp.Regexp {
+	parts := strings.Split(pattern, "*")
+	for i, p := range parts {
+		parts[i] = regexp.QuoteMeta(p)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+}
+
+func timestampOf(m protoreflect.Message) time.Time {
+	fields := m.Descriptor().Fields()
+	secs := m.Get(fields.ByName("seconds")).Int()
+	nanos := m.Get(fields.ByName("nanos")).Int()
+	return time.Unix(secs, nanos).UTC()
+}
+
+func compareTime(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+// Three way comparison of two values of a scalar or enum kind
+func compareScalar(k protoreflect.Kind, a, b protoreflect.Value) int {
+	switch k {
+	case protoreflect.StringKind:
+		return strings.Compare(a.String(), b.String())
+	case protoreflect.BytesKind:
+		return bytes.Compare(a.Bytes(), b.Bytes())
+	case protoreflect.BoolKind:
+		if a.Bool() == b.Bool() {
+			return 0
+		}
+		if !a.Bool() {
+			return -1
+		}
+		return 1
+	case protoreflect.EnumKind:
+		return compareOrdered(int64(a.Enum()), int64(b.Enum()))
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return compareOrdered(a.Int(), b.Int())
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind,
+		protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return compareOrdered(a.Uint(), b.Uint())
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return compareOrdered(a.Float(), b.Float())
+	}
+	return 0
+}
+
+func compareOrdered[T int64 | uint64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,495 @@
+// Package filter parses AIP-160 style filter expressions and
+// order_by clauses against the descriptor of a protobuf message.
+// Parsed filters can be evaluated over messages in memory or
+// translated to SQL.
+//
+// Supported are comparisons (=, !=, <, <=, >, >=), the has operator
+// (:), AND, OR, NOT and - negation, implicit AND between adjacent
+// terms, parentheses, dotted field paths through singular message
+// fields and * wildcards in string values. Functions and global
+// restrictions such as a bare search term are not.
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/daimaou92/prate/internal/protoscalar"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// A parse or validation failure
+type Error struct {
+	// Byte offset in the input
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("filter: position %d: %s", e.Pos, e.Msg)
+}
+
+func errorf(pos int, format string, args ...interface{}) *Error {
+	return &Error{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+type Operator string
+
+const (
+	Equals        Operator = "="
+	NotEquals     Operator = "!="
+	Less          Operator = "<"
+	LessEquals    Operator = "<="
+	Greater       Operator = ">"
+	GreaterEquals Operator = ">="
+	Has           Operator = ":"
+)
+
+func (op Operator) ordering() bool {
+	switch op {
+	case Less, LessEquals, Greater, GreaterEquals:
+		return true
+	}
+	return false
+}
+
+// A node of a parsed filter: *Logical, *Not or *Restriction
+type Expr interface {
+	String() string
+	expr()
+}
+
+type LogicalOp string
+
+const (
+	And LogicalOp = "AND"
+	Or  LogicalOp = "OR"
+)
+
+// Two or more expressions joined by AND or OR
+type Logical struct {
+	Op   LogicalOp
+	Args []Expr
+}
+
+// Negation of an expression
+type Not struct {
+	Arg Expr
+}
+
+// A comparison of a field against a value
+type Restriction struct {
+	Path  Path
+	Op    Operator
+	Value Value
+}
+
+func (*Logical) expr()     {}
+func (*Not) expr()         {}
+func (*Restriction) expr() {}
+
+func (l *Logical) String() string {
+	parts := make([]string, len(l.Args))
+	for i, a := range l.Args {
+		parts[i] = a.String()
+	}
+	return "(" + strings.Join(parts, " "+string(l.Op)+" ") + ")"
+}
+
+func (n *Not) String() string {
+	return "NOT " + n.Arg.String()
+}
+
+func (r *Restriction) String() string {
+	return r.Path.String() + " " + string(r.Op) + " " + strconv.Quote(r.Value.Raw)
+}
+
+// A field path resolved against a message descriptor
+type Path struct {
+	Names  []string
+	Fields []protoreflect.FieldDescriptor
+}
+
+func (p Path) String() string {
+	return strings.Join(p.Names, ".")
+}
+
+// The field the path ends at
+func (p Path) Leaf() protoreflect.FieldDescriptor {
+	return p.Fields[len(p.Fields)-1]
+}
+
+// The right hand side of a Restriction, typed after the field
+type Value struct {
+	// The literal as written, unquoted
+	Raw string
+	// Scalar and enum fields
+	Proto protoreflect.Value
+	// google.protobuf.Timestamp fields
+	Time time.Time
+	// A string value containing * wildcards
+	Wildcard bool
+	// A lone * with the has operator, testing for presence
+	Present bool
+	pattern *regexp.Regexp
+}
+
+// A parsed filter. The zero Filter matches everything.
+type Filter struct {
+	// Nil when the expression was empty
+	Expr    Expr
+	Message protoreflect.MessageDescriptor
+}
+
+func (f *Filter) String() string {
+	if f == nil || f.Expr == nil {
+		return ""
+	}
+	return f.Expr.String()
+}
+
+// Parses expr and validates its field paths and values against md
+func Parse(expr string, md protoreflect.MessageDescriptor) (*Filter, error) {
+	toks, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+	f := &Filter{Message: md}
+	if len(toks) == 1 {
+		return f, nil
+	}
+	p := &parser{toks: toks, md: md}
+	e, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tkEOF {
+		return nil, errorf(t.pos, "unexpected %q", t.text)
+	}
+	f.Expr = e
+	return f, nil
+}
+
+type tokenKind int
+
+const (
+	tkEOF tokenKind = iota
+	tkLParen
+	tkRParen
+	tkComparator
+	tkString
+	tkText
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func isSpecial(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\r', '(', ')', '"', '\'', '=', '!', '<', '>', ':', ',':
+		return true
+	}
+	return false
+}
+
+func lex(s string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			toks = append(toks, token{tkLParen, "(", i})
+			i++
+		case c == ')':
+			toks = append(toks, token{tkRParen, ")", i})
+			i++
+		case c == '"' || c == '\'':
+			start := i
+			var sb strings.Builder
+			i++
+			for {
+				if i >= len(s) {
+					return nil, errorf(start, "unterminated string")
+				}
+				if s[i] == c {
+					i++
+					break
+				}
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+					switch s[i] {
+					case 'n':
+						sb.WriteByte('\n')
+					case 't':
+						sb.WriteByte('\t')
+					default:
+						sb.WriteByte(s[i])
+					}
+					i++
+					continue
+				}
+				sb.WriteByte(s[i])
+				i++
+			}
+			toks = append(toks, token{tkString, sb.String(), start})
+		case c == '=' || c == ':':
+			toks = append(toks, token{tkComparator, string(c), i})
+			i++
+		case c == '!' || c == '<' || c == '>':
+			if i+1 < len(s) && s[i+1] == '=' {
+				toks = append(toks, token{tkComparator, s[i : i+2], i})
+				i += 2
+				continue
+			}
+			if c == '!' {
+				return nil, errorf(i, "unexpected '!'")
+			}
+			toks = append(toks, token{tkComparator, string(c), i})
+			i++
+		case c == ',':
+			return nil, errorf(i, "unexpected ','")
+		default:
+			start := i
+			for i < len(s) && !isSpecial(s[i]) {
+				i++
+			}
+			toks = append(toks, token{tkText, s[start:i], start})
+		}
+	}
+	return append(toks, token{tkEOF, "", len(s)}), nil
+}
+
+type parser struct {
+	toks []token
+	i    int
+	md   protoreflect.MessageDescriptor
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tkEOF {
+		p.i++
+	}
+	return t
+}
+
+func isKeyword(t token, kw string) bool {
+	return t.kind == tkText && t.text == kw
+}
+
+func join(op LogicalOp, args []Expr) Expr {
+	if len(args) == 1 {
+		return args[0]
+	}
+	return &Logical{Op: op, Args: args}
+}
+
+// expression: sequence {AND sequence}
+func (p *parser) expression() (Expr, error) {
+	var args []Expr
+	for {
+		e, err := p.sequence()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, e)
+		if !isKeyword(p.peek(), "AND") {
+			return join(And, args), nil
+		}
+		p.next()
+	}
+}
+
+// sequence: factor {factor}, adjacent factors are ANDed
+func (p *parser) sequence() (Expr, error) {
+	var args []Expr
+	for {
+		e, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, e)
+		t := p.peek()
+		if t.kind == tkLParen || t.kind == tkString ||
+			(t.kind == tkText && !isKeyword(t, "AND") && !isKeyword(t, "OR")) {
+			continue
+		}
+		return join(And, args), nil
+	}
+}
+
+// factor: term {OR term}
+func (p *parser) factor() (Expr, error) {
+	var args []Expr
+	for {
+		e, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, e)
+		if !isKeyword(p.peek(), "OR") {
+			return join(Or, args), nil
+		}
+		p.next()
+	}
+}
+
+// term: [NOT | -] simple
+func (p *parser) term() (Expr, error) {
+	t := p.peek()
+	negate := false
+	switch {
+	case isKeyword(t, "NOT"):
+		p.next()
+		negate = true
+	case t.kind == tkText && t.text == "-":
+		p.next()
+		negate = true
+	case t.kind == tkText && strings.HasPrefix(t.text, "-"):
+		p.toks[p.i].text = t.text[1:]
+		p.toks[p.i].pos++
+		negate = true
+	}
+	e, err := p.simple()
+	if err != nil {
+		return nil, err
+	}
+	if negate {
+		return &Not{Arg: e}, nil
+	}
+	return e, nil
+}
+
+// simple: restriction | "(" expression ")"
+func (p *parser) simple() (Expr, error) {
+	t := p.peek()
+	if t.kind == tkLParen {
+		p.next()
+		e, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if c := p.next(); c.kind != tkRParen {
+			return nil, errorf(c.pos, "expected ')'")
+		}
+		return e, nil
+	}
+	return p.restriction()
+}
+
+func (p *parser) restriction() (Expr, error) {
+	t := p.next()
+	switch {
+	case t.kind == tkEOF:
+		return nil, errorf(t.pos, "unexpected end of filter")
+	case t.kind != tkText || isKeyword(t, "AND") || isKeyword(t, "OR") || isKeyword(t, "NOT"):
+		return nil, errorf(t.pos, "expected a field, got %q", t.text)
+	}
+	path, err := ResolvePath(t.text, p.md)
+	if err != nil {
+		return nil, errorf(t.pos, "%v", err)
+	}
+	c := p.next()
+	if c.kind != tkComparator {
+		return nil, errorf(t.pos, "global restrictions are not supported, compare %s against a value", t.text)
+	}
+	v := p.next()
+	if v.kind != tkString && v.kind != tkText {
+		return nil, errorf(v.pos, "expected a value after %s", c.text)
+	}
+	r := &Restriction{Path: path, Op: Operator(c.text)}
+	if err := r.typeValue(v.text, v.kind == tkString); err != nil {
+		return nil, errorf(v.pos, "%s: %v", t.text, err)
+	}
+	return r, nil
+}
+
+// Resolves a dotted field path against md. Every field but the last
+// must be a singular message.
+func ResolvePath(s string, md protoreflect.MessageDescriptor) (Path, error) {
+	var p Path
+	names := strings.Split(s, ".")
+	for i, name := range names {
+		if md == nil {
+			return Path{}, fmt.Errorf("%s is not a message", strings.Join(p.Names, "."))
+		}
+		fd := md.Fields().ByName(protoreflect.Name(name))
+		if fd == nil {
+			fd = md.Fields().ByJSONName(name)
+		}
+		if fd == nil {
+			return Path{}, fmt.Errorf("unknown field %q in %s", name, md.FullName())
+		}
+		if fd.IsMap() {
+			return Path{}, fmt.Errorf("map field %s is not supported", name)
+		}
+		p.Names = append(p.Names, string(fd.Name()))
+		p.Fields = append(p.Fields, fd)
+		md = nil
+		if fd.Message() != nil && !fd.IsList() {
+			md = fd.Message()
+		}
+		if i < len(names)-1 && fd.IsList() {
+			return Path{}, fmt.Errorf("can't traverse repeated field %s", name)
+		}
+	}
+	return p, nil
+}
+
+const timestampName = "google.protobuf.Timestamp"
+
+func isTimestamp(fd protoreflect.FieldDescriptor) bool {
+	return fd.Message() != nil && fd.Message().FullName() == timestampName
+}
+
+// Checks the operator suits the field and types the value
+func (r *Restriction) typeValue(raw string, quoted bool) error {
+	fd := r.Path.Leaf()
+	r.Value.Raw = raw
+	if r.Op == Has && raw == "*" && !quoted {
+		r.Value.Present = true
+		return nil
+	}
+	if fd.IsList() && r.Op != Has {
+		return fmt.Errorf("repeated fields only support the : operator")
+	}
+	if fd.Message() != nil && !isTimestamp(fd) {
+		return fmt.Errorf("message fields only support :*")
+	}
+	if isTimestamp(fd) {
+		t, err := time.Parse(time.RFC3339Nano, raw)
+		if err != nil {
+			return fmt.Errorf("invalid timestamp %q", raw)
+		}
+		r.Value.Time = t
+		return nil
+	}
+	if fd.Kind() == protoreflect.BoolKind && r.Op.ordering() {
+		return fmt.Errorf("booleans can't be ordered")
+	}
+	if fd.Kind() == protoreflect.StringKind && strings.Contains(raw, "*") {
+		if r.Op != Equals && r.Op != NotEquals && r.Op != Has {
+			return fmt.Errorf("wildcards need = or !=")
+		}
+		r.Value.Wildcard = true
+		r.Value.pattern = wildcardRegexp(raw)
+	}
+	v, err := protoscalar.Parse(fd, raw)
+	if err != nil {
+		return err
+	}
+	r.Value.Proto = v
+	return nil
+}
@@ -0,0 +1,152 @@
+package filter
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+var fileMD = (&descriptorpb.FileDescriptorProto{}).ProtoReflect().Descriptor()
+
+func testFiles() []*descriptorpb.FileDescriptorProto {
+	return []*descriptorpb.FileDescriptorProto{
+		{
+			Name:       proto.String("a.proto"),
+			Package:    proto.String("pkg.one"),
+			Dependency: []string{"google/protobuf/empty.proto"},
+			Options: &descriptorpb.FileOptions{
+				JavaPackage: proto.String("com.example"),
+				OptimizeFor: descriptorpb.FileOptions_SPEED.Enum(),
+			},
+			PublicDependency: []int32{0},
+		},
+		{
+			Name:    proto.String("b.proto"),
+			Package: proto.String("pkg.two"),
+			Options: &descriptorpb.FileOptions{
+				OptimizeFor: descriptorpb.FileOptions_LITE_RUNTIME.Enum(),
+				Deprecated:  proto.Bool(true),
+			},
+		},
+		{
+			Name:    proto.String("c.proto"),
+			Package: proto.String("other"),
+		},
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"nope = 1",
+		"name",
+		"name = ",
+		"dependency = \"x\"",
+		"options = 1",
+		"options.deprecated > true",
+		"options.optimize_for = FAST",
+		"public_dependency : abc",
+		"(name = \"a\"",
+		"name = \"a\" AND",
+		"name.x = 1",
+		"name ! \"a\"",
+		"\"bare\"",
+	}
+	for _, expr := range tests {
+		if _, err := Parse(expr, fileMD); err == nil {
+			t.Fatalf("%q: wanted an error", expr)
+		} else if _, ok := err.(*Error); !ok {
+			t.Fatalf("%q: wanted *Error. got: %T", expr, err)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		{"", []string{"a.proto", "b.proto", "c.proto"}},
+		{`name = "a.proto"`, []string{"a.proto"}},
+		{`package = "pkg.*"`, []string{"a.proto", "b.proto"}},
+		{`package != pkg.*`, []string{"c.proto"}},
+		{`name > "a.proto" name < c.proto`, []string{"b.proto"}},
+		{`options.optimize_for = LITE_RUNTIME OR options.java_package = "com.example"`, []string{"a.proto", "b.proto"}},
+		{`options.optimize_for >= CODE_SIZE`, []string{"b.proto"}},
+		{`options.deprecated = true`, []string{"b.proto"}},
+		{`NOT options:*`, []string{"c.proto"}},
+		{`-options.deprecated = true AND package = "pkg*"`, []string{"a.proto"}},
+		{`-(name = "a.proto" OR name = "b.proto")`, []string{"c.proto"}},
+		{`dependency:"google/protobuf/empty.proto"`, []string{"a.proto"}},
+		{`dependency:*`, []string{"a.proto"}},
+		{`public_dependency:0`, []string{"a.proto"}},
+	}
+	for _, tst := range tests {
+		f, err := Parse(tst.expr, fileMD)
+		if err != nil {
+			t.Fatalf("%q: %v", tst.expr, err)
+		}
+		var got []string
+		for _, fd := range testFiles() {
+			if f.Match(fd) {
+				got = append(got, fd.GetName())
+			}
+		}
+		if !reflect.DeepEqual(got, tst.want) {
+			t.Fatalf("%q (%s): wanted: %v. got: %v", tst.expr, f, tst.want, got)
+		}
+	}
+}
+
+func TestOrderBy(t *testing.T) {
+	ob, err := ParseOrderBy("options.deprecated desc, name", fileMD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := testFiles()
+	sort.Slice(files, func(i, j int) bool { return ob.Compare(files[i], files[j]) < 0 })
+	var got []string
+	for _, f := range files {
+		got = append(got, f.GetName())
+	}
+	if !reflect.DeepEqual(got, []string{"b.proto", "a.proto", "c.proto"}) {
+		t.Fatalf("unexpected order %v", got)
+	}
+
+	for _, s := range []string{"dependency", "options", "name sideways", "name,", "nope"} {
+		if _, err := ParseOrderBy(s, fileMD); err == nil {
+			t.Fatalf("%q: wanted an error", s)
+		}
+	}
+}
+
+func TestSQL(t *testing.T) {
+	f, err := Parse(`(package = "pkg_*" OR options.optimize_for = LITE_RUNTIME) -name = "a.proto" options:*`, fileMD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	where, args, err := f.SQL(SQLOptions{Placeholder: Dollar})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantWhere := `((package LIKE $1 ESCAPE '!' OR options_optimize_for = $2) AND NOT (name = $3) AND options IS NOT NULL)`
+	if where != wantWhere {
+		t.Fatalf("where wanted:\n%s\ngot:\n%s", wantWhere, where)
+	}
+	wantArgs := []interface{}{`pkg!_%`, int64(3), "a.proto"}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Fatalf("args wanted: %v. got: %v", wantArgs, args)
+	}
+
+	ob, _ := ParseOrderBy("options.deprecated desc, name", fileMD)
+	if s, _ := ob.SQL(SQLOptions{}); s != "options_deprecated DESC, name ASC" {
+		t.Fatalf("unexpected order by %q", s)
+	}
+
+	f, _ = Parse(`dependency:"x"`, fileMD)
+	if _, _, err := f.SQL(SQLOptions{}); err == nil {
+		t.Fatal("repeated field translated")
+	}
+}
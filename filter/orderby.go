@@ -0,0 +1,93 @@
+package filter
+
+import (
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// One field of an order_by clause
+type Order struct {
+	Path Path
+	Desc bool
+}
+
+// A parsed order_by clause, most significant field first
+type OrderBy []Order
+
+func (o OrderBy) String() string {
+	parts := make([]string, len(o))
+	for i, ord := range o {
+		parts[i] = ord.Path.String()
+		if ord.Desc {
+			parts[i] += " desc"
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Parses a clause such as "priority desc, create_time" and checks
+// every field is a singular scalar, enum or Timestamp of md
+func ParseOrderBy(s string, md protoreflect.MessageDescriptor) (OrderBy, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var ob OrderBy
+	pos := 0
+	for _, part := range strings.Split(s, ",") {
+		words := strings.Fields(part)
+		switch {
+		case len(words) == 0:
+			return nil, errorf(pos, "empty order_by field")
+		case len(words) > 2:
+			return nil, errorf(pos, "unexpected %q", words[2])
+		}
+		ord := Order{}
+		if len(words) == 2 {
+			switch strings.ToLower(words[1]) {
+			case "desc":
+				ord.Desc = true
+			case "asc":
+			default:
+				return nil, errorf(pos, "expected asc or desc, got %q", words[1])
+			}
+		}
+		p, err := ResolvePath(words[0], md)
+		if err != nil {
+			return nil, errorf(pos, "%v", err)
+		}
+		fd := p.Leaf()
+		if fd.IsList() || (fd.Message() != nil && !isTimestamp(fd)) {
+			return nil, errorf(pos, "can't order by %s", words[0])
+		}
+		ord.Path = p
+		ob = append(ob, ord)
+		pos += len(part) + 1
+	}
+	return ob, nil
+}
+
+// Three way comparison of a and b under the ordering, usable with
+// sort.Slice
+func (o OrderBy) Compare(a, b proto.Message) int {
+	ma, mb := a.ProtoReflect(), b.ProtoReflect()
+	for _, ord := range o {
+		fd := ord.Path.Leaf()
+		va := parentOf(ma, ord.Path).Get(fd)
+		vb := parentOf(mb, ord.Path).Get(fd)
+		var c int
+		if isTimestamp(fd) {
+			c = compareTime(timestampOf(va.Message()), timestampOf(vb.Message()))
+		} else {
+			c = compareScalar(fd.Kind(), va, vb)
+		}
+		if ord.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
@@ -0,0 +1,161 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+type SQLOptions struct {
+	// Returns the placeholder of the nth argument, counted from 1.
+	// Defaults to "?". Use Dollar for PostgreSQL.
+	Placeholder func(n int) string
+	// Returns the column storing a field. Defaults to the field
+	// names of the path joined with "_".
+	Column func(p Path) (string, error)
+}
+
+// PostgreSQL style placeholders: $1, $2...
+func Dollar(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+func (o *SQLOptions) defaults() {
+	if o.Placeholder == nil {
+		o.Placeholder = func(int) string { return "?" }
+	}
+	if o.Column == nil {
+		o.Column = func(p Path) (string, error) {
+			return strings.Join(p.Names, "_"), nil
+		}
+	}
+}
+
+// Translates the filter into a condition for a WHERE clause and its
+// arguments. Values never end up in the SQL text. Returns an empty
+// condition for an empty filter. Restrictions on repeated fields
+// can't be translated.
+func (f *Filter) SQL(opts SQLOptions) (string, []interface{}, error) {
+	if f == nil || f.Expr == nil {
+		return "", nil, nil
+	}
+	opts.defaults()
+	st := &sqlTranslator{opts: opts}
+	s, err := st.expr(f.Expr)
+	if err != nil {
+		return "", nil, err
+	}
+	return s, st.args, nil
+}
+
+type sqlTranslator struct {
+	opts SQLOptions
+	args []interface{}
+}
+
+func (st *sqlTranslator) arg(v interface{}) string {
+	st.args = append(st.args, v)
+	return st.opts.Placeholder(len(st.args))
+}
+
+func (st *sqlTranslator) expr(e Expr) (string, error) {
+	switch e := e.(type) {
+	case *Logical:
+		parts := make([]string, len(e.Args))
+		for i, a := range e.Args {
+			s, err := st.expr(a)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = s
+		}
+		return "(" + strings.Join(parts, " "+string(e.Op)+" ") + ")", nil
+	case *Not:
+		s, err := st.expr(e.Arg)
+		if err != nil {
+			return "", err
+		}
+		return "NOT (" + s + ")", nil
+	case *Restriction:
+		return st.restriction(e)
+	}
+	return "", fmt.Errorf("filter: unexpected expression %T", e)
+}
+
+// Escapes with ! rather than a backslash, which MySQL treats as an
+// escape inside string literals too
+var likeEscaper = strings.NewReplacer(`!`, `!!`, `%`, `!%`, `_`, `!_`)
+
+func (st *sqlTranslator) restriction(r *Restriction) (string, error) {
+	fd := r.Path.Leaf()
+	if fd.IsList() {
+		return "", fmt.Errorf("filter: %s: repeated fields can't be translated to SQL", r.Path)
+	}
+	col, err := st.opts.Column(r.Path)
+	if err != nil {
+		return "", err
+	}
+	if r.Value.Present {
+		return col + " IS NOT NULL", nil
+	}
+	if r.Value.Wildcard {
+		pattern := strings.ReplaceAll(likeEscaper.Replace(r.Value.Raw), "*", "%")
+		op := "LIKE"
+		if r.Op == NotEquals {
+			op = "NOT LIKE"
+		}
+		return fmt.Sprintf(`%s %s %s ESCAPE '!'`, col, op, st.arg(pattern)), nil
+	}
+
+	op := string(r.Op)
+	switch r.Op {
+	case Has:
+		op = "="
+	case NotEquals:
+		op = "<>"
+	}
+	var v interface{}
+	if isTimestamp(fd) {
+		v = r.Value.Time
+	} else {
+		v = sqlValue(fd.Kind(), r.Value.Proto)
+	}
+	return fmt.Sprintf("%s %s %s", col, op, st.arg(v)), nil
+}
+
+// Go value handed to database/sql for a field value. Enums are
+// passed as their number.
+func sqlValue(k protoreflect.Kind, v protoreflect.Value) interface{} {
+	switch k {
+	case protoreflect.EnumKind:
+		return int64(v.Enum())
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return v.Int()
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind,
+		protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return v.Uint()
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return v.Float()
+	}
+	return v.Interface()
+}
+
+// Translates the ordering into the body of an ORDER BY clause
+func (o OrderBy) SQL(opts SQLOptions) (string, error) {
+	opts.defaults()
+	parts := make([]string, len(o))
+	for i, ord := range o {
+		col, err := opts.Column(ord.Path)
+		if err != nil {
+			return "", err
+		}
+		dir := "ASC"
+		if ord.Desc {
+			dir = "DESC"
+		}
+		parts[i] = col + " " + dir
+	}
+	return strings.Join(parts, ", "), nil
+}
@@ -0,0 +1,340 @@
+package prate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// A named dependency check, for example a database ping
+type Checker interface {
+	Name() string
+	// Returns nil when the dependency is healthy
+	Check(ctx context.Context) error
+}
+
+type checkerFunc struct {
+	name string
+	f    func(context.Context) error
+}
+
+func (c checkerFunc) Name() string {
+	return c.name
+}
+
+func (c checkerFunc) Check(ctx context.Context) error {
+	return c.f(ctx)
+}
+
+// Builds a Checker out of a function
+func NewChecker(name string, f func(ctx context.Context) error) Checker {
+	return checkerFunc{name: name, f: f}
+}
+
+type HealthCheck struct {
+	Checker Checker
+	// Defaults to two seconds
+	Timeout time.Duration
+	// How long a result is reused before the check runs again.
+	// Zero runs the check on every readiness probe.
+	CacheTTL time.Duration
+	// A failing optional check is reported but doesn't
+	// make the App not ready.
+	Optional bool
+}
+
+type HealthOptions struct {
+	// Defaults to "/livez"
+	LivenessPath string
+	// Defaults to "/readyz"
+	ReadinessPath string
+	Checks        []HealthCheck
+	// Time between App.Shutdown failing readiness and the listeners
+	// closing, giving load balancers a chance to stop routing traffic.
+	DrainDelay time.Duration
+	// Middlewares the health endpoints skip, typically "auth"
+	ExcludeMiddlewares []string
+}
+
+const (
+	HealthStatusOK   = "ok"
+	HealthStatusWarn = "warn"
+	HealthStatusFail = "fail"
+)
+
+type CheckResult struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+	Cached    bool    `json:"cached,omitempty"`
+}
+
+type HealthReport struct {
+	Status string        `json:"status"`
+	Reason string        `json:"reason,omitempty"`
+	Checks []CheckResult `json:"checks,omitempty"`
+}
+
+func (hr HealthReport) Marshal() ([]byte, error) {
+	bs, err := json.Marshal(hr)
+	if err != nil {
+		return nil, wrapErr(err, "json marshal failed")
+	}
+	return bs, nil
+}
+
+func (hr *HealthReport) Unmarshal(src []byte) error {
+	var t HealthReport
+	if err := json.Unmarshal(src, &t); err != nil {
+		return wrapErr(err, "json unmarshal failed")
+	}
+	*hr = t
+	return nil
+}
+
+func (HealthReport) ContentType() ContentType {
+	return ContentTypeJSON
+}
+
+type cachedCheck struct {
+	HealthCheck
+	mu     sync.Mutex
+	last   CheckResult
+	expiry time.Time
+}
+
+func (cc *cachedCheck) run(ctx context.Context) CheckResult {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.CacheTTL > 0 && time.Now().Before(cc.expiry) {
+		res := cc.last
+		res.Cached = true
+		return res
+	}
+
+	timeout := cc.Timeout
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	errc := make(chan error, 1)
+	go func() {
+		// A panicking checker fails its check, not the process
+		defer func() {
+			if p := recover(); p != nil {
+				errc <- fmt.Errorf("panic: %v", p)
+			}
+		}()
+		errc <- cc.Checker.Check(ctx)
+	}()
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+
+	res := CheckResult{
+		Name:      cc.Checker.Name(),
+		Status:    HealthStatusOK,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		res.Error = err.Error()
+		res.Status = HealthStatusFail
+		if cc.Optional {
+			res.Status = HealthStatusWarn
+		}
+	}
+	cc.last = res
+	cc.expiry = time.Now().Add(cc.CacheTTL)
+	return res
+}
+
+// Registers a hook run once the App starts listening. The readiness
+// endpoint reports not ready until every hook has returned nil.
+// Start retries failing hooks until they succeed.
+func (app *App) OnReady(f func(ctx context.Context) error) {
+	app.readyHooks = append(app.readyHooks, f)
+}
+
+// Reports whether the OnReady hooks completed and the
+// App is not shutting down
+func (app *App) Ready() bool {
+	return app.ready.Load() && !app.draining.Load()
+}
+
+// Runs the OnReady hooks that haven't succeeded yet, in order, and
+// stops at the first error. Start calls it. Apps serving through a
+// listener of their own call it once they are up, again on error.
+func (app *App) RunReadyHooks(ctx context.Context) error {
+	app.readyMu.Lock()
+	defer app.readyMu.Unlock()
+	for app.readyRun < len(app.readyHooks) {
+		if err := app.readyHooks[app.readyRun](ctx); err != nil {
+			return wrapErr(err, "ready hook failed")
+		}
+		app.readyRun++
+	}
+	app.ready.Store(true)
+	return nil
+}
+
+const maxReadyRetryDelay = 30 * time.Second
+
+// Runs the OnReady hooks until they succeed or the App shuts down
+func (app *App) runReadyHooks(ctx context.Context) {
+	delay := 100 * time.Millisecond
+	for {
+		err := app.RunReadyHooks(ctx)
+		if err == nil || app.draining.Load() {
+			return
+		}
+		log.Println(err)
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+		if delay *= 2; delay > maxReadyRetryDelay {
+			delay = maxReadyRetryDelay
+		}
+	}
+}
+
+// Fails readiness, waits for the drain delay configured through
+// App.Health and then gracefully shuts the server down and stops
+// the workers of App.Operations.
+func (app *App) Shutdown(ctx context.Context) error {
+	app.draining.Store(true)
+	if app.drainDelay > 0 {
+		t := time.NewTimer(app.drainDelay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+		}
+	}
+	if err := app.Server.Shutdown(ctx); err != nil {
+		return wrapErr(err)
+	}
+	if app.operations != nil {
+		return app.operations.shutdown(ctx)
+	}
+	return nil
+}
+
+// Registers liveness and readiness endpoints. Both are
+// PriorityCritical so concurrency limiters never shed them.
+func (app *App) Health(opts HealthOptions) error {
+	if app == nil || app.router == nil {
+		return wrapErr(fmt.Errorf("app not initialized"))
+	}
+	if opts.LivenessPath == "" {
+		opts.LivenessPath = "/livez"
+	}
+	if opts.ReadinessPath == "" {
+		opts.ReadinessPath = "/readyz"
+	}
+	checks := make([]*cachedCheck, 0, len(opts.Checks))
+	for _, c := range opts.Checks {
+		if c.Checker == nil {
+			return wrapErr(fmt.Errorf("health check without a Checker"))
+		}
+		checks = append(checks, &cachedCheck{HealthCheck: c})
+	}
+	app.drainDelay = opts.DrainDelay
+
+	app.GET(NewEndpointConfig(opts.LivenessPath, func(rc *RequestCtx, _ *RequestData) (protoreflect.ProtoMessage, error) {
+		return nil, writeHealthReport(rc, HealthReport{Status: HealthStatusOK})
+	}).WithPriority(PriorityCritical).WithExclude(opts.ExcludeMiddlewares...))
+
+	app.GET(NewEndpointConfig(opts.ReadinessPath, func(rc *RequestCtx, _ *RequestData) (protoreflect.ProtoMessage, error) {
+		return nil, writeHealthReport(rc, app.readiness(rc.Context(), checks))
+	}).WithPriority(PriorityCritical).WithExclude(opts.ExcludeMiddlewares...))
+	return nil
+}
+
+func (app *App) readiness(ctx context.Context, checks []*cachedCheck) HealthReport {
+	hr := HealthReport{Status: HealthStatusOK}
+	switch {
+	case app.draining.Load():
+		return HealthReport{Status: HealthStatusFail, Reason: "shutting down"}
+	case !app.ready.Load():
+		return HealthReport{Status: HealthStatusFail, Reason: "starting"}
+	}
+
+	hr.Checks = make([]CheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c *cachedCheck) {
+			defer wg.Done()
+			hr.Checks[i] = c.run(ctx)
+		}(i, c)
+	}
+	wg.Wait()
+
+	for _, c := range hr.Checks {
+		if c.Status == HealthStatusFail {
+			hr.Status = HealthStatusFail
+		} else if c.Status == HealthStatusWarn && hr.Status == HealthStatusOK {
+			hr.Status = HealthStatusWarn
+		}
+	}
+	return hr
+}
+
+func writeHealthReport(rc *RequestCtx, hr HealthReport) error {
+	code := StatusOK
+	if hr.Status == HealthStatusFail {
+		code = StatusServiceUnavailable
+	}
+	bs, err := hr.Marshal()
+	if err != nil {
+		return wrapErr(err)
+	}
+	rc.ResponseWriter.Header().Set(HeaderCacheControl, "no-store")
+	return writeJSONOrStruct(rc, code, bs)
+}
+
+// Writes a JSON document as is, or as a protobuf encoded
+// google.protobuf.Struct when the client accepts protobuf
+func writeJSONOrStruct(rc *RequestCtx, code int, bs []byte) error {
+	ct := ContentTypeJSON
+	if strings.Contains(rc.Request.Header.Get(HeaderAccept), ContentTypePROTO.String()) {
+		m := map[string]interface{}{}
+		if err := json.Unmarshal(bs, &m); err != nil {
+			return wrapErr(err)
+		}
+		s, err := structpb.NewStruct(m)
+		if err != nil {
+			return wrapErr(err)
+		}
+		if bs, err = proto.Marshal(s); err != nil {
+			return wrapErr(err)
+		}
+		ct = ContentTypePROTO
+	}
+
+	rc.ResponseWriter.Header().Set(HeaderContentType, ct.String())
+	rc.ResponseWriter.WriteHeader(code)
+	if _, err := rc.ResponseWriter.Write(bs); err != nil {
+		return wrapErr(err)
+	}
+	return nil
+}
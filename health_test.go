@@ -0,0 +1,138 @@
+package prate
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbCalls := 0
+	dbErr := error(nil)
+	if err := app.Health(HealthOptions{
+		Checks: []HealthCheck{
+			{
+				Checker: NewChecker("db", func(context.Context) error {
+					dbCalls++
+					return dbErr
+				}),
+				CacheTTL: time.Minute,
+			}, {
+				Checker: NewChecker("cache", func(ctx context.Context) error {
+					<-ctx.Done()
+					return ctx.Err()
+				}),
+				Timeout:  10 * time.Millisecond,
+				Optional: true,
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	hookDone := false
+	app.OnReady(func(context.Context) error {
+		hookDone = true
+		return nil
+	})
+	app.mountEndpoints()
+
+	probe := func(path string) (int, HealthReport) {
+		w := testServe(app, httptest.NewRequest(http.MethodGet, path, nil))
+		var hr HealthReport
+		if err := hr.Unmarshal(w.Body.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, hr
+	}
+
+	if code, _ := probe("/livez"); code != StatusOK {
+		t.Fatalf("liveness wanted: %d. got: %d", StatusOK, code)
+	}
+	if code, hr := probe("/readyz"); code != StatusServiceUnavailable || hr.Reason != "starting" {
+		t.Fatalf("readiness before hooks wanted 503 starting. got: %d %+v", code, hr)
+	}
+
+	app.runReadyHooks(context.TODO())
+	if !hookDone || !app.Ready() {
+		t.Fatalf("ready hooks did not run")
+	}
+	code, hr := probe("/readyz")
+	if code != StatusOK || hr.Status != HealthStatusWarn || len(hr.Checks) != 2 {
+		t.Fatalf("readiness wanted 200 warn. got: %d %+v", code, hr)
+	}
+	if hr.Checks[1].Status != HealthStatusWarn || hr.Checks[1].Error == "" {
+		t.Fatalf("optional check should warn on timeout: %+v", hr.Checks[1])
+	}
+
+	dbErr = errors.New("down")
+	if _, hr := probe("/readyz"); !hr.Checks[0].Cached || dbCalls != 1 {
+		t.Fatalf("db check result should be cached: %+v calls: %d", hr.Checks[0], dbCalls)
+	}
+
+	app.draining.Store(true)
+	if code, hr := probe("/readyz"); code != StatusServiceUnavailable || hr.Reason != "shutting down" {
+		t.Fatalf("readiness while draining wanted 503. got: %d %+v", code, hr)
+	}
+}
+
+func TestHealthCheckPanic(t *testing.T) {
+	cc := &cachedCheck{HealthCheck: HealthCheck{
+		Checker: NewChecker("queue", func(context.Context) error {
+			panic("no connection")
+		}),
+	}}
+	res := cc.run(context.Background())
+	if res.Status != HealthStatusFail || res.Error != "panic: no connection" {
+		t.Fatalf("panicking check wanted fail. got: %+v", res)
+	}
+}
+
+func TestReadyHooksRetry(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first, second int
+	app.OnReady(func(context.Context) error {
+		first++
+		return nil
+	})
+	app.OnReady(func(context.Context) error {
+		if second++; second < 3 {
+			return errors.New("not yet")
+		}
+		return nil
+	})
+	for i := 0; i < 2; i++ {
+		if err := app.RunReadyHooks(context.Background()); err == nil || app.Ready() {
+			t.Fatalf("attempt %d should fail", i+1)
+		}
+	}
+	if err := app.RunReadyHooks(context.Background()); err != nil || !app.Ready() {
+		t.Fatalf("third attempt wanted ready. got: %v", err)
+	}
+	if first != 1 || second != 3 {
+		t.Fatalf("succeeded hooks should not run again. runs: %d %d", first, second)
+	}
+
+	// Retried by runReadyHooks
+	app, _ = New(AppOptions{})
+	calls := 0
+	app.OnReady(func(context.Context) error {
+		if calls++; calls < 2 {
+			return errors.New("not yet")
+		}
+		return nil
+	})
+	app.runReadyHooks(context.Background())
+	if !app.Ready() || calls != 2 {
+		t.Fatalf("runReadyHooks wanted a retry. calls: %d", calls)
+	}
+}
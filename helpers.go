@@ -162,6 +162,9 @@ const (
 	HeaderLastModified                    = "Last-Modified"
 	HeaderVary                            = "Vary"
 	HeaderConnection                      = "Connection"
+	HeaderConnectProtocolVersion          = "Connect-Protocol-Version"
+	HeaderConnectTimeoutMs                = "Connect-Timeout-Ms"
+	HeaderGRPCTimeout                     = "Grpc-Timeout"
 	HeaderKeepAlive                       = "Keep-Alive"
 	HeaderAccept                          = "Accept"
 	HeaderAcceptCharset                   = "Accept-Charset"
@@ -213,6 +216,8 @@ const (
 	HeaderContentSecurityPolicy           = "Content-Security-Policy"
 	HeaderContentSecurityPolicyReportOnly = "Content-Security-Policy-Report-Only"
 	HeaderCrossOriginResourcePolicy       = "Cross-Origin-Resource-Policy"
+	HeaderCrossOriginOpenerPolicy         = "Cross-Origin-Opener-Policy"
+	HeaderCrossOriginEmbedderPolicy       = "Cross-Origin-Embedder-Policy"
 	HeaderExpectCT                        = "Expect-CT"
 	// Deprecated: use HeaderPermissionsPolicy instead
 	HeaderFeaturePolicy           = "Feature-Policy"
@@ -245,10 +250,16 @@ const (
 	HeaderAltSvc                  = "Alt-Svc"
 	HeaderDate                    = "Date"
 	HeaderIndex                   = "Index"
+	HeaderIdempotencyKey          = "Idempotency-Key"
+	HeaderIdempotentReplayed      = "Idempotent-Replayed"
 	HeaderLargeAllocation         = "Large-Allocation"
 	HeaderLink                    = "Link"
 	HeaderPushPolicy              = "Push-Policy"
 	HeaderRetryAfter              = "Retry-After"
+	HeaderRateLimitLimit          = "RateLimit-Limit"
+	HeaderRateLimitRemaining      = "RateLimit-Remaining"
+	HeaderRateLimitReset          = "RateLimit-Reset"
+	HeaderRateLimitPolicy         = "RateLimit-Policy"
 	HeaderServerTiming            = "Server-Timing"
 	HeaderSignature               = "Signature"
 	HeaderSignedHeaders           = "Signed-Headers"
@@ -257,6 +268,11 @@ const (
 	HeaderXDNSPrefetchControl     = "X-DNS-Prefetch-Control"
 	HeaderXPingback               = "X-Pingback"
 	HeaderXRequestID              = "X-Request-ID"
+	HeaderXRequestTimeout         = "X-Request-Timeout"
+	HeaderXCache                  = "X-Cache"
+	HeaderXFieldMask              = "X-Field-Mask"
+	HeaderXPagination             = "X-Pagination"
+	HeaderXTotalCount             = "X-Total-Count"
 	HeaderXRequestedWith          = "X-Requested-With"
 	HeaderXRobotsTag              = "X-Robots-Tag"
 	HeaderXUACompatible           = "X-UA-Compatible"
@@ -456,6 +472,19 @@ const (
 	ContentTypePROTO ContentType = "application/vnd.google.protobuf"
 	ContentTypeHTML  ContentType = "text/html; charset=utf-8"
 	ContentTypeTEXT  ContentType = "text/plain; charset=utf-8"
+	// RFC 7386
+	ContentTypeMergePatch ContentType = "application/merge-patch+json"
+	// RFC 6902
+	ContentTypeJSONPatch ContentType = "application/json-patch+json"
+	// Twirp
+	ContentTypeTwirpProto ContentType = "application/protobuf"
+	// Connect unary protocol
+	ContentTypeConnectProto ContentType = "application/proto"
+	// gRPC-Web, with binary or base64 encoded bodies
+	ContentTypeGRPCWeb          ContentType = "application/grpc-web"
+	ContentTypeGRPCWebProto     ContentType = "application/grpc-web+proto"
+	ContentTypeGRPCWebText      ContentType = "application/grpc-web-text"
+	ContentTypeGRPCWebTextProto ContentType = "application/grpc-web-text+proto"
 )
 
 func wrapErr(err error, msgs ...string) error {
@@ -0,0 +1,215 @@
+package prate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// The state of a request made with an Idempotency-Key
+type IdempotencyRecord struct {
+	// Digest of the method, path and body of the first request
+	Fingerprint string
+	// False while the first request is still being served
+	Completed bool
+	Status    int
+	Header    http.Header
+	Body      []byte
+}
+
+// Storage for idempotency records. Implementations must make
+// Reserve atomic so only one request wins a key.
+type IdempotencyStore interface {
+	// Creates an in-progress record for key. When a record already
+	// exists it is returned along with false.
+	Reserve(ctx context.Context, key, fingerprint string, ttl time.Duration) (*IdempotencyRecord, bool, error)
+	// Stores the response of the request that reserved key
+	Complete(ctx context.Context, key string, rec *IdempotencyRecord, ttl time.Duration) error
+	// Forgets key so the request can be retried
+	Release(ctx context.Context, key string) error
+}
+
+type memoryIdempotencyEntry struct {
+	rec     *IdempotencyRecord
+	expires time.Time
+}
+
+// In-memory IdempotencyStore. Expired records are dropped lazily.
+type MemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	entries   map[string]memoryIdempotencyEntry
+	lastSweep time.Time
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		entries: map[string]memoryIdempotencyEntry{},
+	}
+}
+
+func (s *MemoryIdempotencyStore) Reserve(
+	_ context.Context, key, fingerprint string, ttl time.Duration,
+) (*IdempotencyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		s.lastSweep = now
+		for k, e := range s.entries {
+			if now.After(e.expires) {
+				delete(s.entries, k)
+			}
+		}
+	}
+
+	if e, ok := s.entries[key]; ok && now.Before(e.expires) {
+		c := *e.rec
+		return &c, false, nil
+	}
+	rec := &IdempotencyRecord{Fingerprint: fingerprint}
+	s.entries[key] = memoryIdempotencyEntry{rec: rec, expires: now.Add(ttl)}
+	c := *rec
+	return &c, true, nil
+}
+
+func (s *MemoryIdempotencyStore) Complete(_ context.Context, key string, rec *IdempotencyRecord, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = memoryIdempotencyEntry{rec: rec, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Release(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+type IdempotencyOptions struct {
+	// Defaults to an in-memory store
+	Store IdempotencyStore
+	// How long responses are kept for replay. Defaults to 24 hours.
+	TTL time.Duration
+	// Methods the middleware applies to. Defaults to POST and PATCH.
+	Methods []string
+	// Reject requests without an Idempotency-Key with a 400
+	Required bool
+}
+
+func requestFingerprint(r *http.Request, rd *RequestData) (string, error) {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	switch {
+	case rd.patch != nil:
+		// Body is only filled in once the patch is applied
+		h.Write([]byte(rd.patchType + "\n"))
+		h.Write(rd.patch)
+	case rd.Body != nil:
+		bs, err := proto.MarshalOptions{Deterministic: true}.Marshal(rd.Body)
+		if err != nil {
+			return "", wrapErr(err)
+		}
+		h.Write(bs)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Returns a middleware with ID "idempotency". The first response to
+// a request carrying an Idempotency-Key is stored and replayed for
+// later requests with the same key. A duplicate arriving while the
+// first is in flight gets a 409 and reusing a key with a different
+// request gets a 422. Keys are scoped to the authenticated Principal.
+func Idempotency(opts IdempotencyOptions) *Middleware {
+	if opts.Store == nil {
+		opts.Store = NewMemoryIdempotencyStore()
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = 24 * time.Hour
+	}
+	if len(opts.Methods) == 0 {
+		opts.Methods = []string{http.MethodPost, http.MethodPatch}
+	}
+	methods := map[string]bool{}
+	for _, m := range opts.Methods {
+		methods[m] = true
+	}
+
+	return &Middleware{
+		ID: "idempotency",
+		Handler: func(h Handler) Handler {
+			return func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+				r := rc.Request
+				if !methods[r.Method] {
+					return h(rc, rd)
+				}
+				key := r.Header.Get(HeaderIdempotencyKey)
+				if key == "" {
+					if opts.Required {
+						return nil, NewError(StatusBadRequest, "missing "+HeaderIdempotencyKey+" header")
+					}
+					return h(rc, rd)
+				}
+				if p := rc.Principal(); p != nil {
+					key = p.Scheme + ":" + p.Subject + "|" + key
+				}
+
+				fp, err := requestFingerprint(r, rd)
+				if err != nil {
+					return nil, wrapErr(err)
+				}
+				ctx := rc.Context()
+				rec, reserved, err := opts.Store.Reserve(ctx, key, fp, opts.TTL)
+				if err != nil {
+					return nil, wrapErr(err)
+				}
+				if !reserved {
+					switch {
+					case rec.Fingerprint != fp:
+						return nil, NewError(StatusUnprocessableEntity, HeaderIdempotencyKey+" reused with a different request")
+					case !rec.Completed:
+						return nil, NewError(StatusConflict, "a request with this "+HeaderIdempotencyKey+" is in progress")
+					}
+					rc.ResponseWriter.Header().Set(HeaderIdempotentReplayed, "true")
+					(&recordedResponse{Status: rec.Status, Header: rec.Header, Body: rec.Body}).replay(rc.ResponseWriter)
+					return nil, nil
+				}
+
+				// A panicking handler would otherwise hold the key
+				// until it expires
+				defer func() {
+					if p := recover(); p != nil {
+						if err := opts.Store.Release(ctx, key); err != nil {
+							log.Println(wrapErr(err))
+						}
+						panic(p)
+					}
+				}()
+				res := captureResponse(rc, rd, h)
+				if res.Status >= StatusInternalServerError {
+					// Let the client retry failures
+					if err := opts.Store.Release(ctx, key); err != nil {
+						log.Println(wrapErr(err))
+					}
+				} else if err := opts.Store.Complete(ctx, key, &IdempotencyRecord{
+					Fingerprint: fp,
+					Completed:   true,
+					Status:      res.Status,
+					Header:      res.Header,
+					Body:        res.Body,
+				}, opts.TTL); err != nil {
+					log.Println(wrapErr(err))
+				}
+				res.replay(rc.ResponseWriter)
+				return nil, nil
+			}
+		},
+	}
+}
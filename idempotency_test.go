@@ -0,0 +1,124 @@
+package prate
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daimaou92/prate/pb/fortest"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func TestIdempotency(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int32
+	block := make(chan struct{})
+	app.POST(NewEndpointConfig("/orders", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		n := atomic.AddInt32(&calls, 1)
+		req := rd.Body.(*fortest.TestReq)
+		if req.Key == "slow" {
+			<-block
+		}
+		if req.Key == "fail" && n == 1 {
+			return nil, ErrInternalServerError
+		}
+		if req.Key == "panic" && n == 1 {
+			panic("boom")
+		}
+		rc.ResponseWriter.Header().Set("X-Order", req.Value)
+		rc.ResponseWriter.WriteHeader(StatusCreated)
+		return &fortest.TestRes{Key: req.Key, Value: req.Value}, nil
+	}).WithRequestPayloadType(&fortest.TestReq{}))
+	if err := app.Apply(Idempotency(IdempotencyOptions{})); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.SetPanicHandler(func(w http.ResponseWriter, _ *http.Request, _ interface{}) {
+		w.WriteHeader(StatusInternalServerError)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	app.mountEndpoints()
+
+	post := func(key string, req *fortest.TestReq) *httptest.ResponseRecorder {
+		bs, _ := proto.Marshal(req)
+		r := httptest.NewRequest(http.MethodPost, "/orders", bytes.NewReader(bs))
+		if key != "" {
+			r.Header.Set(HeaderIdempotencyKey, key)
+		}
+		return testServe(app, r)
+	}
+
+	first := post("k1", &fortest.TestReq{Key: "a", Value: "1"})
+	second := post("k1", &fortest.TestReq{Key: "a", Value: "1"})
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("handler executions wanted: 1. got: %d", calls)
+	}
+	if second.Code != StatusCreated || second.Header().Get("X-Order") != "1" ||
+		!bytes.Equal(first.Body.Bytes(), second.Body.Bytes()) {
+		t.Fatalf("response not replayed: %d %v", second.Code, second.Header())
+	}
+	if second.Header().Get(HeaderIdempotentReplayed) != "true" {
+		t.Fatal("replayed response not marked")
+	}
+
+	if w := post("k1", &fortest.TestReq{Key: "a", Value: "2"}); w.Code != StatusUnprocessableEntity {
+		t.Fatalf("different body wanted: %d. got: %d", StatusUnprocessableEntity, w.Code)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		post("k2", &fortest.TestReq{Key: "slow"})
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if w := post("k2", &fortest.TestReq{Key: "slow"}); w.Code != StatusConflict {
+		t.Fatalf("concurrent duplicate wanted: %d. got: %d", StatusConflict, w.Code)
+	}
+	close(block)
+	<-done
+
+	atomic.StoreInt32(&calls, 0)
+	if w := post("k3", &fortest.TestReq{Key: "fail"}); w.Code != StatusInternalServerError {
+		t.Fatalf("first attempt wanted: %d. got: %d", StatusInternalServerError, w.Code)
+	}
+	if w := post("k3", &fortest.TestReq{Key: "fail"}); w.Code != StatusCreated {
+		t.Fatalf("retry after failure wanted: %d. got: %d", StatusCreated, w.Code)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	if w := post("k4", &fortest.TestReq{Key: "panic"}); w.Code != StatusInternalServerError {
+		t.Fatalf("panicking attempt wanted: %d. got: %d", StatusInternalServerError, w.Code)
+	}
+	if w := post("k4", &fortest.TestReq{Key: "panic"}); w.Code != StatusCreated {
+		t.Fatalf("retry after panic wanted: %d. got: %d", StatusCreated, w.Code)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	post("", &fortest.TestReq{Key: "b"})
+	post("", &fortest.TestReq{Key: "b"})
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("requests without a key wanted 2 executions. got: %d", n)
+	}
+}
+
+func TestMemoryIdempotencyStoreTTL(t *testing.T) {
+	s := NewMemoryIdempotencyStore()
+	if _, ok, _ := s.Reserve(context.Background(), "k", "fp", 10*time.Millisecond); !ok {
+		t.Fatal("first reserve failed")
+	}
+	if _, ok, _ := s.Reserve(context.Background(), "k", "fp", 10*time.Millisecond); ok {
+		t.Fatal("second reserve succeeded")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok, _ := s.Reserve(context.Background(), "k", "fp", 10*time.Millisecond); !ok {
+		t.Fatal("reserve after expiry failed")
+	}
+}
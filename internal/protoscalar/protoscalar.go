@@ -0,0 +1,76 @@
+// Package protoscalar parses the text form of scalar protobuf
+// field values, as found in query strings and form fields.
+package protoscalar
+
+import (
+	"fmt"
+	"strconv"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Parses s as a value of the scalar field fd. Enums are accepted by
+// name or number.
+func Parse(fd protoreflect.FieldDescriptor, s string) (protoreflect.Value, error) {
+	invalid := func() (protoreflect.Value, error) {
+		return protoreflect.Value{}, fmt.Errorf("invalid %s value %q", fd.Kind(), s)
+	}
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(s), nil
+	case protoreflect.BytesKind:
+		return protoreflect.ValueOfBytes([]byte(s)), nil
+	case protoreflect.BoolKind:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return invalid()
+		}
+		return protoreflect.ValueOfBool(b), nil
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		i, err := strconv.ParseInt(s, 10, 32)
+		if err != nil {
+			return invalid()
+		}
+		return protoreflect.ValueOfInt32(int32(i)), nil
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return invalid()
+		}
+		return protoreflect.ValueOfInt64(i), nil
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		u, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return invalid()
+		}
+		return protoreflect.ValueOfUint32(uint32(u)), nil
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		u, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return invalid()
+		}
+		return protoreflect.ValueOfUint64(u), nil
+	case protoreflect.FloatKind:
+		f, err := strconv.ParseFloat(s, 32)
+		if err != nil {
+			return invalid()
+		}
+		return protoreflect.ValueOfFloat32(float32(f)), nil
+	case protoreflect.DoubleKind:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return invalid()
+		}
+		return protoreflect.ValueOfFloat64(f), nil
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(s)); ev != nil {
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		}
+		i, err := strconv.ParseInt(s, 10, 32)
+		if err != nil {
+			return invalid()
+		}
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(i)), nil
+	}
+	return protoreflect.Value{}, fmt.Errorf("unsupported kind %s", fd.Kind())
+}
@@ -0,0 +1,40 @@
+package protoscalar
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestParse(t *testing.T) {
+	fields := (&descriptorpb.FieldDescriptorProto{}).ProtoReflect().Descriptor().Fields()
+	for _, tst := range []struct {
+		field, in string
+		want      interface{}
+		err       bool
+	}{
+		{"name", "a b", "a b", false},
+		{"number", "7", int32(7), false},
+		{"number", "7.5", nil, true},
+		{"proto3_optional", "true", true, false},
+		{"proto3_optional", "yes", nil, true},
+		{"type", "TYPE_STRING", protoreflect.EnumNumber(9), false},
+		{"type", "9", protoreflect.EnumNumber(9), false},
+		{"type", "TYPE_NOPE", nil, true},
+	} {
+		v, err := Parse(fields.ByName(protoreflect.Name(tst.field)), tst.in)
+		if tst.err {
+			if err == nil {
+				t.Fatalf("%s=%s wanted an error", tst.field, tst.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := v.Interface(); got != tst.want {
+			t.Fatalf("%s=%s wanted: %v. got: %v", tst.field, tst.in, tst.want, got)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package prate
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+type JWTOptions struct {
+	// Secret for HS256 tokens. HS256 is rejected when empty.
+	HMACSecret []byte
+	// Path to a local JWKS file holding the RSA (RS256) and
+	// P-256 (ES256) public keys tokens are verified with.
+	JWKSFile string
+	// When set the "iss" claim must match
+	Issuer string
+	// When set the "aud" claim must contain it
+	Audience string
+	// Clock skew tolerated on "exp" and "nbf"
+	Leeway time.Duration
+	// Claim holding the roles. Defaults to "roles".
+	RolesClaim string
+	// Claim holding the scopes, either a space separated string or
+	// an array. Defaults to "scope".
+	ScopesClaim string
+	// Realm sent in the WWW-Authenticate challenge
+	Realm string
+}
+
+// Verifies Bearer JSON Web Tokens signed with HS256, RS256 or ES256
+type JWTAuthenticator struct {
+	opts JWTOptions
+	keys map[string]crypto.PublicKey
+	now  func() time.Time
+}
+
+func NewJWTAuthenticator(opts JWTOptions) (*JWTAuthenticator, error) {
+	if opts.RolesClaim == "" {
+		opts.RolesClaim = "roles"
+	}
+	if opts.ScopesClaim == "" {
+		opts.ScopesClaim = "scope"
+	}
+	a := &JWTAuthenticator{
+		opts: opts,
+		keys: map[string]crypto.PublicKey{},
+		now:  time.Now,
+	}
+	if opts.JWKSFile != "" {
+		bs, err := os.ReadFile(opts.JWKSFile)
+		if err != nil {
+			return nil, wrapErr(err)
+		}
+		keys, err := parseJWKS(bs)
+		if err != nil {
+			return nil, wrapErr(err)
+		}
+		a.keys = keys
+	}
+	if len(opts.HMACSecret) == 0 && len(a.keys) == 0 {
+		return nil, wrapErr(fmt.Errorf("no verification keys configured"))
+	}
+	return a, nil
+}
+
+func (a *JWTAuthenticator) Challenge() string {
+	if a.opts.Realm == "" {
+		return "Bearer"
+	}
+	return fmt.Sprintf(`Bearer realm="%s"`, a.opts.Realm)
+}
+
+func (a *JWTAuthenticator) Authenticate(rc *RequestCtx) (*Principal, error) {
+	token, ok := authorizationCredentials(rc.Request, "Bearer")
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	claims, err := a.Verify(token)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+
+	p := &Principal{
+		Scheme: "Bearer",
+		Claims: claims,
+		Roles:  claimStrings(claims[a.opts.RolesClaim]),
+		Scopes: claimStrings(claims[a.opts.ScopesClaim]),
+	}
+	p.Subject, _ = claims["sub"].(string)
+	return p, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Checks the signature and the registered claims of a compact
+// serialized token and returns its claims.
+func (a *JWTAuthenticator) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, wrapErr(fmt.Errorf("malformed token"))
+	}
+	hbs, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, wrapErr(err, "header decode failed")
+	}
+	var hdr jwtHeader
+	if err := json.Unmarshal(hbs, &hdr); err != nil {
+		return nil, wrapErr(err, "header unmarshal failed")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, wrapErr(err, "signature decode failed")
+	}
+	if err := a.verifySignature(hdr, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, wrapErr(err)
+	}
+
+	cbs, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, wrapErr(err, "claims decode failed")
+	}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(cbs, &claims); err != nil {
+		return nil, wrapErr(err, "claims unmarshal failed")
+	}
+	if err := a.validateClaims(claims); err != nil {
+		return nil, wrapErr(err)
+	}
+	return claims, nil
+}
+
+func (a *JWTAuthenticator) verifySignature(hdr jwtHeader, signed string, sig []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch hdr.Alg {
+	case "HS256":
+		if len(a.opts.HMACSecret) == 0 {
+			return fmt.Errorf("HS256 not enabled")
+		}
+		m := hmac.New(sha256.New, a.opts.HMACSecret)
+		m.Write([]byte(signed))
+		if !hmac.Equal(m.Sum(nil), sig) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	case "RS256":
+		k, ok := a.key(hdr.Kid).(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("no RSA key for kid %q", hdr.Kid)
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	case "ES256":
+		k, ok := a.key(hdr.Kid).(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("no EC key for kid %q", hdr.Kid)
+		}
+		if len(sig) != 64 {
+			return fmt.Errorf("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported alg %q", hdr.Alg)
+	}
+}
+
+// Tokens without a kid are accepted only when the JWKS
+// holds a single key.
+func (a *JWTAuthenticator) key(kid string) crypto.PublicKey {
+	if k, ok := a.keys[kid]; ok {
+		return k
+	}
+	if kid == "" && len(a.keys) == 1 {
+		for _, k := range a.keys {
+			return k
+		}
+	}
+	return nil
+}
+
+func (a *JWTAuthenticator) validateClaims(claims map[string]interface{}) error {
+	now := a.now()
+	if exp, ok := claims["exp"].(float64); ok {
+		if now.After(time.Unix(int64(exp), 0).Add(a.opts.Leeway)) {
+			return fmt.Errorf("token expired")
+		}
+	}
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Add(a.opts.Leeway).Before(time.Unix(int64(nbf), 0)) {
+			return fmt.Errorf("token not valid yet")
+		}
+	}
+	if a.opts.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != a.opts.Issuer {
+			return fmt.Errorf("invalid issuer")
+		}
+	}
+	if a.opts.Audience != "" {
+		found := false
+		for _, aud := range claimStrings(claims["aud"]) {
+			if aud == a.opts.Audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("invalid audience")
+		}
+	}
+	return nil
+}
+
+// Normalizes a claim that is either a space separated string
+// or an array of strings.
+func claimStrings(v interface{}) []string {
+	switch t := v.(type) {
+	case string:
+		return strings.Fields(t)
+	case []interface{}:
+		var ss []string
+		for _, e := range t {
+			if s, ok := e.(string); ok {
+				ss = append(ss, s)
+			}
+		}
+		return ss
+	}
+	return nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func parseJWKS(bs []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(bs, &set); err != nil {
+		return nil, wrapErr(err, "jwks unmarshal failed")
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pk, err := k.publicKey()
+		if err != nil {
+			return nil, wrapErr(err, fmt.Sprintf("key %q", k.Kid))
+		}
+		keys[k.Kid] = pk
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := func(s string) (*big.Int, error) {
+		bs, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(bs), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := b64(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pk := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !pk.Curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point not on curve")
+		}
+		return pk, nil
+	default:
+		return nil, fmt.Errorf("unsupported kty %q", k.Kty)
+	}
+}
@@ -0,0 +1,23 @@
+package prate
+
+import (
+	"github.com/daimaou92/prate/filter"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Parses the filter and order_by query parameters of a list request
+// against the message type of the listed items. Invalid ones are
+// reported as a 400 *Error.
+func (rc *RequestCtx) ListQuery(item protoreflect.ProtoMessage) (*filter.Filter, filter.OrderBy, error) {
+	q := rc.Request.URL.Query()
+	md := item.ProtoReflect().Descriptor()
+	f, err := filter.Parse(q.Get("filter"), md)
+	if err != nil {
+		return nil, nil, NewError(StatusBadRequest, err.Error())
+	}
+	ob, err := filter.ParseOrderBy(q.Get("order_by"), md)
+	if err != nil {
+		return nil, nil, NewError(StatusBadRequest, err.Error())
+	}
+	return f, ob, nil
+}
@@ -0,0 +1,47 @@
+package prate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/daimaou92/prate/pb/fortest"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func TestListQuery(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := []*fortest.TestRes{{Key: "b", Value: "1"}, {Key: "a", Value: "2"}, {Key: "c", Value: "1"}}
+	app.GET(NewEndpointConfig("/items", func(rc *RequestCtx, _ *RequestData) (protoreflect.ProtoMessage, error) {
+		f, ob, err := rc.ListQuery(&fortest.TestRes{})
+		if err != nil {
+			return nil, err
+		}
+		var best *fortest.TestRes
+		for _, it := range items {
+			if f.Match(it) && (best == nil || ob.Compare(it, best) < 0) {
+				best = it
+			}
+		}
+		return best, nil
+	}))
+	app.mountEndpoints()
+
+	q := url.Values{"filter": {`value = "1"`}, "order_by": {"key desc"}}
+	w := testServe(app, httptest.NewRequest(http.MethodGet, "/items?"+q.Encode(), nil))
+	var res fortest.TestRes
+	if err := proto.Unmarshal(w.Body.Bytes(), &res); err != nil || res.Key != "c" {
+		t.Fatalf("wanted item c. got: %d %v %v", w.Code, &res, err)
+	}
+
+	q = url.Values{"filter": {`missing = 1`}}
+	w = testServe(app, httptest.NewRequest(http.MethodGet, "/items?"+q.Encode(), nil))
+	if w.Code != StatusBadRequest {
+		t.Fatalf("unknown field wanted: %d. got: %d", StatusBadRequest, w.Code)
+	}
+}
@@ -0,0 +1,375 @@
+package prate
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/daimaou92/prate/internal/protoscalar"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Limits and storage settings for multipart/form-data requests
+type MultipartOptions struct {
+	// Largest accepted file. 0 means only MaxTotalSize applies.
+	MaxFileSize int64
+	// Largest accepted request body, fields included. Defaults to 32MB.
+	MaxTotalSize int64
+	// File bytes kept in memory across all files of a request before
+	// the rest spills to disk. Defaults to 10MB.
+	MaxMemory int64
+	// Directory for spilled files. Defaults to os.TempDir.
+	TempDir string
+	// Reject files that don't fit in MaxMemory instead of
+	// spilling them to disk
+	NoSpill bool
+	// Accepted media types of files, for example "image/png" or
+	// "image/*". Empty accepts any type.
+	AllowedTypes []string
+}
+
+// A file part of a multipart/form-data request
+type UploadedFile struct {
+	// Name of the form field
+	Field    string
+	Filename string
+	// Media type sniffed from the content, falling back to the one
+	// implied by the file extension
+	ContentType string
+	Size        int64
+	Header      http.Header
+	data        []byte
+	path        string
+}
+
+// Returns a reader over the contents of the file. May be called
+// more than once.
+func (f *UploadedFile) Open() (io.ReadCloser, error) {
+	if f.path == "" {
+		return io.NopCloser(bytes.NewReader(f.data)), nil
+	}
+	fl, err := os.Open(f.path)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	return fl, nil
+}
+
+// Returns the first file uploaded under field
+func (rd *RequestData) File(field string) *UploadedFile {
+	if fs := rd.Files[field]; len(fs) > 0 {
+		return fs[0]
+	}
+	return nil
+}
+
+// Accepts multipart/form-data bodies. Fields named after fields of
+// the RequestPayloadType, by proto or JSON name, are bound to it.
+// File parts are available through RequestData.Files, read in full
+// before the handler runs rather than streamed. Other bodies are
+// still decoded as protobuf.
+func (ec EndpointConfig) WithMultipart(mo MultipartOptions) EndpointConfig {
+	ec.Multipart = &mo
+	return ec
+}
+
+func isMultipartForm(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get(HeaderContentType))
+	return err == nil && mt == "multipart/form-data"
+}
+
+type multipartForm struct {
+	files map[string][]*UploadedFile
+}
+
+// Removes the files spilled to disk
+func (mf *multipartForm) cleanup() {
+	for _, fs := range mf.files {
+		for _, f := range fs {
+			if f.path != "" {
+				os.Remove(f.path)
+			}
+		}
+	}
+}
+
+// Reads a multipart/form-data body binding fields to msg, which may
+// be nil, and collecting files. Each file is read in full before the
+// handler runs, into memory or a temporary file, rather than streamed
+// to it. Failures to store a file are returned as is and every other
+// error as an *Error.
+func parseMultipart(r *http.Request, msg proto.Message, mo MultipartOptions) (*multipartForm, error) {
+	if mo.MaxTotalSize <= 0 {
+		mo.MaxTotalSize = 32 << 20
+	}
+	if mo.MaxMemory <= 0 {
+		mo.MaxMemory = 10 << 20
+	}
+	_, params, err := mime.ParseMediaType(r.Header.Get(HeaderContentType))
+	if err != nil || params["boundary"] == "" {
+		return nil, NewError(StatusBadRequest, "invalid multipart content type")
+	}
+	body := &limitedReader{r: r.Body, n: mo.MaxTotalSize}
+	mr := multipart.NewReader(body, params["boundary"])
+
+	mf := &multipartForm{files: map[string][]*UploadedFile{}}
+	var fields protoreflect.FieldDescriptors
+	if msg != nil {
+		proto.Reset(msg)
+		fields = msg.ProtoReflect().Descriptor().Fields()
+	}
+	memory := mo.MaxMemory
+	fail := func(err error) (*multipartForm, error) {
+		mf.cleanup()
+		if body.exceeded {
+			return nil, NewError(StatusRequestEntityTooLarge, "request body too large")
+		}
+		return nil, err
+	}
+
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(errInvalidMultipart)
+		}
+		name := p.FormName()
+		if name == "" {
+			p.Close()
+			continue
+		}
+
+		if p.FileName() == "" {
+			bs, err := io.ReadAll(p)
+			p.Close()
+			if err != nil {
+				return fail(errInvalidMultipart)
+			}
+			if fields == nil {
+				continue
+			}
+			fd := fields.ByName(protoreflect.Name(name))
+			if fd == nil {
+				fd = fields.ByJSONName(name)
+			}
+			if fd == nil {
+				continue
+			}
+			if err := setFormField(msg.ProtoReflect(), fd, string(bs)); err != nil {
+				return fail(err)
+			}
+			continue
+		}
+
+		f, err := readUploadedFile(p, &memory, mo)
+		p.Close()
+		if err != nil {
+			return fail(err)
+		}
+		mf.files[name] = append(mf.files[name], f)
+	}
+	return mf, nil
+}
+
+var errInvalidMultipart = NewError(StatusBadRequest, "invalid multipart body")
+
+// Records the error of a failed write, telling it apart from
+// failures to read the request in io.Copy
+type storageWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (sw *storageWriter) Write(bs []byte) (int, error) {
+	n, err := sw.w.Write(bs)
+	if err != nil {
+		sw.err = err
+	}
+	return n, err
+}
+
+func readUploadedFile(p *multipart.Part, memory *int64, mo MultipartOptions) (*UploadedFile, error) {
+	f := &UploadedFile{
+		Field:    p.FormName(),
+		Filename: filepath.Base(p.FileName()),
+		Header:   http.Header(p.Header),
+	}
+	br := bufio.NewReaderSize(p, 512)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, errInvalidMultipart
+	}
+	ct, err := sniffUpload(f.Filename, head)
+	if err != nil {
+		return nil, err
+	}
+	if !mediaTypeAllowed(ct, mo.AllowedTypes) {
+		return nil, NewError(StatusUnsupportedMediaType, fmt.Sprintf("%s: type %s not allowed", f.Filename, ct))
+	}
+	f.ContentType = ct
+
+	var src io.Reader = br
+	limit := int64(-1)
+	if mo.MaxFileSize > 0 {
+		limit = mo.MaxFileSize
+		src = io.LimitReader(br, mo.MaxFileSize+1)
+	}
+	tooLarge := NewError(StatusRequestEntityTooLarge, f.Filename+": file too large")
+
+	// Fill memory first, then move to disk
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, src, *memory+1)
+	if err != nil && err != io.EOF {
+		return nil, errInvalidMultipart
+	}
+	if limit >= 0 && n > limit {
+		return nil, tooLarge
+	}
+	if n <= *memory {
+		*memory -= n
+		f.data = buf.Bytes()
+		f.Size = n
+		return f, nil
+	}
+	if mo.NoSpill {
+		return nil, tooLarge
+	}
+
+	tmp, err := os.CreateTemp(mo.TempDir, "prate-upload-")
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	defer tmp.Close()
+	f.path = tmp.Name()
+	sw := &storageWriter{w: tmp}
+	size, err := io.Copy(sw, io.MultiReader(&buf, src))
+	if err != nil {
+		os.Remove(f.path)
+		if sw.err != nil {
+			return nil, wrapErr(sw.err)
+		}
+		return nil, errInvalidMultipart
+	}
+	if limit >= 0 && size > limit {
+		os.Remove(f.path)
+		return nil, tooLarge
+	}
+	*memory = 0
+	f.Size = size
+	return f, nil
+}
+
+// Containers DetectContentType reports in place of the formats
+// built on them
+var sniffFamilies = map[string]func(ct string) bool{
+	"text/xml": func(ct string) bool {
+		return ct == "application/xml" || strings.HasSuffix(ct, "+xml")
+	},
+	"application/zip": func(ct string) bool {
+		return ct == "application/java-archive" || strings.HasSuffix(ct, "+zip") ||
+			strings.HasPrefix(ct, "application/vnd.oasis.opendocument.") ||
+			strings.HasPrefix(ct, "application/vnd.openxmlformats-officedocument.")
+	},
+}
+
+// Types a plain text sniff can stand for
+func isTextual(ct string) bool {
+	switch ct {
+	case "application/json", "application/xml", "application/javascript":
+		return true
+	}
+	return strings.HasPrefix(ct, "text/") || strings.HasSuffix(ct, "+json") || strings.HasSuffix(ct, "+xml")
+}
+
+// Media type of an upload. The sniffed type wins over the one the
+// extension implies but the two must agree when both are specific.
+// The extension only refines a sniffed container into a format of its
+// family, and plain text into a textual type.
+func sniffUpload(filename string, head []byte) (string, error) {
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	byExt := ContentTypeFromExtension(filepath.Ext(filename))
+	switch {
+	case byExt == "" || byExt == sniffed:
+		return sniffed, nil
+	case sniffed == "application/octet-stream":
+		return byExt, nil
+	case sniffed == "text/plain":
+		if isTextual(byExt) {
+			return byExt, nil
+		}
+		return sniffed, nil
+	case sniffFamilies[sniffed] != nil && sniffFamilies[sniffed](byExt):
+		return byExt, nil
+	}
+	return "", NewError(StatusUnsupportedMediaType,
+		fmt.Sprintf("%s: content is %s", filename, sniffed))
+}
+
+func mediaTypeAllowed(ct string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if a == ct || a == "*/*" {
+			return true
+		}
+		if strings.HasSuffix(a, "/*") && strings.HasPrefix(ct, strings.TrimSuffix(a, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets a scalar field, appending for repeated ones
+func setFormField(m protoreflect.Message, fd protoreflect.FieldDescriptor, s string) error {
+	if fd.IsMap() {
+		return NewError(StatusBadRequest, fmt.Sprintf("field %s can't be set from a form", fd.Name()))
+	}
+	v, err := protoscalar.Parse(fd, s)
+	if err != nil {
+		return NewError(StatusBadRequest, fmt.Sprintf("field %s: %v", fd.Name(), err))
+	}
+	if fd.IsList() {
+		m.Mutable(fd).List().Append(v)
+		return nil
+	}
+	m.Set(fd, v)
+	return nil
+}
+
+// Like io.LimitReader but remembers whether the limit was exceeded
+type limitedReader struct {
+	r        io.Reader
+	n        int64
+	exceeded bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// Exactly n bytes is fine. Only a byte past them isn't.
+		var b [1]byte
+		n, err := l.r.Read(b[:])
+		if n > 0 {
+			l.exceeded = true
+			return 0, errors.New("limit exceeded")
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
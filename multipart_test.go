@@ -0,0 +1,223 @@
+package prate
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/daimaou92/prate/pb/fortest"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func multipartRequest(t *testing.T, fields map[string]string, files map[string][]byte) *http.Request {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for k, v := range fields {
+		if err := mw.WriteField(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, data := range files {
+		fw, err := mw.CreateFormFile("upload", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(data)
+	}
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/upload", &buf)
+	r.Header.Set(HeaderContentType, mw.FormDataContentType())
+	return r
+}
+
+func TestMultipart(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spilled string
+	app.POST(NewEndpointConfig("/upload", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		req := rd.Body.(*fortest.TestReq)
+		f := rd.File("upload")
+		if f == nil {
+			return nil, ErrBadRequest
+		}
+		spilled = f.path
+		rdr, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rdr.Close()
+		bs, _ := io.ReadAll(rdr)
+		return &fortest.TestRes{Key: req.Key + "|" + f.ContentType, Value: req.Value + string(bs[1:4])}, nil
+	}).WithRequestPayloadType(&fortest.TestReq{}).WithMultipart(MultipartOptions{
+		MaxFileSize:  1 << 10,
+		MaxMemory:    64,
+		AllowedTypes: []string{"image/*"},
+	}))
+	app.mountEndpoints()
+
+	small := append(append([]byte{}, pngHeader...), make([]byte, 10)...)
+	big := append(append([]byte{}, pngHeader...), make([]byte, 200)...)
+	tests := []struct {
+		name  string
+		file  string
+		data  []byte
+		code  int
+		spill bool
+	}{
+		{"in memory", "a.png", small, StatusOK, false},
+		{"spilled", "a.png", big, StatusOK, true},
+		{"too large", "a.png", make([]byte, 2<<10), StatusRequestEntityTooLarge, false},
+		{"extension mismatch", "a.pdf", small, StatusUnsupportedMediaType, false},
+		{"type not allowed", "a.txt", []byte("hello"), StatusUnsupportedMediaType, false},
+	}
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			spilled = ""
+			r := multipartRequest(t, map[string]string{"key": "k1"}, map[string][]byte{tst.file: tst.data})
+			w := testServe(app, r)
+			if w.Code != tst.code {
+				t.Fatalf("code wanted: %d. got: %d %s", tst.code, w.Code, w.Body.String())
+			}
+			if tst.code != StatusOK {
+				return
+			}
+			if (spilled != "") != tst.spill {
+				t.Fatalf("spill wanted: %v. got path %q", tst.spill, spilled)
+			}
+			if _, err := os.Stat(spilled); spilled != "" && !os.IsNotExist(err) {
+				t.Fatal("spilled file not removed")
+			}
+		})
+	}
+
+	r := multipartRequest(t, map[string]string{"key": "k1", "value": "v"}, map[string][]byte{"a.png": small})
+	w := testServe(app, r)
+	res := &fortest.TestRes{}
+	if err := proto.Unmarshal(w.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Key != "k1|image/png" || res.Value != "vPNG" {
+		t.Fatalf("unexpected binding: %v", res)
+	}
+}
+
+func TestMultipartStorageFailure(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.POST(NewEndpointConfig("/upload", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		return &fortest.TestRes{}, nil
+	}).WithMultipart(MultipartOptions{
+		MaxMemory: 8,
+		TempDir:   filepath.Join(t.TempDir(), "missing"),
+	}))
+	app.mountEndpoints()
+
+	big := append(append([]byte{}, pngHeader...), make([]byte, 64)...)
+	if w := testServe(app, multipartRequest(t, nil, map[string][]byte{"a.png": big})); w.Code != StatusInternalServerError {
+		t.Fatalf("unwritable temp dir wanted: %d. got: %d %s", StatusInternalServerError, w.Code, w.Body.String())
+	}
+	r := multipartRequest(t, nil, map[string][]byte{"a.png": big})
+	bs, _ := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(bs[:len(bs)-20]))
+	if w := testServe(app, r); w.Code != StatusBadRequest {
+		t.Fatalf("truncated body wanted: %d. got: %d", StatusBadRequest, w.Code)
+	}
+}
+
+func TestSniffUpload(t *testing.T) {
+	xml := []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"/>`)
+	zip := []byte("PK\x03\x04\x14\x00\x00\x00")
+	tests := []struct {
+		file string
+		head []byte
+		want string
+		code int
+	}{
+		{"a.png", pngHeader, "image/png", 0},
+		{"a.pdf", pngHeader, "", StatusUnsupportedMediaType},
+		{"a.svg", xml, "image/svg+xml", 0},
+		{"a.xml", xml, "application/xml", 0},
+		{"a.jar", zip, "application/java-archive", 0},
+		{"a.odt", zip, "application/vnd.oasis.opendocument.text", 0},
+		{"a.png", zip, "", StatusUnsupportedMediaType},
+		{"a.json", []byte(`{"a":1}`), "application/json", 0},
+		{"a.png", []byte("not an image"), "text/plain", 0},
+		{"a.png", make([]byte, 16), "image/png", 0},
+	}
+	for _, tst := range tests {
+		got, err := sniffUpload(tst.file, tst.head)
+		if tst.code != 0 {
+			var e *Error
+			if !errors.As(err, &e) || e.Code != tst.code {
+				t.Fatalf("%s wanted: %d. got: %v", tst.file, tst.code, err)
+			}
+			continue
+		}
+		if err != nil || got != tst.want {
+			t.Fatalf("%s wanted: %s. got: %s %v", tst.file, tst.want, got, err)
+		}
+	}
+}
+
+func TestLimitedReader(t *testing.T) {
+	for _, tst := range []struct {
+		size     int
+		exceeded bool
+	}{{9, false}, {10, false}, {11, true}} {
+		l := &limitedReader{r: bytes.NewReader(make([]byte, tst.size)), n: 10}
+		_, err := io.ReadAll(l)
+		if l.exceeded != tst.exceeded || (err != nil) != tst.exceeded {
+			t.Fatalf("%d bytes exceeded wanted: %v. got: %v %v", tst.size, tst.exceeded, l.exceeded, err)
+		}
+	}
+}
+
+func TestMultipartAbandoned(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	paths := make(chan string, 1)
+	app.POST(NewEndpointConfig("/upload", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		paths <- rd.File("upload").path
+		<-release
+		return nil, nil
+	}).WithRequestPayloadType(&fortest.TestReq{}).WithMultipart(MultipartOptions{
+		MaxMemory: 64,
+	}).WithTimeout(20 * time.Millisecond))
+	app.mountEndpoints()
+
+	big := append(append([]byte{}, pngHeader...), make([]byte, 200)...)
+	r := multipartRequest(t, nil, map[string][]byte{"a.png": big})
+	if w := testServe(app, r); w.Code != StatusGatewayTimeout {
+		t.Fatalf("wanted: %d. got: %d", StatusGatewayTimeout, w.Code)
+	}
+	spilled := <-paths
+	if _, err := os.Stat(spilled); spilled == "" || err != nil {
+		t.Fatalf("spilled file removed under the running handler: %q %v", spilled, err)
+	}
+	close(release)
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(spilled); os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("spilled file left behind by the abandoned handler")
+}
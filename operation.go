@@ -0,0 +1,479 @@
+package prate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+type OperationStatus string
+
+const (
+	OperationPending   OperationStatus = "pending"
+	OperationRunning   OperationStatus = "running"
+	OperationSucceeded OperationStatus = "succeeded"
+	OperationFailed    OperationStatus = "failed"
+	OperationCancelled OperationStatus = "cancelled"
+)
+
+// Reports whether the operation has finished one way or another
+func (s OperationStatus) Done() bool {
+	switch s {
+	case OperationSucceeded, OperationFailed, OperationCancelled:
+		return true
+	}
+	return false
+}
+
+type Operation struct {
+	ID     string
+	Status OperationStatus
+	// Fraction of the work done, between 0 and 1
+	Progress float64
+	// Free form description of the current step
+	Message string
+	// Set once the operation succeeded
+	Result proto.Message
+	// Set once the operation failed
+	Error *Error
+	// Subject of the Principal that started the operation, the only
+	// caller it is shown to. Empty when started anonymously.
+	Owner   string
+	Created time.Time
+	Updated time.Time
+}
+
+// Persists operations so their status can be polled. Get reports
+// unknown ids with ErrNotFound.
+type OperationStore interface {
+	Save(ctx context.Context, op Operation) error
+	Get(ctx context.Context, id string) (Operation, error)
+	Delete(ctx context.Context, id string) error
+}
+
+type MemoryOperationStore struct {
+	mu  sync.RWMutex
+	ops map[string]Operation
+}
+
+func NewMemoryOperationStore() *MemoryOperationStore {
+	return &MemoryOperationStore{
+		ops: map[string]Operation{},
+	}
+}
+
+func (s *MemoryOperationStore) Save(_ context.Context, op Operation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ops[op.ID] = op
+	return nil
+}
+
+func (s *MemoryOperationStore) Get(_ context.Context, id string) (Operation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	op, ok := s.ops[id]
+	if !ok {
+		return Operation{}, ErrNotFound
+	}
+	return op, nil
+}
+
+func (s *MemoryOperationStore) Delete(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.ops, id)
+	return nil
+}
+
+// Reports how far an operation got. fraction is clamped
+// between 0 and 1.
+type ProgressFunc func(fraction float64, message string)
+
+// The work of an operation. ctx is cancelled when a client
+// cancels the operation.
+type OperationFunc func(ctx context.Context, progress ProgressFunc) (protoreflect.ProtoMessage, error)
+
+type OperationOptions struct {
+	// Defaults to "/operations"
+	Path string
+	// Defaults to a MemoryOperationStore
+	Store OperationStore
+	// Operations running at once. Defaults to 4.
+	Workers int
+	// Operations waiting for a worker. Further operations are
+	// refused with a 503. Defaults to 64.
+	QueueSize int
+	// How long finished operations can be polled. Defaults to an hour.
+	Retention time.Duration
+	// Sent as Retry-After when the queue is full. Defaults to a second.
+	RetryAfter time.Duration
+	// Middlewares the operation endpoints skip
+	ExcludeMiddlewares []string
+}
+
+type queuedOperation struct {
+	id  string
+	ctx context.Context
+	f   OperationFunc
+}
+
+type operations struct {
+	opts  OperationOptions
+	queue chan queuedOperation
+
+	// Serializes status changes so a cancellation isn't
+	// overwritten by the worker finishing the operation
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+	// Set by App.Shutdown, after which operations are refused
+	stopped bool
+	stop    chan struct{}
+	workers sync.WaitGroup
+}
+
+// Starts the worker pool running operations and registers
+//
+//	GET    path/:id  the status, progress and result or error
+//	DELETE path/:id  cancels the operation
+//
+// Both answer 404 to callers other than the one that started the
+// operation. Handlers start operations with RequestCtx.StartOperation.
+// App.Shutdown cancels pending operations and stops the workers.
+func (app *App) Operations(opts OperationOptions) error {
+	if app == nil || app.router == nil {
+		return wrapErr(fmt.Errorf("app not initialized"))
+	}
+	if app.operations != nil {
+		return wrapErr(fmt.Errorf("operations already enabled"))
+	}
+	if opts.Path == "" {
+		opts.Path = "/operations"
+	}
+	opts.Path = "/" + strings.Trim(opts.Path, "/")
+	if opts.Store == nil {
+		opts.Store = NewMemoryOperationStore()
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 4
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 64
+	}
+	if opts.Retention <= 0 {
+		opts.Retention = time.Hour
+	}
+	if opts.RetryAfter <= 0 {
+		opts.RetryAfter = time.Second
+	}
+	ops := &operations{
+		opts:    opts,
+		queue:   make(chan queuedOperation, opts.QueueSize),
+		cancels: map[string]context.CancelFunc{},
+		stop:    make(chan struct{}),
+	}
+	ops.workers.Add(opts.Workers)
+	for i := 0; i < opts.Workers; i++ {
+		go ops.work()
+	}
+	app.operations = ops
+
+	app.GET(NewEndpointConfig(opts.Path+"/:id", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		op, err := ops.get(rc, rd.Params.ByName("id"))
+		if err != nil {
+			return nil, err
+		}
+		return nil, writeOperation(rc, StatusOK, op)
+	}).WithExclude(opts.ExcludeMiddlewares...))
+
+	app.DELETE(NewEndpointConfig(opts.Path+"/:id", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		op, err := ops.cancel(rc, rd.Params.ByName("id"))
+		if err != nil {
+			return nil, err
+		}
+		return nil, writeOperation(rc, StatusOK, op)
+	}).WithExclude(opts.ExcludeMiddlewares...))
+	return nil
+}
+
+// Queues f and answers the request with a 202 Accepted whose
+// Location points at the operation. Handlers return its results:
+//
+//	return rc.StartOperation(func(ctx context.Context, progress ProgressFunc) (protoreflect.ProtoMessage, error) {
+//		...
+//	})
+//
+// f runs after the request completed so it must not use the
+// RequestCtx or RequestData. A full queue, or a shut down App, is
+// answered with a 503.
+func (rc *RequestCtx) StartOperation(f OperationFunc) (protoreflect.ProtoMessage, error) {
+	if rc.endpoint == nil || rc.endpoint.app == nil || rc.endpoint.app.operations == nil {
+		return nil, wrapErr(fmt.Errorf("operations not enabled, see App.Operations"))
+	}
+	ops := rc.endpoint.app.operations
+	id, err := newResourceID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	op := Operation{
+		ID:      id,
+		Status:  OperationPending,
+		Owner:   subjectOf(rc),
+		Created: now,
+		Updated: now,
+	}
+	if err := ops.opts.Store.Save(rc.Context(), op); err != nil {
+		return nil, wrapErr(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ops.mu.Lock()
+	stopped := ops.stopped
+	if stopped {
+		cancel()
+	} else {
+		ops.cancels[id] = cancel
+	}
+	ops.mu.Unlock()
+	queued := false
+	if !stopped {
+		select {
+		case ops.queue <- queuedOperation{id: id, ctx: ctx, f: f}:
+			queued = true
+		default:
+			ops.forget(id)
+		}
+	}
+	if !queued {
+		if err := ops.opts.Store.Delete(rc.Context(), id); err != nil {
+			log.Println(wrapErr(err))
+		}
+		rc.ResponseWriter.Header().Set(HeaderRetryAfter, fmt.Sprint(ceilSeconds(ops.opts.RetryAfter)))
+		return nil, ErrServiceUnavailable
+	}
+
+	rc.ResponseWriter.Header().Set(HeaderLocation, ops.opts.Path+"/"+id)
+	return nil, writeOperation(rc, StatusAccepted, op)
+}
+
+func subjectOf(rc *RequestCtx) string {
+	if p := rc.Principal(); p != nil {
+		return p.Subject
+	}
+	return ""
+}
+
+// Loads an operation, hiding those started by someone else
+func (ops *operations) get(rc *RequestCtx, id string) (Operation, error) {
+	op, err := ops.opts.Store.Get(rc.Context(), id)
+	if err != nil {
+		return Operation{}, storeErr(err)
+	}
+	if op.Owner != subjectOf(rc) {
+		return Operation{}, ErrNotFound
+	}
+	return op, nil
+}
+
+func (ops *operations) forget(id string) {
+	ops.mu.Lock()
+	defer ops.mu.Unlock()
+	if cancel, ok := ops.cancels[id]; ok {
+		cancel()
+		delete(ops.cancels, id)
+	}
+}
+
+// Applies f to the stored operation unless it already finished
+func (ops *operations) update(id string, f func(*Operation)) {
+	ops.mu.Lock()
+	defer ops.mu.Unlock()
+	ctx := context.Background()
+	op, err := ops.opts.Store.Get(ctx, id)
+	if err != nil {
+		log.Println(wrapErr(err, "operation "+id))
+		return
+	}
+	if op.Status.Done() {
+		return
+	}
+	f(&op)
+	op.Updated = time.Now()
+	if err := ops.opts.Store.Save(ctx, op); err != nil {
+		log.Println(wrapErr(err, "operation "+id))
+		return
+	}
+	if op.Status.Done() {
+		time.AfterFunc(ops.opts.Retention, func() {
+			if err := ops.opts.Store.Delete(context.Background(), id); err != nil {
+				log.Println(wrapErr(err, "operation "+id))
+			}
+		})
+	}
+}
+
+func (ops *operations) work() {
+	defer ops.workers.Done()
+	for {
+		select {
+		case <-ops.stop:
+			return
+		case q := <-ops.queue:
+			ops.run(q)
+		}
+	}
+}
+
+// Refuses new operations, cancels those pending and waits for
+// the workers to return
+func (ops *operations) shutdown(ctx context.Context) error {
+	ops.mu.Lock()
+	if ops.stopped {
+		ops.mu.Unlock()
+		return nil
+	}
+	ops.stopped = true
+	close(ops.stop)
+	ids := make([]string, 0, len(ops.cancels))
+	for id := range ops.cancels {
+		ids = append(ids, id)
+	}
+	ops.mu.Unlock()
+
+	for _, id := range ids {
+		ops.update(id, func(op *Operation) {
+			op.Status = OperationCancelled
+			op.Message = "shutting down"
+		})
+		ops.forget(id)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ops.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return wrapErr(ctx.Err())
+	}
+}
+
+func (ops *operations) run(q queuedOperation) {
+	defer ops.forget(q.id)
+	if q.ctx.Err() != nil {
+		// Cancelled while queued
+		return
+	}
+	ops.update(q.id, func(op *Operation) { op.Status = OperationRunning })
+
+	progress := func(fraction float64, message string) {
+		if fraction < 0 {
+			fraction = 0
+		} else if fraction > 1 {
+			fraction = 1
+		}
+		ops.update(q.id, func(op *Operation) {
+			op.Progress = fraction
+			op.Message = message
+		})
+	}
+	res, err := func() (res protoreflect.ProtoMessage, err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				log.Println(wrapErr(fmt.Errorf("%v", p), "operation "+q.id+" panicked"))
+				err = NewError(StatusInternalServerError)
+			}
+		}()
+		return q.f(q.ctx, progress)
+	}()
+
+	ops.update(q.id, func(op *Operation) {
+		if err != nil {
+			op.Status = OperationFailed
+			e, ok := err.(*Error)
+			if !ok {
+				log.Println(wrapErr(err, "operation "+q.id))
+				e = NewError(StatusInternalServerError)
+			}
+			op.Error = e
+			return
+		}
+		op.Status = OperationSucceeded
+		op.Progress = 1
+		op.Result = res
+	})
+}
+
+func (ops *operations) cancel(rc *RequestCtx, id string) (Operation, error) {
+	if _, err := ops.get(rc, id); err != nil {
+		return Operation{}, err
+	}
+	// Marked first so the worker can't record the failure the
+	// cancelled context causes
+	ops.update(id, func(op *Operation) { op.Status = OperationCancelled })
+	ops.forget(id)
+	op, err := ops.opts.Store.Get(rc.Context(), id)
+	if err != nil {
+		return Operation{}, storeErr(err)
+	}
+	return op, nil
+}
+
+type operationError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type operationReport struct {
+	ID       string          `json:"id"`
+	Status   OperationStatus `json:"status"`
+	Progress float64         `json:"progress"`
+	Message  string          `json:"message,omitempty"`
+	Result   json.RawMessage `json:"result,omitempty"`
+	Error    *operationError `json:"error,omitempty"`
+	Created  time.Time       `json:"created"`
+	Updated  time.Time       `json:"updated"`
+}
+
+// Writes the operation as JSON, or as a protobuf encoded
+// google.protobuf.Struct when the client accepts protobuf. The
+// result appears in its protobuf JSON form.
+func writeOperation(rc *RequestCtx, code int, op Operation) error {
+	or := operationReport{
+		ID:       op.ID,
+		Status:   op.Status,
+		Progress: op.Progress,
+		Message:  op.Message,
+		Created:  op.Created.UTC(),
+		Updated:  op.Updated.UTC(),
+	}
+	if op.Result != nil {
+		bs, err := protojson.Marshal(op.Result)
+		if err != nil {
+			return wrapErr(err)
+		}
+		or.Result = bs
+	}
+	if op.Error != nil {
+		or.Error = &operationError{Code: op.Error.Code, Message: op.Error.Error()}
+	}
+	bs, err := json.Marshal(or)
+	if err != nil {
+		return wrapErr(err)
+	}
+
+	rc.ResponseWriter.Header().Set(HeaderCacheControl, "no-store")
+	return writeJSONOrStruct(rc, code, bs)
+}
@@ -0,0 +1,203 @@
+package prate
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/daimaou92/prate/pb/fortest"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func pollOperation(t *testing.T, app *App, loc string, want OperationStatus) operationReport {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		w := testServe(app, httptest.NewRequest(http.MethodGet, loc, nil))
+		if w.Code != StatusOK {
+			t.Fatalf("poll wanted: %d. got: %d %s", StatusOK, w.Code, w.Body.String())
+		}
+		var or operationReport
+		if err := json.Unmarshal(w.Body.Bytes(), &or); err != nil {
+			t.Fatal(err)
+		}
+		if or.Status == want {
+			return or
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("status wanted: %s. got: %s", want, or.Status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestOperations(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Operations(OperationOptions{Workers: 1, QueueSize: 1}); err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	app.POST(NewEndpointConfig("/jobs", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		kind := rc.Request.URL.Query().Get("kind")
+		return rc.StartOperation(func(ctx context.Context, progress ProgressFunc) (protoreflect.ProtoMessage, error) {
+			switch kind {
+			case "fail":
+				return nil, ErrConflict
+			case "block":
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			progress(0.5, "halfway")
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			return &fortest.TestRes{Key: "done", Value: kind}, nil
+		})
+	}))
+	app.mountEndpoints()
+
+	start := func(kind string) *httptest.ResponseRecorder {
+		return testServe(app, httptest.NewRequest(http.MethodPost, "/jobs?kind="+kind, nil))
+	}
+
+	w := start("ok")
+	if w.Code != StatusAccepted {
+		t.Fatalf("start wanted: %d. got: %d %s", StatusAccepted, w.Code, w.Body.String())
+	}
+	loc := w.Header().Get(HeaderLocation)
+	or := pollOperation(t, app, loc, OperationRunning)
+	for or.Progress != 0.5 {
+		or = pollOperation(t, app, loc, OperationRunning)
+	}
+	if or.Message != "halfway" {
+		t.Fatalf("unexpected progress %+v", or)
+	}
+
+	// The single worker is busy and the queue takes one more
+	queued := start("ok")
+	if queued.Code != StatusAccepted {
+		t.Fatalf("queue wanted: %d. got: %d", StatusAccepted, queued.Code)
+	}
+	if w := start("ok"); w.Code != StatusServiceUnavailable || w.Header().Get(HeaderRetryAfter) == "" {
+		t.Fatalf("full queue wanted: %d. got: %d", StatusServiceUnavailable, w.Code)
+	}
+
+	// Cancelling the queued operation keeps it from running
+	w = testServe(app, httptest.NewRequest(http.MethodDelete, queued.Header().Get(HeaderLocation), nil))
+	if w.Code != StatusOK {
+		t.Fatalf("cancel wanted: %d. got: %d", StatusOK, w.Code)
+	}
+
+	release <- struct{}{}
+	or = pollOperation(t, app, loc, OperationSucceeded)
+	var res fortest.TestRes
+	if err := json.Unmarshal(or.Result, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Key != "done" || or.Progress != 1 {
+		t.Fatalf("unexpected result %+v", or)
+	}
+	pollOperation(t, app, queued.Header().Get(HeaderLocation), OperationCancelled)
+
+	// A running operation sees its context cancelled
+	loc = start("block").Header().Get(HeaderLocation)
+	pollOperation(t, app, loc, OperationRunning)
+	testServe(app, httptest.NewRequest(http.MethodDelete, loc, nil))
+	pollOperation(t, app, loc, OperationCancelled)
+
+	loc = start("fail").Header().Get(HeaderLocation)
+	or = pollOperation(t, app, loc, OperationFailed)
+	if or.Error == nil || or.Error.Code != StatusConflict {
+		t.Fatalf("unexpected error %+v", or.Error)
+	}
+
+	if w := testServe(app, httptest.NewRequest(http.MethodGet, "/operations/nope", nil)); w.Code != StatusNotFound {
+		t.Fatalf("unknown wanted: %d. got: %d", StatusNotFound, w.Code)
+	}
+}
+
+func TestOperationOwner(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Operations(OperationOptions{Workers: 1}); err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	app.POST(NewEndpointConfig("/jobs", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		return rc.StartOperation(func(ctx context.Context, _ ProgressFunc) (protoreflect.ProtoMessage, error) {
+			select {
+			case <-release:
+			case <-ctx.Done():
+			}
+			return nil, ctx.Err()
+		})
+	}))
+	if err := app.Apply(&Middleware{
+		ID: "fakeauth",
+		Handler: func(h Handler) Handler {
+			return func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+				if sub := rc.Request.Header.Get("X-Subject"); sub != "" {
+					rc.principal = &Principal{Subject: sub}
+				}
+				return h(rc, rd)
+			}
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	app.mountEndpoints()
+
+	as := func(method, target, sub string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		if sub != "" {
+			r.Header.Set("X-Subject", sub)
+		}
+		return testServe(app, r)
+	}
+	loc := as(http.MethodPost, "/jobs", "alice").Header().Get(HeaderLocation)
+	queued := as(http.MethodPost, "/jobs", "alice").Header().Get(HeaderLocation)
+	for _, tst := range []struct {
+		method, sub string
+		code        int
+	}{
+		{http.MethodGet, "", StatusNotFound},
+		{http.MethodGet, "bob", StatusNotFound},
+		{http.MethodDelete, "bob", StatusNotFound},
+		{http.MethodGet, "alice", StatusOK},
+	} {
+		if w := as(tst.method, loc, tst.sub); w.Code != tst.code {
+			t.Fatalf("%s as %q wanted: %d. got: %d", tst.method, tst.sub, tst.code, w.Code)
+		}
+	}
+
+	// Shutdown cancels what's left and stops the worker
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := app.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []string{loc, queued} {
+		w := as(http.MethodGet, l, "alice")
+		var or operationReport
+		if err := json.Unmarshal(w.Body.Bytes(), &or); err != nil {
+			t.Fatal(err)
+		}
+		if or.Status != OperationCancelled {
+			t.Fatalf("status after shutdown wanted: %s. got: %s", OperationCancelled, or.Status)
+		}
+	}
+	if w := as(http.MethodPost, "/jobs", "alice"); w.Code != StatusServiceUnavailable {
+		t.Fatalf("start after shutdown wanted: %d. got: %d", StatusServiceUnavailable, w.Code)
+	}
+	close(release)
+}
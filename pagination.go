@@ -0,0 +1,326 @@
+package prate
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+type PaginationMode int
+
+const (
+	// Numbered pages of a fixed size
+	PaginationOffset PaginationMode = iota
+	// Opaque cursors pointing past the last item returned
+	PaginationCursor
+)
+
+type PaginationOptions struct {
+	Mode PaginationMode
+	// Page size when the client asks for none. Defaults to 20.
+	DefaultSize int32
+	// Larger sizes are clamped to this. Defaults to 100.
+	MaxSize int32
+	// Key signing cursors and page tokens so clients can't forge
+	// them, nor use them on another route or with another query. A
+	// random key is generated when empty, which doesn't survive
+	// restarts nor work across instances.
+	CursorSecret []byte
+	// Query parameter names. Default to "page", "size", "cursor" and
+	// "page_token".
+	PageParam      string
+	SizeParam      string
+	CursorParam    string
+	PageTokenParam string
+}
+
+func (po *PaginationOptions) defaults() {
+	if po.DefaultSize <= 0 {
+		po.DefaultSize = 20
+	}
+	if po.MaxSize <= 0 {
+		po.MaxSize = 100
+	}
+	if po.DefaultSize > po.MaxSize {
+		po.DefaultSize = po.MaxSize
+	}
+	if po.PageParam == "" {
+		po.PageParam = "page"
+	}
+	if po.SizeParam == "" {
+		po.SizeParam = "size"
+	}
+	if po.CursorParam == "" {
+		po.CursorParam = "cursor"
+	}
+	if po.PageTokenParam == "" {
+		po.PageTokenParam = "page_token"
+	}
+	if len(po.CursorSecret) == 0 {
+		po.CursorSecret = make([]byte, 32)
+		if _, err := rand.Read(po.CursorSecret); err != nil {
+			panic(wrapErr(err))
+		}
+	}
+}
+
+// The page a client asked for, read from the query string
+type PageRequest struct {
+	// 1 based page number. Offset mode only.
+	Page int32
+	Size int32
+	// Items to skip. Offset mode only.
+	Offset int64
+	// Position set as PageResult.NextCursor or PrevCursor by the
+	// request that produced the cursor. Empty for the first page.
+	Cursor string
+	// Opaque token for the page following this one, for responses
+	// carrying their own next_page_token. Sent back as the page token
+	// parameter. Offset mode only.
+	NextPageToken string
+}
+
+// What a handler found for a PageRequest
+type PageResult struct {
+	// Items in this page
+	Count int
+	// Items in the whole listing. Negative when unknown.
+	Total int64
+	// Cursor mode only. Positions to resume from for the following
+	// and the preceding page, empty when there is none. They are
+	// signed before being handed to clients.
+	NextCursor string
+	PrevCursor string
+}
+
+// Returns the page requested from a paginated endpoint
+func (rc *RequestCtx) PageRequest() PageRequest {
+	if rc.page == nil {
+		return PageRequest{}
+	}
+	return *rc.page
+}
+
+// Reports what the handler of a paginated endpoint found so the
+// Pagination metadata, Link and X-Total-Count headers can be set
+func (rc *RequestCtx) SetPageResult(pr PageResult) {
+	rc.pageResult = &pr
+}
+
+type paginator struct {
+	opts PaginationOptions
+}
+
+// Identifies the listing a cursor or page token belongs to: the
+// route and a hash of the query minus the paging parameters. Part
+// of the signature, so a token is only good for the listing it came
+// from.
+func (p *paginator) scope(rc *RequestCtx) string {
+	q := rc.Request.URL.Query()
+	for _, k := range []string{p.opts.PageParam, p.opts.SizeParam, p.opts.CursorParam, p.opts.PageTokenParam} {
+		q.Del(k)
+	}
+	sum := sha256.Sum256([]byte(rc.Route() + "?" + q.Encode()))
+	return string(sum[:])
+}
+
+func (p *paginator) mac(scope string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, p.opts.CursorSecret)
+	mac.Write([]byte(scope))
+	mac.Write(payload)
+	return mac.Sum(nil)[:16]
+}
+
+func (p *paginator) sign(scope, payload string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(p.mac(scope, []byte(payload)))
+}
+
+func (p *paginator) verify(scope, cursor string) (string, bool) {
+	enc, sig, ok := strings.Cut(cursor, ".")
+	if !ok {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil {
+		return "", false
+	}
+	want, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return "", false
+	}
+	if !hmac.Equal(p.mac(scope, payload), want) {
+		return "", false
+	}
+	return string(payload), true
+}
+
+func (p *paginator) parse(q url.Values, scope string) (PageRequest, error) {
+	pr := PageRequest{Page: 1, Size: p.opts.DefaultSize}
+	if s := q.Get(p.opts.SizeParam); s != "" {
+		n, err := strconv.ParseInt(s, 10, 32)
+		if err != nil || n < 1 {
+			return pr, NewError(StatusBadRequest, "invalid "+p.opts.SizeParam)
+		}
+		pr.Size = int32(n)
+		if pr.Size > p.opts.MaxSize {
+			pr.Size = p.opts.MaxSize
+		}
+	}
+
+	if p.opts.Mode == PaginationCursor {
+		if c := q.Get(p.opts.CursorParam); c != "" {
+			payload, ok := p.verify(scope, c)
+			if !ok {
+				return pr, NewError(StatusBadRequest, "invalid "+p.opts.CursorParam)
+			}
+			pr.Cursor = payload
+		}
+		pr.Page = 0
+		return pr, nil
+	}
+
+	if t := q.Get(p.opts.PageTokenParam); t != "" {
+		// Holds an offset so it survives a change of size
+		payload, ok := p.verify(scope, t)
+		off, err := strconv.ParseInt(payload, 10, 64)
+		if !ok || err != nil || off < 0 {
+			return pr, NewError(StatusBadRequest, "invalid "+p.opts.PageTokenParam)
+		}
+		pr.Offset = off
+		pr.Page = int32(off/int64(pr.Size)) + 1
+	} else {
+		if s := q.Get(p.opts.PageParam); s != "" {
+			n, err := strconv.ParseInt(s, 10, 32)
+			if err != nil || n < 1 {
+				return pr, NewError(StatusBadRequest, "invalid "+p.opts.PageParam)
+			}
+			pr.Page = int32(n)
+		}
+		pr.Offset = int64(pr.Page-1) * int64(pr.Size)
+	}
+	pr.NextPageToken = p.sign(scope, strconv.FormatInt(pr.Offset+int64(pr.Size), 10))
+	return pr, nil
+}
+
+// Sets the Pagination metadata and navigation headers
+func (p *paginator) emit(rc *RequestCtx, scope string, req PageRequest, res PageResult) {
+	hd := rc.ResponseWriter.Header()
+	u := *rc.Request.URL
+	link := func(rel string, set map[string]string) string {
+		q := u.Query()
+		for k, v := range set {
+			if v == "" {
+				q.Del(k)
+				continue
+			}
+			q.Set(k, v)
+		}
+		l := u.Path
+		if enc := q.Encode(); enc != "" {
+			l += "?" + enc
+		}
+		return fmt.Sprintf(`<%s>; rel="%s"`, l, rel)
+	}
+	size := strconv.Itoa(int(req.Size))
+
+	meta := Pagination{
+		Page:      req.Page,
+		PageSize:  req.Size,
+		ItemCount: int32(res.Count),
+	}
+	if res.Total >= 0 {
+		meta.TotalItems = res.Total
+		meta.Pages = int32((res.Total + int64(req.Size) - 1) / int64(req.Size))
+		hd.Set(HeaderXTotalCount, strconv.FormatInt(res.Total, 10))
+	}
+
+	var links []string
+	if p.opts.Mode == PaginationCursor {
+		first := link("first", map[string]string{p.opts.CursorParam: "", p.opts.SizeParam: size})
+		links = append(links, first)
+		if res.PrevCursor != "" {
+			meta.PrevCursor = p.sign(scope, res.PrevCursor)
+			links = append(links, link("prev", map[string]string{p.opts.CursorParam: meta.PrevCursor, p.opts.SizeParam: size}))
+		}
+		if res.NextCursor != "" {
+			meta.NextCursor = p.sign(scope, res.NextCursor)
+			meta.HasNext = true
+			links = append(links, link("next", map[string]string{p.opts.CursorParam: meta.NextCursor, p.opts.SizeParam: size}))
+		}
+	} else {
+		page := func(rel string, n int32) string {
+			return link(rel, map[string]string{p.opts.PageParam: strconv.Itoa(int(n)), p.opts.SizeParam: size})
+		}
+		links = append(links, page("first", 1))
+		if req.Page > 1 {
+			links = append(links, page("prev", req.Page-1))
+		}
+		if res.Total >= 0 {
+			meta.HasNext = req.Page < meta.Pages
+		} else {
+			// Without a total a full page suggests there is more
+			meta.HasNext = res.Count >= int(req.Size)
+		}
+		if meta.HasNext {
+			links = append(links, page("next", req.Page+1))
+		}
+		if res.Total >= 0 && meta.Pages > 0 {
+			links = append(links, page("last", meta.Pages))
+		}
+	}
+	hd.Set(HeaderLink, strings.Join(links, ", "))
+
+	bs, err := meta.Marshal()
+	if err != nil {
+		log.Println(wrapErr(err))
+		return
+	}
+	hd.Set(HeaderXPagination, string(bs))
+}
+
+func (p *paginator) wrap(h Handler) Handler {
+	return func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		scope := p.scope(rc)
+		req, err := p.parse(rc.Request.URL.Query(), scope)
+		if err != nil {
+			return nil, err
+		}
+		rc.page = &req
+		rc.pageResult = nil
+		resp, err := h(rc, rd)
+		if err != nil || rc.pageResult == nil || rc.ResponseWriter.written {
+			return resp, err
+		}
+		p.emit(rc, scope, req, *rc.pageResult)
+		return resp, nil
+	}
+}
+
+// Parses page and size, or cursor and size, query parameters
+// into a PageRequest available through RequestCtx.PageRequest.
+// Handlers report the outcome with RequestCtx.SetPageResult, from
+// which the X-Pagination, Link and X-Total-Count headers are set.
+func (ec EndpointConfig) WithPagination(po PaginationOptions) EndpointConfig {
+	ec.Pagination = &po
+	return ec
+}
+
+// Wraps the handler so the page request is parsed before it runs
+// and its page headers set after
+func (ec *EndpointConfig) applyPagination() {
+	if ec.Pagination == nil {
+		return
+	}
+	po := *ec.Pagination
+	po.defaults()
+	ec.Handler = (&paginator{opts: po}).wrap(ec.Handler)
+}
@@ -0,0 +1,204 @@
+package prate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/daimaou92/prate/pb/fortest"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+var linkRe = regexp.MustCompile(`<([^>]*)>; rel="(\w+)"`)
+
+func parseLinks(v string) map[string]string {
+	links := map[string]string{}
+	for _, m := range linkRe.FindAllStringSubmatch(v, -1) {
+		links[m[2]] = m[1]
+	}
+	return links
+}
+
+func TestPaginationOffset(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const total = 45
+	app.GET(NewEndpointConfig("/items", func(rc *RequestCtx, _ *RequestData) (protoreflect.ProtoMessage, error) {
+		pr := rc.PageRequest()
+		count := total - pr.Offset
+		if count > int64(pr.Size) {
+			count = int64(pr.Size)
+		}
+		if count < 0 {
+			count = 0
+		}
+		rc.SetPageResult(PageResult{Count: int(count), Total: total})
+		return &fortest.TestRes{Value: strconv.Itoa(int(pr.Offset))}, nil
+	}).WithPagination(PaginationOptions{DefaultSize: 10, MaxSize: 20}))
+	app.mountEndpoints()
+
+	tests := []struct {
+		query string
+		code  int
+		links []string
+		meta  string
+	}{
+		{"", StatusOK, []string{"first", "next", "last"}, `"page":1,"page_size":10,"item_count":10,"total_items":45,"pages":5,"has_next":true`},
+		{"page=5&size=10&q=x", StatusOK, []string{"first", "prev", "last"}, `"page":5,"page_size":10,"item_count":5,"total_items":45,"pages":5,"has_next":false`},
+		{"size=500", StatusOK, []string{"first", "next", "last"}, `"page_size":20`},
+		{"page=0", StatusBadRequest, nil, ""},
+		{"size=abc", StatusBadRequest, nil, ""},
+	}
+	for _, tst := range tests {
+		w := testServe(app, httptest.NewRequest(http.MethodGet, "/items?"+tst.query, nil))
+		if w.Code != tst.code {
+			t.Fatalf("%q: code wanted: %d. got: %d", tst.query, tst.code, w.Code)
+		}
+		if tst.code != StatusOK {
+			continue
+		}
+		if w.Header().Get(HeaderXTotalCount) != "45" {
+			t.Fatalf("%q: unexpected X-Total-Count %q", tst.query, w.Header().Get(HeaderXTotalCount))
+		}
+		if !strings.Contains(w.Header().Get(HeaderXPagination), tst.meta) {
+			t.Fatalf("%q: pagination wanted %s. got: %s", tst.query, tst.meta, w.Header().Get(HeaderXPagination))
+		}
+		links := parseLinks(w.Header().Get(HeaderLink))
+		if len(links) != len(tst.links) {
+			t.Fatalf("%q: links wanted %v. got: %v", tst.query, tst.links, links)
+		}
+		for _, rel := range tst.links {
+			if _, ok := links[rel]; !ok {
+				t.Fatalf("%q: missing %s link in %v", tst.query, rel, links)
+			}
+		}
+	}
+
+	w := testServe(app, httptest.NewRequest(http.MethodGet, "/items?page=2&q=x", nil))
+	next, _ := url.Parse(parseLinks(w.Header().Get(HeaderLink))["next"])
+	if next.Path != "/items" || next.Query().Get("page") != "3" || next.Query().Get("q") != "x" {
+		t.Fatalf("unexpected next link %s", next)
+	}
+}
+
+func TestPaginationCursor(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := []string{"a", "b", "c", "d", "e"}
+	app.GET(NewEndpointConfig("/items", func(rc *RequestCtx, _ *RequestData) (protoreflect.ProtoMessage, error) {
+		pr := rc.PageRequest()
+		start := 0
+		if pr.Cursor != "" {
+			start, _ = strconv.Atoi(pr.Cursor)
+		}
+		end := start + int(pr.Size)
+		if end > len(items) {
+			end = len(items)
+		}
+		res := PageResult{Count: end - start, Total: -1}
+		if end < len(items) {
+			res.NextCursor = strconv.Itoa(end)
+		}
+		rc.SetPageResult(res)
+		return &fortest.TestRes{Value: strings.Join(items[start:end], "")}, nil
+	}).WithPagination(PaginationOptions{Mode: PaginationCursor, DefaultSize: 2, CursorSecret: []byte("secret")}))
+	app.mountEndpoints()
+
+	var pages []string
+	next := "/items"
+	for next != "" {
+		w := testServe(app, httptest.NewRequest(http.MethodGet, next, nil))
+		if w.Code != StatusOK {
+			t.Fatalf("code wanted: %d. got: %d", StatusOK, w.Code)
+		}
+		if w.Header().Get(HeaderXTotalCount) != "" {
+			t.Fatal("X-Total-Count set without a total")
+		}
+		var res fortest.TestRes
+		if err := proto.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, res.Value)
+		next = parseLinks(w.Header().Get(HeaderLink))["next"]
+	}
+	if strings.Join(pages, "|") != "ab|cd|e" {
+		t.Fatalf("unexpected pages %v", pages)
+	}
+
+	forged := "/items?cursor=" + (&paginator{opts: PaginationOptions{CursorSecret: []byte("other")}}).sign("", "4")
+	if w := testServe(app, httptest.NewRequest(http.MethodGet, forged, nil)); w.Code != StatusBadRequest {
+		t.Fatalf("forged cursor wanted: %d. got: %d", StatusBadRequest, w.Code)
+	}
+	first := testServe(app, httptest.NewRequest(http.MethodGet, "/items", nil))
+	link, _ := url.Parse(parseLinks(first.Header().Get(HeaderLink))["next"])
+	other := "/items?q=x&cursor=" + url.QueryEscape(link.Query().Get("cursor"))
+	if w := testServe(app, httptest.NewRequest(http.MethodGet, other, nil)); w.Code != StatusBadRequest {
+		t.Fatalf("cursor of another query wanted: %d. got: %d", StatusBadRequest, w.Code)
+	}
+}
+
+func TestPaginationPageToken(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := func(rc *RequestCtx, _ *RequestData) (protoreflect.ProtoMessage, error) {
+		pr := rc.PageRequest()
+		return &fortest.TestRes{Key: pr.NextPageToken, Value: strconv.FormatInt(pr.Offset, 10)}, nil
+	}
+	po := PaginationOptions{DefaultSize: 2, CursorSecret: []byte("secret")}
+	app.GET(NewEndpointConfig("/items", list).WithPagination(po))
+	app.GET(NewEndpointConfig("/others", list).WithPagination(po))
+	app.mountEndpoints()
+
+	get := func(u string) (*httptest.ResponseRecorder, *fortest.TestRes) {
+		w := testServe(app, httptest.NewRequest(http.MethodGet, u, nil))
+		var res fortest.TestRes
+		if w.Code != StatusOK {
+			return w, &res
+		}
+		if err := proto.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return w, &res
+	}
+	_, res := get("/items")
+	if res.Key == "" || res.Key == "2" {
+		t.Fatalf("unexpected page token %q", res.Key)
+	}
+	// Offsets survive a change of size
+	_, res = get("/items?size=5&page_token=" + url.QueryEscape(res.Key))
+	if res.Value != "2" {
+		t.Fatalf("offset wanted: 2. got: %s", res.Value)
+	}
+	_, res = get("/items?page_token=" + url.QueryEscape(res.Key))
+	if res.Value != "7" {
+		t.Fatalf("offset wanted: 7. got: %s", res.Value)
+	}
+	for _, tok := range []string{"2", "Mg.AAAA"} {
+		if w, _ := get("/items?page_token=" + tok); w.Code != StatusBadRequest {
+			t.Fatalf("token %s wanted: %d. got: %d", tok, StatusBadRequest, w.Code)
+		}
+	}
+
+	// Tokens only work for the listing they came from
+	_, res = get("/items?filter=a")
+	tok := url.QueryEscape(res.Key)
+	for _, u := range []string{"/others?filter=a", "/items?filter=b", "/items?"} {
+		if w, _ := get(u + "&page_token=" + tok); w.Code != StatusBadRequest {
+			t.Fatalf("token reused on %s wanted: %d. got: %d", u, StatusBadRequest, w.Code)
+		}
+	}
+	if _, res := get("/items?filter=a&size=3&page_token=" + tok); res.Value != "2" {
+		t.Fatalf("token on its own listing wanted offset 2. got: %s", res.Value)
+	}
+}
@@ -0,0 +1,359 @@
+package prate
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Loads the current state of the resource a PATCH request targets.
+// Return ErrNotFound or any other *Error to stop the request.
+type PatchLoader func(*RequestCtx, *RequestData) (protoreflect.ProtoMessage, error)
+
+// Accepts application/merge-patch+json and application/json-patch+json
+// bodies on a PATCH endpoint with a RequestPayloadType. The patch is
+// applied to the JSON form of the resource returned by l and the
+// result decoded into RequestData.Body, so handlers see the complete
+// updated message, as do policies. Middlewares run before the
+// resource is loaded, so authentication comes first, and see an empty
+// Body. Field names follow the protobuf JSON mapping.
+// Patches that can't be applied, or whose result isn't a valid
+// message, are answered with a 422. Protobuf bodies are decoded
+// as usual.
+func (ec EndpointConfig) WithPatchLoader(l PatchLoader) EndpointConfig {
+	ec.PatchLoader = l
+	return ec
+}
+
+func mediaType(r *http.Request) string {
+	mt, _, err := mime.ParseMediaType(r.Header.Get(HeaderContentType))
+	if err != nil {
+		return ""
+	}
+	return mt
+}
+
+func isPatchDocument(r *http.Request) bool {
+	switch mediaType(r) {
+	case ContentTypeMergePatch.String(), ContentTypeJSONPatch.String():
+		return true
+	}
+	return false
+}
+
+// Wraps the handler so patch documents are applied to the loaded
+// resource before it runs
+func (ec *EndpointConfig) applyPatching() {
+	if ec.PatchLoader == nil {
+		return
+	}
+	load := ec.PatchLoader
+	h := ec.Handler
+	ec.Handler = func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		if rd.patch == nil || rd.Body == nil {
+			return h(rc, rd)
+		}
+		current, err := load(rc, rd)
+		if err != nil {
+			// Not wrapped so an *Error such as ErrNotFound keeps its code
+			return nil, err
+		}
+		if err := applyPatch(rd.Body, current, rd.patch, rd.patchType); err != nil {
+			return nil, err
+		}
+		rd.patchBase = current
+		return h(rc, rd)
+	}
+}
+
+var patchMarshal = protojson.MarshalOptions{EmitUnpopulated: true}
+
+// Sets dst to current with the patch document applied
+func applyPatch(dst proto.Message, current protoreflect.ProtoMessage, patch []byte, patchType string) error {
+	unprocessable := func(msg string) error {
+		return NewError(StatusUnprocessableEntity, msg)
+	}
+	if current == nil {
+		return unprocessable("nothing to patch")
+	}
+	bs, err := patchMarshal.Marshal(current)
+	if err != nil {
+		return wrapErr(err)
+	}
+	var doc interface{}
+	if err := json.Unmarshal(bs, &doc); err != nil {
+		return wrapErr(err)
+	}
+
+	switch patchType {
+	case ContentTypeMergePatch.String():
+		var p interface{}
+		if err := json.Unmarshal(patch, &p); err != nil {
+			return NewError(StatusBadRequest, "invalid merge patch: "+err.Error())
+		}
+		doc = mergePatch(doc, p)
+	case ContentTypeJSONPatch.String():
+		var ops []jsonPatchOp
+		if err := json.Unmarshal(patch, &ops); err != nil {
+			return NewError(StatusBadRequest, "invalid json patch: "+err.Error())
+		}
+		for i, op := range ops {
+			doc, err = op.apply(doc)
+			if err != nil {
+				return unprocessable(fmt.Sprintf("operation %d (%s %s): %v", i, op.Op, op.Path, err))
+			}
+		}
+	default:
+		return NewError(StatusUnsupportedMediaType)
+	}
+
+	bs, err = json.Marshal(doc)
+	if err != nil {
+		return wrapErr(err)
+	}
+	proto.Reset(dst)
+	if err := protojson.Unmarshal(bs, dst); err != nil {
+		return unprocessable("patched resource is invalid: " + err.Error())
+	}
+	return nil
+}
+
+// RFC 7386 section 2
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
+
+// An RFC 6902 operation
+type jsonPatchOp struct {
+	Op    string           `json:"op"`
+	Path  string           `json:"path"`
+	From  string           `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+func (op jsonPatchOp) value() (interface{}, error) {
+	if op.Value == nil {
+		return nil, fmt.Errorf("missing value")
+	}
+	var v interface{}
+	if err := json.Unmarshal(*op.Value, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (op jsonPatchOp) apply(doc interface{}) (interface{}, error) {
+	switch op.Op {
+	case "add":
+		v, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		return pointerSet(doc, op.Path, v, true)
+	case "remove":
+		doc, _, err := pointerRemove(doc, op.Path)
+		return doc, err
+	case "replace":
+		v, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := pointerGet(doc, op.Path); err != nil {
+			return nil, err
+		}
+		return pointerSet(doc, op.Path, v, false)
+	case "move":
+		if strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, fmt.Errorf("can't move a value into itself")
+		}
+		doc, v, err := pointerRemove(doc, op.From)
+		if err != nil {
+			return nil, err
+		}
+		return pointerSet(doc, op.Path, v, true)
+	case "copy":
+		v, err := pointerGet(doc, op.From)
+		if err != nil {
+			return nil, err
+		}
+		return pointerSet(doc, op.Path, deepCopyJSON(v), true)
+	case "test":
+		want, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		got, err := pointerGet(doc, op.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(got, want) {
+			return nil, fmt.Errorf("test failed")
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown op %q", op.Op)
+}
+
+// Splits an RFC 6901 JSON Pointer into unescaped tokens
+func pointerTokens(ptr string) ([]string, error) {
+	if ptr == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(ptr, "/") {
+		return nil, fmt.Errorf("invalid pointer %q", ptr)
+	}
+	toks := strings.Split(ptr[1:], "/")
+	for i, t := range toks {
+		toks[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return toks, nil
+}
+
+// Index into an array. "-" addresses the end when allowed.
+func arrayIndex(tok string, n int, allowEnd bool) (int, error) {
+	if tok == "-" && allowEnd {
+		return n, nil
+	}
+	i, err := strconv.Atoi(tok)
+	if err != nil || i < 0 || (tok != "0" && strings.HasPrefix(tok, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", tok)
+	}
+	if i > n || (i == n && !allowEnd) {
+		return 0, fmt.Errorf("array index %d out of range", i)
+	}
+	return i, nil
+}
+
+func pointerGet(doc interface{}, ptr string) (interface{}, error) {
+	toks, err := pointerTokens(ptr)
+	if err != nil {
+		return nil, err
+	}
+	cur := doc
+	for _, t := range toks {
+		switch c := cur.(type) {
+		case map[string]interface{}:
+			v, ok := c[t]
+			if !ok {
+				return nil, fmt.Errorf("%s not found", ptr)
+			}
+			cur = v
+		case []interface{}:
+			i, err := arrayIndex(t, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			cur = c[i]
+		default:
+			return nil, fmt.Errorf("%s not found", ptr)
+		}
+	}
+	return cur, nil
+}
+
+// Adds or replaces the value at ptr. With insert, array
+// elements are inserted rather than replaced.
+func pointerSet(doc interface{}, ptr string, v interface{}, insert bool) (interface{}, error) {
+	toks, err := pointerTokens(ptr)
+	if err != nil {
+		return nil, err
+	}
+	if len(toks) == 0 {
+		return v, nil
+	}
+	parentPtr := ptr[:strings.LastIndex(ptr, "/")]
+	parent, err := pointerGet(doc, parentPtr)
+	if err != nil {
+		return nil, err
+	}
+	last := toks[len(toks)-1]
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		p[last] = v
+		return doc, nil
+	case []interface{}:
+		i, err := arrayIndex(last, len(p), insert)
+		if err != nil {
+			return nil, err
+		}
+		if !insert {
+			p[i] = v
+			return doc, nil
+		}
+		p = append(p, nil)
+		copy(p[i+1:], p[i:])
+		p[i] = v
+		return pointerSet(doc, parentPtr, p, false)
+	}
+	return nil, fmt.Errorf("%s not found", parentPtr)
+}
+
+// Removes the value at ptr returning the document and the value
+func pointerRemove(doc interface{}, ptr string) (interface{}, interface{}, error) {
+	toks, err := pointerTokens(ptr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(toks) == 0 {
+		return nil, nil, fmt.Errorf("can't remove the whole document")
+	}
+	v, err := pointerGet(doc, ptr)
+	if err != nil {
+		return nil, nil, err
+	}
+	parentPtr := ptr[:strings.LastIndex(ptr, "/")]
+	parent, _ := pointerGet(doc, parentPtr)
+	last := toks[len(toks)-1]
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		delete(p, last)
+		return doc, v, nil
+	case []interface{}:
+		i, _ := arrayIndex(last, len(p), false)
+		p = append(p[:i:i], p[i+1:]...)
+		doc, err := pointerSet(doc, parentPtr, p, false)
+		return doc, v, err
+	}
+	return nil, nil, fmt.Errorf("%s not found", ptr)
+}
+
+func deepCopyJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			c[k] = deepCopyJSON(e)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, e := range v {
+			c[i] = deepCopyJSON(e)
+		}
+		return c
+	}
+	return v
+}
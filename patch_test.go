@@ -0,0 +1,172 @@
+package prate
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daimaou92/prate/pb/fortest"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func TestPatchDocuments(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := map[string]*fortest.TestReq{"a": {Key: "a", Value: "one"}}
+	app.PATCH(NewEndpointConfig("/items/:id", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		req := rd.Body.(*fortest.TestReq)
+		return &fortest.TestRes{Key: req.Key, Value: req.Value}, nil
+	}).WithRequestPayloadType(&fortest.TestReq{}).WithPatchLoader(
+		func(_ *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+			if m, ok := stored[rd.Params.ByName("id")]; ok {
+				return m, nil
+			}
+			return nil, ErrNotFound
+		},
+	))
+	if err := app.Apply(Idempotency(IdempotencyOptions{})); err != nil {
+		t.Fatal(err)
+	}
+	app.mountEndpoints()
+
+	tests := []struct {
+		name, id, contentType, body string
+		code                        int
+		want                        *fortest.TestRes
+	}{
+		{"merge", "a", ContentTypeMergePatch.String(), `{"value":"two"}`, StatusOK, &fortest.TestRes{Key: "a", Value: "two"}},
+		{"merge removes", "a", ContentTypeMergePatch.String(), `{"value":null}`, StatusOK, &fortest.TestRes{Key: "a"}},
+		{"merge unknown field", "a", ContentTypeMergePatch.String(), `{"nope":1}`, StatusUnprocessableEntity, nil},
+		{"merge malformed", "a", ContentTypeMergePatch.String(), `{`, StatusBadRequest, nil},
+		{"json patch", "a", ContentTypeJSONPatch.String(),
+			`[{"op":"test","path":"/value","value":"one"},{"op":"copy","from":"/key","path":"/value"}]`,
+			StatusOK, &fortest.TestRes{Key: "a", Value: "a"}},
+		{"json patch replace", "a", ContentTypeJSONPatch.String(), `[{"op":"replace","path":"/key","value":"b"}]`, StatusOK, &fortest.TestRes{Key: "b", Value: "one"}},
+		{"json patch failed test", "a", ContentTypeJSONPatch.String(), `[{"op":"test","path":"/value","value":"x"}]`, StatusUnprocessableEntity, nil},
+		{"json patch missing path", "a", ContentTypeJSONPatch.String(), `[{"op":"remove","path":"/nope"}]`, StatusUnprocessableEntity, nil},
+		{"missing resource", "b", ContentTypeMergePatch.String(), `{"value":"two"}`, StatusNotFound, nil},
+	}
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPatch, "/items/"+tst.id, strings.NewReader(tst.body))
+			r.Header.Set(HeaderContentType, tst.contentType)
+			w := testServe(app, r)
+			if w.Code != tst.code {
+				t.Fatalf("code wanted: %d. got: %d %s", tst.code, w.Code, w.Body.String())
+			}
+			if tst.want == nil {
+				return
+			}
+			var res fortest.TestRes
+			if err := proto.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(&res, tst.want) {
+				t.Fatalf("wanted: %v. got: %v", tst.want, &res)
+			}
+		})
+	}
+
+	// Plain protobuf bodies still work
+	bs, _ := proto.Marshal(&fortest.TestReq{Key: "z", Value: "full"})
+	w := testServe(app, httptest.NewRequest(http.MethodPatch, "/items/a", strings.NewReader(string(bs))))
+	if w.Code != StatusOK {
+		t.Fatalf("protobuf body wanted: %d. got: %d", StatusOK, w.Code)
+	}
+
+	// Idempotency keys are matched against the patch document
+	patch := func(body string) int {
+		r := httptest.NewRequest(http.MethodPatch, "/items/a", strings.NewReader(body))
+		r.Header.Set(HeaderContentType, ContentTypeMergePatch.String())
+		r.Header.Set(HeaderIdempotencyKey, "p1")
+		return testServe(app, r).Code
+	}
+	if code := patch(`{"value":"two"}`); code != StatusOK {
+		t.Fatalf("keyed patch wanted: %d. got: %d", StatusOK, code)
+	}
+	if code := patch(`{"value":"three"}`); code != StatusUnprocessableEntity {
+		t.Fatalf("different patch wanted: %d. got: %d", StatusUnprocessableEntity, code)
+	}
+}
+
+func TestJSONPatchArrays(t *testing.T) {
+	doc := map[string]interface{}{"a": []interface{}{1.0, 2.0}}
+	ops := []jsonPatchOp{}
+	for _, raw := range []struct{ op, path, from, value string }{
+		{"add", "/a/1", "", "5"},
+		{"add", "/a/-", "", "9"},
+		{"remove", "/a/0", "", ""},
+		{"move", "/b", "/a/0", ""},
+	} {
+		op := jsonPatchOp{Op: raw.op, Path: raw.path, From: raw.from}
+		if raw.value != "" {
+			v := []byte(raw.value)
+			rm := json.RawMessage(v)
+			op.Value = &rm
+		}
+		ops = append(ops, op)
+	}
+	var cur interface{} = doc
+	var err error
+	for _, op := range ops {
+		if cur, err = op.apply(cur); err != nil {
+			t.Fatalf("%s %s: %v", op.Op, op.Path, err)
+		}
+	}
+	got := cur.(map[string]interface{})
+	if len(got["a"].([]interface{})) != 2 || got["b"] != 5.0 {
+		t.Fatalf("unexpected document %v", got)
+	}
+}
+
+func TestPatchBeforePolicies(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seenByMiddleware int
+	app.PATCH(NewEndpointConfig("/items/:id", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		return &fortest.TestRes{}, nil
+	}).WithRequestPayloadType(&fortest.TestReq{}).WithPatchLoader(
+		func(*RequestCtx, *RequestData) (protoreflect.ProtoMessage, error) {
+			return &fortest.TestReq{Key: "a", Value: "one"}, nil
+		},
+	).WithPolicy(RequireAttribute("unlocked", func(_ *RequestCtx, rd *RequestData) (bool, error) {
+		req := rd.Body.(*fortest.TestReq)
+		return req.Key == "a" && req.Value != "locked", nil
+	})))
+	if err := app.Apply(&Middleware{
+		ID: "size",
+		Handler: func(h Handler) Handler {
+			return func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+				seenByMiddleware = proto.Size(rd.Body)
+				return h(rc, rd)
+			}
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	app.mountEndpoints()
+
+	for _, tst := range []struct {
+		body string
+		code int
+	}{
+		{`{"value":"two"}`, StatusOK},
+		{`{"value":"locked"}`, StatusForbidden},
+	} {
+		r := httptest.NewRequest(http.MethodPatch, "/items/a", strings.NewReader(tst.body))
+		r.Header.Set(HeaderContentType, ContentTypeMergePatch.String())
+		if w := testServe(app, r); w.Code != tst.code {
+			t.Fatalf("%s wanted: %d. got: %d", tst.body, tst.code, w.Code)
+		}
+		if seenByMiddleware != 0 {
+			t.Fatalf("middleware wanted an empty body. got %d bytes", seenByMiddleware)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package prate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// The outcome of evaluating a Policy. Reason explains a denial
+// and is sent back to the client along the 403.
+type Decision struct {
+	Allowed bool
+	Reason  string
+}
+
+func allow() Decision {
+	return Decision{Allowed: true}
+}
+
+func deny(format string, args ...interface{}) Decision {
+	return Decision{Reason: fmt.Sprintf(format, args...)}
+}
+
+// An authorization rule evaluated right before the handler, after
+// every middleware has run. The request body has been decoded into
+// RequestData.Body and the Principal, if any, is on the RequestCtx.
+type Policy interface {
+	Evaluate(*RequestCtx, *RequestData) (Decision, error)
+	// Describes the policy for audit reports and API documentation
+	Describe() PolicyInfo
+}
+
+// Machine readable description of a Policy
+type PolicyInfo struct {
+	// One of "authenticated", "roles", "scopes", "attribute",
+	// "and", "or" or "not"
+	Kind string `json:"kind"`
+	// Name of an attribute policy
+	Name string `json:"name,omitempty"`
+	// Required roles or scopes
+	Values []string `json:"values,omitempty"`
+	// Operands of and/or/not
+	Policies []PolicyInfo `json:"policies,omitempty"`
+}
+
+func (pi PolicyInfo) String() string {
+	switch pi.Kind {
+	case "and", "or":
+		ps := make([]string, len(pi.Policies))
+		for i, p := range pi.Policies {
+			ps[i] = p.String()
+		}
+		return pi.Kind + "(" + strings.Join(ps, ", ") + ")"
+	case "not":
+		if len(pi.Policies) == 1 {
+			return "not(" + pi.Policies[0].String() + ")"
+		}
+	case "attribute":
+		return "attribute(" + pi.Name + ")"
+	case "roles", "scopes":
+		return pi.Kind + "(" + strings.Join(pi.Values, ", ") + ")"
+	}
+	return pi.Kind
+}
+
+// Returns the alternative sets of roles and scopes satisfying the
+// policy, in the shape of OpenAPI security requirement objects for
+// the security scheme named scheme. Attribute and negated policies
+// can't be expressed. They are left out of an and. An or with such a
+// branch, like a policy made of nothing else, has no requirements
+// rather than allowing anonymous access.
+func (pi PolicyInfo) SecurityRequirements(scheme string) []map[string][]string {
+	var reqs []map[string][]string
+	for _, alt := range pi.alternatives() {
+		reqs = append(reqs, map[string][]string{scheme: alt})
+	}
+	return reqs
+}
+
+func (pi PolicyInfo) alternatives() [][]string {
+	switch pi.Kind {
+	case "authenticated":
+		return [][]string{{}}
+	case "roles", "scopes":
+		return [][]string{append([]string{}, pi.Values...)}
+	case "or":
+		// A branch that can't be expressed may be the one letting a
+		// request in, so listing the others would overstate them
+		var alts [][]string
+		for _, p := range pi.Policies {
+			palts := p.alternatives()
+			if palts == nil {
+				return nil
+			}
+			alts = append(alts, palts...)
+		}
+		return alts
+	case "and":
+		var alts [][]string
+		for _, p := range pi.Policies {
+			palts := p.alternatives()
+			if palts == nil {
+				continue
+			}
+			if alts == nil {
+				alts = palts
+				continue
+			}
+			var next [][]string
+			for _, a := range alts {
+				for _, b := range palts {
+					next = append(next, mergeSorted(a, b))
+				}
+			}
+			alts = next
+		}
+		return alts
+	}
+	return nil
+}
+
+func mergeSorted(a, b []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, v := range append(append([]string{}, a...), b...) {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+type policyFunc struct {
+	info PolicyInfo
+	f    func(*RequestCtx, *RequestData) (Decision, error)
+}
+
+func (p policyFunc) Evaluate(rc *RequestCtx, rd *RequestData) (Decision, error) {
+	return p.f(rc, rd)
+}
+
+func (p policyFunc) Describe() PolicyInfo {
+	return p.info
+}
+
+// Allows any authenticated Principal
+func RequireAuthenticated() Policy {
+	return policyFunc{
+		info: PolicyInfo{Kind: "authenticated"},
+		f: func(rc *RequestCtx, _ *RequestData) (Decision, error) {
+			if rc.Principal() == nil {
+				return deny("authentication required"), nil
+			}
+			return allow(), nil
+		},
+	}
+}
+
+// Allows a Principal holding every one of roles
+func RequireRoles(roles ...string) Policy {
+	return policyFunc{
+		info: PolicyInfo{Kind: "roles", Values: roles},
+		f: func(rc *RequestCtx, _ *RequestData) (Decision, error) {
+			p := rc.Principal()
+			for _, r := range roles {
+				if !p.HasRole(r) {
+					return deny("missing role %q", r), nil
+				}
+			}
+			return allow(), nil
+		},
+	}
+}
+
+// Allows a Principal granted every one of scopes
+func RequireScopes(scopes ...string) Policy {
+	return policyFunc{
+		info: PolicyInfo{Kind: "scopes", Values: scopes},
+		f: func(rc *RequestCtx, _ *RequestData) (Decision, error) {
+			p := rc.Principal()
+			for _, s := range scopes {
+				if !p.HasScope(s) {
+					return deny("missing scope %q", s), nil
+				}
+			}
+			return allow(), nil
+		},
+	}
+}
+
+// Attribute based policy. f sees the path params, the decoded
+// body and the Principal. name identifies the policy in denial
+// reasons and in PolicyInfo.
+func RequireAttribute(name string, f func(*RequestCtx, *RequestData) (bool, error)) Policy {
+	return policyFunc{
+		info: PolicyInfo{Kind: "attribute", Name: name},
+		f: func(rc *RequestCtx, rd *RequestData) (Decision, error) {
+			ok, err := f(rc, rd)
+			if err != nil {
+				return Decision{}, wrapErr(err, name)
+			}
+			if !ok {
+				return deny("%s not satisfied", name), nil
+			}
+			return allow(), nil
+		},
+	}
+}
+
+// Allows when every policy allows
+func And(ps ...Policy) Policy {
+	info := PolicyInfo{Kind: "and"}
+	for _, p := range ps {
+		info.Policies = append(info.Policies, p.Describe())
+	}
+	return policyFunc{
+		info: info,
+		f: func(rc *RequestCtx, rd *RequestData) (Decision, error) {
+			for _, p := range ps {
+				d, err := p.Evaluate(rc, rd)
+				if err != nil || !d.Allowed {
+					return d, err
+				}
+			}
+			return allow(), nil
+		},
+	}
+}
+
+// Allows when at least one policy allows
+func Or(ps ...Policy) Policy {
+	info := PolicyInfo{Kind: "or"}
+	for _, p := range ps {
+		info.Policies = append(info.Policies, p.Describe())
+	}
+	return policyFunc{
+		info: info,
+		f: func(rc *RequestCtx, rd *RequestData) (Decision, error) {
+			var reasons []string
+			for _, p := range ps {
+				d, err := p.Evaluate(rc, rd)
+				if err != nil {
+					return d, err
+				}
+				if d.Allowed {
+					return d, nil
+				}
+				reasons = append(reasons, d.Reason)
+			}
+			return deny("%s", strings.Join(reasons, " or ")), nil
+		},
+	}
+}
+
+// Allows when p denies
+func Not(p Policy) Policy {
+	info := p.Describe()
+	return policyFunc{
+		info: PolicyInfo{Kind: "not", Policies: []PolicyInfo{info}},
+		f: func(rc *RequestCtx, rd *RequestData) (Decision, error) {
+			d, err := p.Evaluate(rc, rd)
+			if err != nil {
+				return d, err
+			}
+			if d.Allowed {
+				return deny("%s must not hold", info), nil
+			}
+			return allow(), nil
+		},
+	}
+}
+
+// Wraps the handler so the endpoint's policies are evaluated
+// right before it runs. Must be called before middlewares are applied.
+func (ec *EndpointConfig) applyPolicies() {
+	if len(ec.Policies) == 0 {
+		return
+	}
+	p := ec.Policies[0]
+	if len(ec.Policies) > 1 {
+		p = And(ec.Policies...)
+	}
+	next := ec.Handler
+	ec.Handler = func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		d, err := p.Evaluate(rc, rd)
+		if err != nil {
+			return nil, wrapErr(err)
+		}
+		if !d.Allowed {
+			return nil, NewError(StatusForbidden, httpStatusMessage[StatusForbidden], d.Reason)
+		}
+		return next(rc, rd)
+	}
+}
+
+// The policies declared on one endpoint
+type EndpointPolicy struct {
+	Method string       `json:"method"`
+	Path   string       `json:"path"`
+	Policy []PolicyInfo `json:"policy"`
+}
+
+// Lists the policies declared on every registered endpoint. Endpoints
+// without policies are included with an empty Policy so audits can
+// spot unprotected routes.
+func (app *App) Policies() []EndpointPolicy {
+	eps := make([]EndpointPolicy, 0, len(app.epCache))
+	for _, v := range app.epCache {
+		ep := EndpointPolicy{
+			Method: v.ec.method,
+			Path:   v.ec.Path,
+		}
+		for _, p := range v.ec.Policies {
+			ep.Policy = append(ep.Policy, p.Describe())
+		}
+		eps = append(eps, ep)
+	}
+	return eps
+}
@@ -0,0 +1,123 @@
+package prate
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/daimaou92/prate/pb/fortest"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func TestPolicies(t *testing.T) {
+	ownsOrder := RequireAttribute("owner", func(rc *RequestCtx, rd *RequestData) (bool, error) {
+		req, ok := rd.Body.(*fortest.TestReq)
+		return ok && rc.Principal() != nil && req.Key == rc.Principal().Subject, nil
+	})
+	p := Or(
+		RequireRoles("admin"),
+		And(RequireScopes("orders:write"), ownsOrder, Not(RequireRoles("suspended"))),
+	)
+
+	tsts := []struct {
+		name      string
+		principal *Principal
+		key       string
+		allowed   bool
+	}{
+		{"admin", &Principal{Subject: "a", Roles: []string{"admin"}}, "x", true},
+		{"owner", &Principal{Subject: "u1", Scopes: []string{"orders:write"}}, "u1", true},
+		{"not owner", &Principal{Subject: "u1", Scopes: []string{"orders:write"}}, "u2", false},
+		{"suspended", &Principal{Subject: "u1", Scopes: []string{"orders:write"}, Roles: []string{"suspended"}}, "u1", false},
+		{"anonymous", nil, "u1", false},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.name, func(t *testing.T) {
+			rc := &RequestCtx{principal: tst.principal}
+			rd := &RequestData{Body: &fortest.TestReq{Key: tst.key}}
+			d, err := p.Evaluate(rc, rd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.Allowed != tst.allowed {
+				t.Fatalf("allowed wanted: %v. got: %v (%s)", tst.allowed, d.Allowed, d.Reason)
+			}
+			if !d.Allowed && d.Reason == "" {
+				t.Fatalf("denial without reason")
+			}
+		})
+	}
+
+	want := []map[string][]string{
+		{"oauth2": {"admin"}},
+		{"oauth2": {"orders:write"}},
+	}
+	if got := p.Describe().SecurityRequirements("oauth2"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("security requirements wanted: %v. got: %v", want, got)
+	}
+	for _, p := range []Policy{
+		ownsOrder,
+		Not(RequireRoles("suspended")),
+		And(ownsOrder, Not(RequireRoles("x"))),
+		Or(RequireRoles("admin"), ownsOrder),
+	} {
+		if got := p.Describe().SecurityRequirements("oauth2"); got != nil {
+			t.Fatalf("%s security requirements wanted none. got: %v", p.Describe(), got)
+		}
+	}
+}
+
+func TestEndpointPolicy(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.POST(NewEndpointConfig("/orders", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		return &fortest.TestRes{}, nil
+	}).WithRequestPayloadType(&fortest.TestReq{}).WithPolicy(RequireScopes("orders:write")))
+	if err := app.Apply(&Middleware{
+		ID: "fakeauth",
+		Handler: func(h Handler) Handler {
+			return func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+				rc.principal = &Principal{Scopes: strings.Fields(rc.Request.Header.Get("X-Scopes"))}
+				return h(rc, rd)
+			}
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	app.mountEndpoints()
+
+	if ps := app.Policies(); len(ps) != 1 || ps[0].Policy[0].Kind != "scopes" {
+		t.Fatalf("unexpected policies: %+v", ps)
+	}
+
+	bs, _ := proto.Marshal(&fortest.TestReq{Key: "k"})
+	for _, tst := range []struct {
+		scopes string
+		code   int
+	}{{"orders:read", StatusForbidden}, {"orders:read orders:write", StatusOK}} {
+		r := httptest.NewRequest(http.MethodPost, "/orders", bytes.NewReader(bs))
+		r.Header.Set("X-Scopes", tst.scopes)
+		w := testServe(app, r)
+		if w.Code != tst.code {
+			t.Fatalf("statuscode wanted: %d. got: %d", tst.code, w.Code)
+		}
+		if tst.code == StatusForbidden {
+			body, _ := io.ReadAll(w.Body)
+			if !strings.Contains(string(body), `missing scope "orders:write"`) {
+				t.Fatalf("reason missing from body: %s", body)
+			}
+		}
+	}
+
+	if !errors.Is(NewError(StatusForbidden, "reason"), ErrForbidden) {
+		t.Fatalf("errors.Is should match on code")
+	}
+}
@@ -0,0 +1,254 @@
+package prate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Content of known size readable at any offset, for example a
+// blob in object storage fetched with ranged reads
+type ContentProvider interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// More ranges than this in one request are answered with the
+// whole content
+const maxRanges = 32
+
+type byteRange struct {
+	start, length int64
+}
+
+func (br byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.start+br.length-1, size)
+}
+
+var errUnsatisfiableRange = errors.New("range not satisfiable")
+
+// Parses a Range header against content of size bytes. Returns
+// nil ranges for headers to ignore and errUnsatisfiableRange when
+// no range overlaps the content.
+func parseRange(s string, size int64) ([]byteRange, error) {
+	if !strings.HasPrefix(s, "bytes=") {
+		return nil, nil
+	}
+	spec := strings.TrimPrefix(s, "bytes=")
+	var ranges []byteRange
+	var total int64
+	satisfiable := false
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, nil
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+		var br byteRange
+		if first == "" {
+			// Suffix range: the last n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			br = byteRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, nil
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			if start >= size {
+				continue
+			}
+			br = byteRange{start: start, length: end - start + 1}
+		}
+		satisfiable = true
+		total += br.length
+		ranges = append(ranges, br)
+	}
+	if !satisfiable {
+		if size == 0 {
+			// Nothing to slice, serve the empty content
+			return nil, nil
+		}
+		return nil, errUnsatisfiableRange
+	}
+	if len(ranges) > maxRanges || total > size {
+		// Likely abusive, send everything once instead
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+// Reports whether If-Range allows the Range header to be used
+func ifRangeMatches(r *http.Request, etag string, modTime time.Time) bool {
+	ir := strings.TrimSpace(r.Header.Get(HeaderIfRange))
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		// Only a strong match counts
+		return !strings.HasPrefix(ir, "W/") && ir == etag
+	}
+	t, err := http.ParseTime(ir)
+	return err == nil && !modTime.IsZero() && modTime.Truncate(time.Second).Equal(t)
+}
+
+// Serves content from a seekable reader with support for
+// conditional and range requests, including multipart/byteranges
+// responses for several ranges. The Content-Type is taken from the
+// header if already set, then from the extension of name, then
+// sniffed. Set an ETag with SetETag beforehand to make If-Range and
+// If-None-Match work with it. Handlers return nil, nil after, or
+// the error, which is only set before anything was written.
+func (rc *RequestCtx) ServeContent(name string, modTime time.Time, content io.ReadSeeker) error {
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return wrapErr(err)
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return wrapErr(err)
+	}
+	return rc.serveRanges(name, modTime, size, func(w io.Writer, off, n int64) error {
+		if _, err := content.Seek(off, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := io.CopyN(w, content, n)
+		return err
+	})
+}
+
+// Like ServeContent for content that is read at offsets
+// rather than sought
+func (rc *RequestCtx) ServeContentFrom(name string, modTime time.Time, content ContentProvider) error {
+	return rc.serveRanges(name, modTime, content.Size(), func(w io.Writer, off, n int64) error {
+		_, err := io.Copy(w, io.NewSectionReader(content, off, n))
+		return err
+	})
+}
+
+func (rc *RequestCtx) serveRanges(
+	name string, modTime time.Time, size int64,
+	copyRange func(w io.Writer, off, n int64) error,
+) error {
+	r := rc.Request
+	w := rc.ResponseWriter
+	hd := w.Header()
+	rc.SetLastModified(modTime)
+	etag := hd.Get(HeaderETag)
+
+	if err := rc.CheckPreconditions(etag, modTime); err != nil {
+		return err
+	}
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && notModified(r, hd) {
+		hd.Del(HeaderContentType)
+		hd.Del(HeaderContentLength)
+		w.WriteHeader(StatusNotModified)
+		return nil
+	}
+
+	ct := hd.Get(HeaderContentType)
+	if ct == "" {
+		ct = ContentTypeFromExtension(path.Ext(name))
+	}
+	if ct == "" {
+		ct = mime.TypeByExtension(path.Ext(name))
+	}
+	if ct == "" {
+		var buf bytes.Buffer
+		n := size
+		if n > 512 {
+			n = 512
+		}
+		if err := copyRange(&buf, 0, n); err != nil {
+			return wrapErr(err)
+		}
+		ct = http.DetectContentType(buf.Bytes())
+	}
+	hd.Set(HeaderContentType, ct)
+	hd.Set(HeaderAcceptRanges, "bytes")
+
+	var ranges []byteRange
+	if rh := r.Header.Get(HeaderRange); rh != "" && r.Method == http.MethodGet && ifRangeMatches(r, etag, modTime) {
+		var err error
+		ranges, err = parseRange(rh, size)
+		if err != nil {
+			hd.Del(HeaderContentType)
+			hd.Set(HeaderContentRange, fmt.Sprintf("bytes */%d", size))
+			return ErrRequestedRangeNotSatisfiable
+		}
+	}
+
+	switch len(ranges) {
+	case 0:
+		hd.Set(HeaderContentLength, strconv.FormatInt(size, 10))
+		w.WriteHeader(StatusOK)
+		if r.Method == http.MethodHead {
+			return nil
+		}
+		if err := copyRange(w, 0, size); err != nil {
+			log.Println(wrapErr(err))
+		}
+	case 1:
+		br := ranges[0]
+		hd.Set(HeaderContentRange, br.contentRange(size))
+		hd.Set(HeaderContentLength, strconv.FormatInt(br.length, 10))
+		w.WriteHeader(StatusPartialContent)
+		if err := copyRange(w, br.start, br.length); err != nil {
+			log.Println(wrapErr(err))
+		}
+	default:
+		mw := multipart.NewWriter(w)
+		hd.Set(HeaderContentType, "multipart/byteranges; boundary="+mw.Boundary())
+		hd.Del(HeaderContentLength)
+		w.WriteHeader(StatusPartialContent)
+		for _, br := range ranges {
+			pw, err := mw.CreatePart(textproto.MIMEHeader{
+				HeaderContentType:  {ct},
+				HeaderContentRange: {br.contentRange(size)},
+			})
+			if err == nil {
+				err = copyRange(pw, br.start, br.length)
+			}
+			if err != nil {
+				// Headers are out, all that's left is to stop
+				log.Println(wrapErr(err))
+				return nil
+			}
+		}
+		if err := mw.Close(); err != nil {
+			log.Println(wrapErr(err))
+		}
+	}
+	return nil
+}
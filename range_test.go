@@ -0,0 +1,132 @@
+package prate
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+type stringProvider struct {
+	*strings.Reader
+}
+
+func (sp stringProvider) Size() int64 {
+	return sp.Reader.Size()
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []byteRange
+		err    bool
+	}{
+		{"bytes=0-4", []byteRange{{0, 5}}, false},
+		{"bytes=5-", []byteRange{{5, 5}}, false},
+		{"bytes=-3", []byteRange{{7, 3}}, false},
+		{"bytes=8-100", []byteRange{{8, 2}}, false},
+		{"bytes=0-1, 4-5", []byteRange{{0, 2}, {4, 2}}, false},
+		{"bytes=20-30", nil, true},
+		{"bytes=20-30, 0-0", []byteRange{{0, 1}}, false},
+		{"bytes=5-2", nil, false},
+		{"items=0-1", nil, false},
+		{"bytes=0-9, 0-9", nil, false},
+	}
+	for _, tst := range tests {
+		got, err := parseRange(tst.header, 10)
+		if (err != nil) != tst.err {
+			t.Fatalf("%s: error wanted: %v. got: %v", tst.header, tst.err, err)
+		}
+		if len(got) != len(tst.want) {
+			t.Fatalf("%s: wanted: %v. got: %v", tst.header, tst.want, got)
+		}
+		for i := range got {
+			if got[i] != tst.want[i] {
+				t.Fatalf("%s: wanted: %v. got: %v", tst.header, tst.want, got)
+			}
+		}
+	}
+}
+
+func TestServeContent(t *testing.T) {
+	const content = "0123456789"
+	modified := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.GET(NewEndpointConfig("/seeker", func(rc *RequestCtx, _ *RequestData) (protoreflect.ProtoMessage, error) {
+		rc.SetETag("v1")
+		return nil, rc.ServeContent("digits.txt", modified, strings.NewReader(content))
+	}))
+	app.GET(NewEndpointConfig("/provider", func(rc *RequestCtx, _ *RequestData) (protoreflect.ProtoMessage, error) {
+		return nil, rc.ServeContentFrom("digits", modified, stringProvider{strings.NewReader(content)})
+	}))
+	app.mountEndpoints()
+
+	tests := []struct {
+		name         string
+		path         string
+		headers      map[string]string
+		code         int
+		body         string
+		contentRange string
+	}{
+		{"full", "/seeker", nil, StatusOK, content, ""},
+		{"single range", "/seeker", map[string]string{HeaderRange: "bytes=2-4"}, StatusPartialContent, "234", "bytes 2-4/10"},
+		{"suffix range", "/provider", map[string]string{HeaderRange: "bytes=-2"}, StatusPartialContent, "89", "bytes 8-9/10"},
+		{"unsatisfiable", "/seeker", map[string]string{HeaderRange: "bytes=50-"}, StatusRequestedRangeNotSatisfiable, "", "bytes */10"},
+		{"if-range match", "/seeker", map[string]string{HeaderRange: "bytes=0-0", HeaderIfRange: `"v1"`}, StatusPartialContent, "0", "bytes 0-0/10"},
+		{"if-range stale", "/seeker", map[string]string{HeaderRange: "bytes=0-0", HeaderIfRange: `"v0"`}, StatusOK, content, ""},
+		{"if-range date", "/provider", map[string]string{HeaderRange: "bytes=0-0", HeaderIfRange: modified.Format(http.TimeFormat)}, StatusPartialContent, "0", "bytes 0-0/10"},
+		{"not modified", "/seeker", map[string]string{HeaderIfNoneMatch: `"v1"`}, StatusNotModified, "", ""},
+	}
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tst.path, nil)
+			for k, v := range tst.headers {
+				r.Header.Set(k, v)
+			}
+			w := testServe(app, r)
+			if w.Code != tst.code {
+				t.Fatalf("code wanted: %d. got: %d", tst.code, w.Code)
+			}
+			if w.Header().Get(HeaderContentRange) != tst.contentRange {
+				t.Fatalf("content-range wanted: %q. got: %q", tst.contentRange, w.Header().Get(HeaderContentRange))
+			}
+			if tst.code < 300 && w.Body.String() != tst.body {
+				t.Fatalf("body wanted: %q. got: %q", tst.body, w.Body.String())
+			}
+		})
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/seeker", nil)
+	r.Header.Set(HeaderRange, "bytes=0-1,5-6")
+	w := testServe(app, r)
+	mt, params, err := mime.ParseMediaType(w.Header().Get(HeaderContentType))
+	if w.Code != StatusPartialContent || err != nil || mt != "multipart/byteranges" {
+		t.Fatalf("wanted multipart/byteranges 206. got: %d %q", w.Code, w.Header().Get(HeaderContentType))
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	var parts []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs, _ := io.ReadAll(p)
+		parts = append(parts, p.Header.Get(HeaderContentRange)+"="+string(bs))
+	}
+	if strings.Join(parts, ";") != "bytes 0-1/10=01;bytes 5-6/10=56" {
+		t.Fatalf("unexpected parts: %v", parts)
+	}
+}
@@ -0,0 +1,325 @@
+package prate
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+type RateLimitAlgorithm int
+
+const (
+	// Allows bursts of up to RateLimit.Burst requests and refills
+	// at Limit requests per Window.
+	TokenBucket RateLimitAlgorithm = iota
+
+	// Weighted sliding window counter. Smooths out the boundary
+	// spikes of a fixed window without storing every timestamp.
+	SlidingWindow
+)
+
+// A quota of Limit requests per Window
+type RateLimit struct {
+	Limit     int
+	Window    time.Duration
+	Burst     int
+	Algorithm RateLimitAlgorithm
+}
+
+func (rl RateLimit) valid() bool {
+	return rl.Limit > 0 && rl.Window > 0
+}
+
+func (rl RateLimit) capacity() float64 {
+	if rl.Burst > 0 {
+		return float64(rl.Burst)
+	}
+	return float64(rl.Limit)
+}
+
+// Value of the RateLimit-Policy header
+func (rl RateLimit) policy() string {
+	return fmt.Sprintf("%d;w=%d", rl.Limit, int(math.Ceil(rl.Window.Seconds())))
+}
+
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Time until the quota is fully restored
+	Reset time.Duration
+	// Time until the next request would be allowed. Zero when Allowed.
+	RetryAfter time.Duration
+}
+
+// Storage for rate limiting state. Implementations backed by a
+// shared store (redis, memcached...) let several instances of a
+// service enforce a single quota.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, rl RateLimit) (RateLimitResult, error)
+}
+
+// Returns the key a request is counted against
+type RateLimitKeyFunc func(*RequestCtx, *RequestData) (string, error)
+
+// Keys requests by client IP as reported by RequestCtx.IP
+func RateLimitByIP(rc *RequestCtx, _ *RequestData) (string, error) {
+	return "ip:" + rc.IP(), nil
+}
+
+// Keys requests by the value of a header, typically an API key.
+// Requests without the header are keyed by IP.
+func RateLimitByHeader(name string) RateLimitKeyFunc {
+	return func(rc *RequestCtx, rd *RequestData) (string, error) {
+		v := rc.Request.Header.Get(name)
+		if v == "" {
+			return RateLimitByIP(rc, rd)
+		}
+		return "hdr:" + strings.ToLower(name) + ":" + v, nil
+	}
+}
+
+// Keys requests by the authenticated Principal, falling back to the
+// user stored in RequestData.Custom["user"]. Anonymous requests are
+// keyed by IP.
+func RateLimitByPrincipal(rc *RequestCtx, rd *RequestData) (string, error) {
+	if p := rc.Principal(); p != nil {
+		return "principal:" + p.Scheme + ":" + p.Subject, nil
+	}
+	if rd != nil {
+		if u, ok := rd.Custom["user"]; ok && u != nil {
+			return fmt.Sprintf("user:%v", u), nil
+		}
+	}
+	return RateLimitByIP(rc, rd)
+}
+
+type RateLimitOptions struct {
+	// Quota applied to endpoints that do not declare their own
+	// through EndpointConfig.WithRateLimit. A zero value leaves
+	// such endpoints unlimited.
+	Default RateLimit
+	// Defaults to RateLimitByIP
+	Key RateLimitKeyFunc
+	// Defaults to an in-memory store holding up to 100000 keys
+	Store RateLimitStore
+}
+
+// Returns a middleware with ID "ratelimit". Every endpoint declaring
+// its own quota gets a separate budget, the rest share Default.
+func RateLimiter(opts RateLimitOptions) *Middleware {
+	if opts.Key == nil {
+		opts.Key = RateLimitByIP
+	}
+	if opts.Store == nil {
+		opts.Store = NewMemoryRateLimitStore(100000)
+	}
+	return &Middleware{
+		ID: "ratelimit",
+		Handler: func(h Handler) Handler {
+			return func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+				rl, scope := opts.Default, "app"
+				if rc.endpoint != nil && rc.endpoint.config.RateLimit != nil {
+					rl = *rc.endpoint.config.RateLimit
+					scope = rc.endpoint.method + " " + rc.endpoint.path
+				}
+				if !rl.valid() {
+					return h(rc, rd)
+				}
+
+				key, err := opts.Key(rc, rd)
+				if err != nil {
+					return nil, wrapErr(err)
+				}
+				res, err := opts.Store.Take(rc.Context(), scope+"|"+key, rl)
+				if err != nil {
+					// Fail open. A broken store must not take the service down.
+					log.Println(wrapErr(err))
+					return h(rc, rd)
+				}
+
+				hd := rc.ResponseWriter.Header()
+				hd.Set(HeaderRateLimitPolicy, rl.policy())
+				hd.Set(HeaderRateLimitLimit, strconv.Itoa(res.Limit))
+				hd.Set(HeaderRateLimitRemaining, strconv.Itoa(res.Remaining))
+				hd.Set(HeaderRateLimitReset, strconv.Itoa(ceilSeconds(res.Reset)))
+				if !res.Allowed {
+					hd.Set(HeaderRetryAfter, strconv.Itoa(ceilSeconds(res.RetryAfter)))
+					return nil, ErrTooManyRequests
+				}
+				return h(rc, rd)
+			}
+		},
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(math.Ceil(d.Seconds()))
+}
+
+type rateLimitEntry struct {
+	key     string
+	expires time.Time
+
+	// token bucket
+	tokens float64
+	last   time.Time
+
+	// sliding window
+	windowStart time.Time
+	prev, curr  int
+}
+
+// In-memory RateLimitStore. Idle keys are evicted once their quota
+// has been fully restored and the least recently used key is evicted
+// when the store is full.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	maxKeys   int
+	entries   map[string]*list.Element
+	lru       *list.List
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemoryRateLimitStore(maxKeys int) *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		maxKeys: maxKeys,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+// Number of keys currently tracked
+func (s *MemoryRateLimitStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+func (s *MemoryRateLimitStore) Take(_ context.Context, key string, rl RateLimit) (RateLimitResult, error) {
+	if !rl.valid() {
+		return RateLimitResult{}, wrapErr(fmt.Errorf("invalid rate limit"))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		s.sweep(now)
+	}
+
+	var e *rateLimitEntry
+	if el, ok := s.entries[key]; ok {
+		s.lru.MoveToFront(el)
+		e = el.Value.(*rateLimitEntry)
+	} else {
+		if s.maxKeys > 0 && s.lru.Len() >= s.maxKeys {
+			s.evict(s.lru.Back())
+		}
+		e = &rateLimitEntry{
+			key:         key,
+			tokens:      rl.capacity(),
+			last:        now,
+			windowStart: now,
+		}
+		s.entries[key] = s.lru.PushFront(e)
+	}
+
+	var res RateLimitResult
+	switch rl.Algorithm {
+	case SlidingWindow:
+		res = e.slidingWindow(rl, now)
+	default:
+		res = e.tokenBucket(rl, now)
+	}
+	e.expires = now.Add(res.Reset)
+	return res, nil
+}
+
+func (s *MemoryRateLimitStore) evict(el *list.Element) {
+	if el == nil {
+		return
+	}
+	s.lru.Remove(el)
+	delete(s.entries, el.Value.(*rateLimitEntry).key)
+}
+
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	s.lastSweep = now
+	for el := s.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if !el.Value.(*rateLimitEntry).expires.After(now) {
+			s.evict(el)
+		}
+		el = prev
+	}
+}
+
+func (e *rateLimitEntry) tokenBucket(rl RateLimit, now time.Time) RateLimitResult {
+	capacity := rl.capacity()
+	perSec := float64(rl.Limit) / rl.Window.Seconds()
+
+	e.tokens = math.Min(capacity, e.tokens+now.Sub(e.last).Seconds()*perSec)
+	e.last = now
+
+	res := RateLimitResult{Limit: int(capacity)}
+	if e.tokens >= 1 {
+		e.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = secondsDuration((1 - e.tokens) / perSec)
+	}
+	res.Remaining = int(math.Floor(e.tokens))
+	res.Reset = secondsDuration((capacity - e.tokens) / perSec)
+	return res
+}
+
+func (e *rateLimitEntry) slidingWindow(rl RateLimit, now time.Time) RateLimitResult {
+	// Roll the windows forward
+	if elapsed := now.Sub(e.windowStart); elapsed >= rl.Window {
+		n := int(elapsed / rl.Window)
+		if n == 1 {
+			e.prev = e.curr
+		} else {
+			e.prev = 0
+		}
+		e.curr = 0
+		e.windowStart = e.windowStart.Add(time.Duration(n) * rl.Window)
+	}
+	elapsed := now.Sub(e.windowStart)
+	weight := 1 - float64(elapsed)/float64(rl.Window)
+	estimate := float64(e.prev)*weight + float64(e.curr)
+
+	res := RateLimitResult{Limit: rl.Limit}
+	if estimate+1 <= float64(rl.Limit) {
+		e.curr++
+		estimate++
+		res.Allowed = true
+	} else if e.curr+1 > rl.Limit || e.prev == 0 {
+		res.RetryAfter = rl.Window - elapsed
+	} else {
+		// Wait for the previous window's share to decay enough
+		need := 1 - float64(rl.Limit-1-e.curr)/float64(e.prev)
+		res.RetryAfter = time.Duration(need*float64(rl.Window)) - elapsed
+	}
+	res.Remaining = int(math.Max(0, math.Floor(float64(rl.Limit)-estimate)))
+	res.Reset = 2*rl.Window - elapsed
+	return res
+}
+
+func secondsDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,126 @@
+package prate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/daimaou92/prate/pb/fortest"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	type step struct {
+		after   time.Duration
+		allowed bool
+	}
+	tsts := []struct {
+		name  string
+		rl    RateLimit
+		steps []step
+	}{
+		{
+			name: "token bucket",
+			rl:   RateLimit{Limit: 2, Window: time.Second, Algorithm: TokenBucket},
+			steps: []step{
+				{0, true}, {0, true}, {0, false},
+				{500 * time.Millisecond, true}, {0, false},
+				{time.Second, true}, {0, true}, {0, false},
+			},
+		}, {
+			name: "sliding window",
+			rl:   RateLimit{Limit: 2, Window: time.Second, Algorithm: SlidingWindow},
+			steps: []step{
+				{0, true}, {0, true}, {0, false},
+				// prev=2 weighted at 0.5 -> 1 slot left
+				{1500 * time.Millisecond, true}, {0, false},
+				{2 * time.Second, true}, {0, true}, {0, false},
+			},
+		},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.name, func(t *testing.T) {
+			now := time.Unix(1000, 0)
+			s := NewMemoryRateLimitStore(10)
+			s.now = func() time.Time { return now }
+			for i, st := range tst.steps {
+				now = now.Add(st.after)
+				res, err := s.Take(context.TODO(), "k", tst.rl)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res.Allowed != st.allowed {
+					t.Fatalf("step %d allowed wanted: %v. got: %v", i, st.allowed, res.Allowed)
+				}
+				if !res.Allowed && res.RetryAfter <= 0 {
+					t.Fatalf("step %d retry after not set", i)
+				}
+			}
+		})
+	}
+
+	t.Run("eviction", func(t *testing.T) {
+		s := NewMemoryRateLimitStore(2)
+		rl := RateLimit{Limit: 1, Window: time.Minute}
+		for _, k := range []string{"a", "b", "c"} {
+			if _, err := s.Take(context.TODO(), k, rl); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if s.Len() != 2 {
+			t.Fatalf("len wanted: 2. got: %d", s.Len())
+		}
+		res, _ := s.Take(context.TODO(), "a", rl)
+		if !res.Allowed {
+			t.Fatalf("evicted key should start with a fresh quota")
+		}
+	})
+}
+
+func TestRateLimiter(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		return &fortest.TestRes{}, nil
+	}
+	app.GET(NewEndpointConfig("/a", h))
+	app.GET(NewEndpointConfig("/b", h).WithRateLimit(RateLimit{Limit: 1, Window: time.Minute}))
+	if err := app.Apply(RateLimiter(RateLimitOptions{
+		Default: RateLimit{Limit: 2, Window: time.Minute},
+		Key:     RateLimitByHeader("X-Api-Key"),
+	})); err != nil {
+		t.Fatal(err)
+	}
+	app.mountEndpoints()
+
+	do := func(path, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("X-Api-Key", key)
+		return testServe(app, r)
+	}
+	for i, want := range []int{StatusOK, StatusOK, StatusTooManyRequests} {
+		if w := do("/a", "k1"); w.Code != want {
+			t.Fatalf("request %d statuscode wanted: %d. got: %d", i, want, w.Code)
+		}
+	}
+	w := do("/a", "k1")
+	if v := w.Header().Get(HeaderRetryAfter); v == "" {
+		t.Fatalf("retry-after not set")
+	}
+	if v := w.Header().Get(HeaderRateLimitRemaining); v != "0" {
+		t.Fatalf("remaining wanted: 0. got: %s", v)
+	}
+	if w := do("/a", "k2"); w.Code != StatusOK {
+		t.Fatalf("other key statuscode wanted: %d. got: %d", StatusOK, w.Code)
+	}
+	if w := do("/b", "k1"); w.Code != StatusOK {
+		t.Fatalf("endpoint quota statuscode wanted: %d. got: %d", StatusOK, w.Code)
+	}
+	if w := do("/b", "k1"); w.Code != StatusTooManyRequests {
+		t.Fatalf("endpoint quota statuscode wanted: %d. got: %d", StatusTooManyRequests, w.Code)
+	}
+}
@@ -0,0 +1,92 @@
+package prate
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+)
+
+// In-memory http.ResponseWriter used to capture a response so it
+// can be stored and replayed later
+type responseRecorder struct {
+	header      http.Header
+	code        int
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{
+		header: http.Header{},
+	}
+}
+
+func (rr *responseRecorder) Header() http.Header {
+	return rr.header
+}
+
+func (rr *responseRecorder) WriteHeader(code int) {
+	if rr.wroteHeader {
+		return
+	}
+	rr.code = code
+	rr.wroteHeader = true
+}
+
+func (rr *responseRecorder) Write(bs []byte) (int, error) {
+	if !rr.wroteHeader {
+		rr.WriteHeader(StatusOK)
+	}
+	return rr.body.Write(bs)
+}
+
+func (rr *responseRecorder) result() *recordedResponse {
+	code := rr.code
+	if !rr.wroteHeader {
+		code = StatusOK
+	}
+	return &recordedResponse{
+		Status: code,
+		Header: rr.header.Clone(),
+		Body:   append([]byte{}, rr.body.Bytes()...),
+	}
+}
+
+// A complete response: status, headers and body
+type recordedResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// Writes the response to w. Headers already on w are kept unless
+// the recorded response sets them too.
+func (rec *recordedResponse) replay(w http.ResponseWriter) {
+	hd := w.Header()
+	for k, vs := range rec.Header {
+		hd[k] = append([]string{}, vs...)
+	}
+	w.WriteHeader(rec.Status)
+	if len(rec.Body) == 0 {
+		return
+	}
+	if _, err := w.Write(rec.Body); err != nil {
+		log.Println(wrapErr(err))
+	}
+}
+
+// Runs h with the ResponseWriter of rc swapped for a recorder and
+// returns the response h produced, including the encoding of the
+// message it returned.
+func captureResponse(rc *RequestCtx, rd *RequestData, h Handler) *recordedResponse {
+	orig := rc.ResponseWriter
+	rec := newResponseRecorder()
+	rc.ResponseWriter = NewResponseWriter(rec)
+	defer func() {
+		rc.ResponseWriter = orig
+	}()
+
+	resp, err := h(rc, rd)
+	writeResponse(rc, resp, err)
+	return rec.result()
+}
@@ -0,0 +1,130 @@
+package prate
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+type ReflectionOptions struct {
+	// Defaults to "/reflection"
+	Path string
+	// Middlewares the reflection endpoint skips
+	ExcludeMiddlewares []string
+}
+
+// Messages an endpoint exchanges, by full name
+type RouteMessages struct {
+	Request  string `json:"request,omitempty"`
+	Response string `json:"response,omitempty"`
+}
+
+type reflectionReport struct {
+	// Keyed by method and path, such as "POST /users"
+	Routes map[string]RouteMessages `json:"routes"`
+	Files  json.RawMessage          `json:"files"`
+}
+
+// Registers a GET endpoint describing the messages of every endpoint
+// with a RequestPayloadType or ResponsePayloadType. It answers with
+// a google.protobuf.FileDescriptorSet holding the files declaring
+// those messages and everything they import, dependencies first.
+// Clients accepting application/json get a JSON object instead with
+// the set under "files" and a map from "METHOD /path" to the names of
+// the messages under "routes".
+func (app *App) Reflection(opts ReflectionOptions) error {
+	if app == nil || app.router == nil {
+		return wrapErr(fmt.Errorf("app not initialized"))
+	}
+	if opts.Path == "" {
+		opts.Path = "/reflection"
+	}
+	opts.Path = "/" + strings.Trim(opts.Path, "/")
+
+	// Endpoints are all registered by the time it's first requested
+	var (
+		once   sync.Once
+		fds    *descriptorpb.FileDescriptorSet
+		routes map[string]RouteMessages
+	)
+	app.GET(NewEndpointConfig(opts.Path, func(rc *RequestCtx, _ *RequestData) (protoreflect.ProtoMessage, error) {
+		once.Do(func() {
+			fds, routes = app.describe()
+		})
+		if !strings.Contains(rc.Request.Header.Get(HeaderAccept), ContentTypeJSON.String()) {
+			return fds, nil
+		}
+
+		files, err := protojson.Marshal(fds)
+		if err != nil {
+			return nil, wrapErr(err)
+		}
+		bs, err := json.Marshal(reflectionReport{Routes: routes, Files: files})
+		if err != nil {
+			return nil, wrapErr(err)
+		}
+		rc.ResponseWriter.Header().Set(HeaderContentType, ContentTypeJSON.String())
+		rc.ResponseWriter.WriteHeader(StatusOK)
+		if _, err := rc.ResponseWriter.Write(bs); err != nil {
+			return nil, wrapErr(err)
+		}
+		return nil, nil
+	}).WithResponsePayloadType(&descriptorpb.FileDescriptorSet{}).WithExclude(opts.ExcludeMiddlewares...))
+	return nil
+}
+
+func (app *App) describe() (*descriptorpb.FileDescriptorSet, map[string]RouteMessages) {
+	fds := &descriptorpb.FileDescriptorSet{}
+	routes := map[string]RouteMessages{}
+	seen := map[string]bool{}
+
+	// Depth first so every file follows its imports
+	var addFile func(fd protoreflect.FileDescriptor)
+	addFile = func(fd protoreflect.FileDescriptor) {
+		if seen[fd.Path()] {
+			return
+		}
+		seen[fd.Path()] = true
+		imports := fd.Imports()
+		for i := 0; i < imports.Len(); i++ {
+			addFile(imports.Get(i).FileDescriptor)
+		}
+		fds.File = append(fds.File, protodesc.ToFileDescriptorProto(fd))
+	}
+	name := func(m protoreflect.ProtoMessage) string {
+		if m == nil {
+			return ""
+		}
+		md := m.ProtoReflect().Descriptor()
+		addFile(md.ParentFile())
+		return string(md.FullName())
+	}
+
+	// Sorted so the set doesn't depend on registration order
+	ecs := make([]EndpointConfig, 0, len(app.epCache))
+	for _, v := range app.epCache {
+		if v.ec.RequestPayloadType != nil || v.ec.ResponsePayloadType != nil {
+			ecs = append(ecs, v.ec)
+		}
+	}
+	sort.Slice(ecs, func(i, j int) bool {
+		if ecs[i].Path != ecs[j].Path {
+			return ecs[i].Path < ecs[j].Path
+		}
+		return ecs[i].method < ecs[j].method
+	})
+	for _, ec := range ecs {
+		routes[ec.method+" "+ec.Path] = RouteMessages{
+			Request:  name(ec.RequestPayloadType),
+			Response: name(ec.ResponsePayloadType),
+		}
+	}
+	return fds, routes
+}
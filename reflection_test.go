@@ -0,0 +1,92 @@
+package prate
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/daimaou92/prate/pb/fortest"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestReflection(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Reflection(ReflectionOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	app.POST(NewEndpointConfig("/echo", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		return &fortest.TestRes{}, nil
+	}).WithRequestPayloadType(&fortest.TestReq{}).WithResponsePayloadType(&fortest.TestRes{}))
+	app.GET(NewEndpointConfig("/plain", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		return nil, nil
+	}))
+	if err := app.Resource("/fields", ResourceConfig{
+		Message:     &descriptorpb.FieldDescriptorProto{},
+		ListMessage: &descriptorpb.DescriptorProto{},
+		IDField:     "name",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	app.mountEndpoints()
+
+	w := testServe(app, httptest.NewRequest(http.MethodGet, "/reflection", nil))
+	if w.Code != StatusOK {
+		t.Fatalf("wanted: %d. got: %d", StatusOK, w.Code)
+	}
+	var fds descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(w.Body.Bytes(), &fds); err != nil {
+		t.Fatal(err)
+	}
+	files, err := protodesc.NewFiles(&fds)
+	if err != nil {
+		t.Fatalf("set doesn't resolve: %v", err)
+	}
+	for _, name := range []string{"fortest.TestReq", "fortest.TestRes", "google.protobuf.FieldDescriptorProto", "google.protobuf.FileDescriptorSet"} {
+		if _, err := files.FindDescriptorByName(protoreflect.FullName(name)); err != nil {
+			t.Fatalf("%s missing: %v", name, err)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/reflection", nil)
+	r.Header.Set(HeaderAccept, ContentTypeJSON.String())
+	w = testServe(app, r)
+	if w.Header().Get(HeaderContentType) != ContentTypeJSON.String() {
+		t.Fatalf("unexpected content type %q", w.Header().Get(HeaderContentType))
+	}
+	var report reflectionReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]RouteMessages{
+		"POST /echo":         {Request: "fortest.TestReq", Response: "fortest.TestRes"},
+		"GET /fields":        {Response: "google.protobuf.DescriptorProto"},
+		"PATCH /fields/:id":  {Request: "google.protobuf.FieldDescriptorProto", Response: "google.protobuf.FieldDescriptorProto"},
+		"GET /reflection":    {Response: "google.protobuf.FileDescriptorSet"},
+		"DELETE /fields/:id": {},
+		"GET /plain":         {},
+	}
+	for route, msgs := range want {
+		got, ok := report.Routes[route]
+		if msgs == (RouteMessages{}) {
+			if ok {
+				t.Fatalf("%s listed without messages", route)
+			}
+			continue
+		}
+		if got != msgs {
+			t.Fatalf("%s wanted: %+v. got: %+v", route, msgs, got)
+		}
+	}
+	var jfds descriptorpb.FileDescriptorSet
+	if err := protojson.Unmarshal(report.Files, &jfds); err != nil || len(jfds.File) != len(fds.File) {
+		t.Fatalf("unexpected json files %d %v", len(jfds.File), err)
+	}
+}
@@ -0,0 +1,464 @@
+package prate
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daimaou92/prate/filter"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// A page of a listing requested from a Store
+type ListRequest struct {
+	Offset int64
+	Limit  int32
+	// Never nil. Matches everything when the request had no filter.
+	Filter  *filter.Filter
+	OrderBy filter.OrderBy
+}
+
+// Storage behind a Resource. Implementations report missing
+// messages with ErrNotFound, existing ones on Create with ErrConflict
+// and stale etags with ErrPreconditionFailed, wrapped or not.
+type Store interface {
+	Get(ctx context.Context, id string) (proto.Message, error)
+	// Returns the page of matching messages and how many match in
+	// total, or -1 if that's unknown
+	List(ctx context.Context, lr ListRequest) ([]proto.Message, int64, error)
+	Create(ctx context.Context, id string, m proto.Message) error
+	// Update and Delete only go ahead while the ProtoETag of the
+	// stored message is etag, atomically. An empty etag matches any.
+	Update(ctx context.Context, id string, m proto.Message, etag string) error
+	Delete(ctx context.Context, id string, etag string) error
+}
+
+// In-memory Store keeping copies of the messages it's handed
+type MemoryStore struct {
+	mu    sync.RWMutex
+	items map[string]proto.Message
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		items: map[string]proto.Message{},
+	}
+}
+
+func (s *MemoryStore) Get(_ context.Context, id string) (proto.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.items[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return proto.Clone(m), nil
+}
+
+// Orders by id unless the request has an OrderBy
+func (s *MemoryStore) List(_ context.Context, lr ListRequest) ([]proto.Message, int64, error) {
+	s.mu.RLock()
+	ids := make([]string, 0, len(s.items))
+	for id, m := range s.items {
+		if lr.Filter.Match(m) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	ms := make([]proto.Message, len(ids))
+	for i, id := range ids {
+		ms[i] = proto.Clone(s.items[id])
+	}
+	s.mu.RUnlock()
+
+	if len(lr.OrderBy) > 0 {
+		sort.SliceStable(ms, func(i, j int) bool { return lr.OrderBy.Compare(ms[i], ms[j]) < 0 })
+	}
+	total := int64(len(ms))
+	if lr.Offset >= total {
+		return nil, total, nil
+	}
+	ms = ms[lr.Offset:]
+	if lr.Limit > 0 && int64(len(ms)) > int64(lr.Limit) {
+		ms = ms[:lr.Limit]
+	}
+	return ms, total, nil
+}
+
+func (s *MemoryStore) Create(_ context.Context, id string, m proto.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.items[id]; ok {
+		return ErrConflict
+	}
+	s.items[id] = proto.Clone(m)
+	return nil
+}
+
+// Must be called with the lock held
+func (s *MemoryStore) check(id, etag string) error {
+	m, ok := s.items[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if etag == "" {
+		return nil
+	}
+	current, err := ProtoETag(m)
+	if err != nil {
+		return wrapErr(err)
+	}
+	if current != etag {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+func (s *MemoryStore) Update(_ context.Context, id string, m proto.Message, etag string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.check(id, etag); err != nil {
+		return err
+	}
+	s.items[id] = proto.Clone(m)
+	return nil
+}
+
+func (s *MemoryStore) Delete(_ context.Context, id string, etag string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.check(id, etag); err != nil {
+		return err
+	}
+	delete(s.items, id)
+	return nil
+}
+
+type ResourceConfig struct {
+	// The message the resource stores
+	Message proto.Message
+	// Response of List. Items go into its first repeated field of the
+	// Message type. Fields named total_size and next_page_token are
+	// set when present, the latter to an opaque token accepted back
+	// as a page_token query parameter.
+	ListMessage proto.Message
+	// Defaults to a MemoryStore
+	Store Store
+	// String field of Message holding the id. Defaults to "id".
+	// Generated by Create when empty.
+	IDField string
+	// Defaults to offset pagination. Cursor pagination needs a List
+	// of its own, as Store.List only pages by offset.
+	Pagination PaginationOptions
+	// Replace the standard method of the same name
+	Create, Get, List, Update, Delete Handler
+	// Called with every endpoint before it is registered, to add
+	// policies, rate limits and the like. method is the HTTP method.
+	Configure func(method string, ec EndpointConfig) EndpointConfig
+}
+
+type resource struct {
+	ResourceConfig
+	path      string
+	idField   protoreflect.FieldDescriptor
+	listField protoreflect.FieldDescriptor
+}
+
+// Registers the standard methods over a collection of messages:
+//
+//	POST   path      Create, 201 with a Location header
+//	GET    path/:id  Get
+//	GET    path      List, paginated, with filter and order_by
+//	PATCH  path/:id  Update, honouring an update_mask query parameter
+//	                 and JSON merge or JSON patch bodies
+//	DELETE path/:id  Delete, 204
+//
+// Without an update_mask a protobuf body updates the fields it
+// populates. Get, Create and Update set an ETag and Update and Delete
+// check If-Match against the stored message. Get and List trim
+// responses to a fields query parameter. Store errors matching
+// ErrNotFound, ErrConflict and ErrPreconditionFailed become 404, 409
+// and 412 responses.
+func (app *App) Resource(path string, rc ResourceConfig) error {
+	if app == nil || app.router == nil {
+		return wrapErr(fmt.Errorf("app not initialized"))
+	}
+	if rc.Message == nil {
+		return wrapErr(fmt.Errorf("resource %s without a Message", path))
+	}
+	if rc.Store == nil {
+		rc.Store = NewMemoryStore()
+	}
+	if rc.IDField == "" {
+		rc.IDField = "id"
+	}
+	md := rc.Message.ProtoReflect().Descriptor()
+	res := &resource{
+		ResourceConfig: rc,
+		path:           "/" + strings.Trim(path, "/"),
+		idField:        md.Fields().ByName(protoreflect.Name(rc.IDField)),
+	}
+	if res.idField == nil || res.idField.Kind() != protoreflect.StringKind || res.idField.IsList() {
+		return wrapErr(fmt.Errorf("%s has no string field %s", md.FullName(), rc.IDField))
+	}
+	if rc.List == nil {
+		if rc.Pagination.Mode == PaginationCursor {
+			return wrapErr(fmt.Errorf("resource %s with cursor pagination needs a List", path))
+		}
+		if rc.ListMessage == nil {
+			return wrapErr(fmt.Errorf("resource %s without a ListMessage", path))
+		}
+		fields := rc.ListMessage.ProtoReflect().Descriptor().Fields()
+		for i := 0; i < fields.Len(); i++ {
+			fd := fields.Get(i)
+			if fd.IsList() && fd.Message() != nil && fd.Message().FullName() == md.FullName() {
+				res.listField = fd
+				break
+			}
+		}
+		if res.listField == nil {
+			return wrapErr(fmt.Errorf("%s has no repeated %s field",
+				rc.ListMessage.ProtoReflect().Descriptor().FullName(), md.FullName()))
+		}
+	}
+
+	pick := func(custom, standard Handler) Handler {
+		if custom != nil {
+			return custom
+		}
+		return standard
+	}
+	configure := func(method string, ec EndpointConfig) EndpointConfig {
+		if rc.Configure != nil {
+			return rc.Configure(method, ec)
+		}
+		return ec
+	}
+	item := res.path + "/:id"
+
+	app.POST(configure("POST", NewEndpointConfig(res.path, pick(rc.Create, res.create)).
+		WithRequestPayloadType(rc.Message).
+		WithResponsePayloadType(rc.Message)))
+	app.GET(configure("GET", NewEndpointConfig(item, pick(rc.Get, res.get)).
+		WithResponsePayloadType(rc.Message)))
+	app.GET(configure("GET", NewEndpointConfig(res.path, pick(rc.List, res.list)).
+		WithResponsePayloadType(rc.ListMessage).
+		WithPagination(rc.Pagination)))
+	app.PATCH(configure("PATCH", NewEndpointConfig(item, pick(rc.Update, res.update)).
+		WithRequestPayloadType(rc.Message).
+		WithResponsePayloadType(rc.Message).
+		WithPatchLoader(func(rctx *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+			return res.load(rctx, rd.Params.ByName("id"))
+		})))
+	app.DELETE(configure("DELETE", NewEndpointConfig(item, pick(rc.Delete, res.delete))))
+	return nil
+}
+
+// Maps Store errors onto responses
+func storeErr(err error) error {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return ErrNotFound
+	case errors.Is(err, ErrConflict):
+		return ErrConflict
+	case errors.Is(err, ErrPreconditionFailed):
+		return ErrPreconditionFailed
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return wrapErr(err)
+}
+
+func (res *resource) load(rc *RequestCtx, id string) (proto.Message, error) {
+	m, err := res.Store.Get(rc.Context(), id)
+	if err != nil {
+		return nil, storeErr(err)
+	}
+	return m, nil
+}
+
+// Sets the ETag of m and trims it to the requested fields
+func (res *resource) respond(rc *RequestCtx, m proto.Message) (protoreflect.ProtoMessage, error) {
+	etag, err := ProtoETag(m)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	rc.SetETag(etag)
+	if paths, ok := requestedFields(rc); ok {
+		return TrimToPaths(m, paths)
+	}
+	return m, nil
+}
+
+func newResourceID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", wrapErr(err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (res *resource) create(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+	m := proto.Clone(rd.Body)
+	mr := m.ProtoReflect()
+	id := mr.Get(res.idField).String()
+	if id == "" {
+		var err error
+		if id, err = newResourceID(); err != nil {
+			return nil, err
+		}
+		mr.Set(res.idField, protoreflect.ValueOfString(id))
+	}
+	if err := res.Store.Create(rc.Context(), id, m); err != nil {
+		return nil, storeErr(err)
+	}
+	rc.ResponseWriter.Header().Set(HeaderLocation, res.path+"/"+id)
+	rc.SetStatus(StatusCreated)
+	return res.respond(rc, m)
+}
+
+func (res *resource) get(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+	m, err := res.load(rc, rd.Params.ByName("id"))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := res.respond(rc, m)
+	if err != nil {
+		return nil, err
+	}
+	if notModified(rc.Request, rc.ResponseWriter.Header()) {
+		rc.ResponseWriter.WriteHeader(StatusNotModified)
+		return nil, nil
+	}
+	return resp, nil
+}
+
+func (res *resource) list(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+	f, ob, err := rc.ListQuery(res.Message)
+	if err != nil {
+		return nil, err
+	}
+	pr := rc.PageRequest()
+	items, total, err := res.Store.List(rc.Context(), ListRequest{
+		Offset:  pr.Offset,
+		Limit:   pr.Size,
+		Filter:  f,
+		OrderBy: ob,
+	})
+	if err != nil {
+		return nil, storeErr(err)
+	}
+	rc.SetPageResult(PageResult{Count: len(items), Total: total})
+
+	resp := proto.Clone(res.ListMessage)
+	proto.Reset(resp)
+	rm := resp.ProtoReflect()
+	l := rm.Mutable(res.listField).List()
+	for _, it := range items {
+		l.Append(protoreflect.ValueOfMessage(it.ProtoReflect()))
+	}
+	fields := rm.Descriptor().Fields()
+	if fd := fields.ByName("total_size"); fd != nil && total >= 0 {
+		switch fd.Kind() {
+		case protoreflect.Int32Kind:
+			rm.Set(fd, protoreflect.ValueOfInt32(int32(total)))
+		case protoreflect.Int64Kind:
+			rm.Set(fd, protoreflect.ValueOfInt64(total))
+		}
+	}
+	if fd := fields.ByName("next_page_token"); fd != nil && fd.Kind() == protoreflect.StringKind &&
+		pr.Offset+int64(len(items)) < total {
+		rm.Set(fd, protoreflect.ValueOfString(pr.NextPageToken))
+	}
+	if paths, ok := requestedFields(rc); ok {
+		return TrimToPaths(resp, paths)
+	}
+	return resp, nil
+}
+
+func (res *resource) update(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+	id := rd.Params.ByName("id")
+	// A patch document has already been applied to rd.Body by
+	// applyPatching, over the message it loaded
+	current := rd.patchBase
+	if current == nil {
+		var err error
+		if current, err = res.load(rc, id); err != nil {
+			return nil, err
+		}
+	}
+	etag, err := ProtoETag(current)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	if err := rc.CheckPreconditions(quoteETag(etag), time.Time{}); err != nil {
+		return nil, err
+	}
+
+	switch um := rc.Request.URL.Query().Get("update_mask"); {
+	case rd.patch != nil:
+		if rd.patchBase == nil {
+			if err := applyPatch(rd.Body, current, rd.patch, rd.patchType); err != nil {
+				return nil, err
+			}
+		}
+		proto.Reset(current)
+		proto.Merge(current, rd.Body)
+	case um != "":
+		mask := &fieldmaskpb.FieldMask{Paths: strings.Split(um, ",")}
+		if err := ApplyFieldMask(current, rd.Body, mask); err != nil {
+			return nil, err
+		}
+	default:
+		// The populated fields, as an empty mask would replace
+		// the whole message
+		var paths []string
+		rd.Body.ProtoReflect().Range(func(fd protoreflect.FieldDescriptor, _ protoreflect.Value) bool {
+			paths = append(paths, string(fd.Name()))
+			return true
+		})
+		if len(paths) > 0 {
+			if err := ApplyFieldMask(current, rd.Body, &fieldmaskpb.FieldMask{Paths: paths}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// The id comes from the path
+	current.ProtoReflect().Set(res.idField, protoreflect.ValueOfString(id))
+	if err := res.Store.Update(rc.Context(), id, current, etag); err != nil {
+		return nil, storeErr(err)
+	}
+	return res.respond(rc, current)
+}
+
+func (res *resource) delete(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+	id := rd.Params.ByName("id")
+	var etag string
+	if rc.Request.Header.Get(HeaderIfMatch) != "" {
+		current, err := res.load(rc, id)
+		if err != nil {
+			return nil, err
+		}
+		if etag, err = ProtoETag(current); err != nil {
+			return nil, wrapErr(err)
+		}
+		if err := rc.CheckPreconditions(quoteETag(etag), time.Time{}); err != nil {
+			return nil, err
+		}
+	}
+	if err := res.Store.Delete(rc.Context(), id, etag); err != nil {
+		return nil, storeErr(err)
+	}
+	rc.SetStatus(StatusNoContent)
+	return nil, nil
+}
@@ -0,0 +1,192 @@
+package prate
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+type countingStore struct {
+	Store
+	gets int
+}
+
+func (s *countingStore) Get(ctx context.Context, id string) (proto.Message, error) {
+	s.gets++
+	return s.Store.Get(ctx, id)
+}
+
+func TestResource(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &countingStore{Store: NewMemoryStore()}
+	if err := app.Resource("/fields", ResourceConfig{
+		Message:     &descriptorpb.FieldDescriptorProto{},
+		ListMessage: &descriptorpb.DescriptorProto{},
+		IDField:     "name",
+		Store:       store,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	app.mountEndpoints()
+
+	create := func(f *descriptorpb.FieldDescriptorProto) *httptest.ResponseRecorder {
+		bs, _ := proto.Marshal(f)
+		return testServe(app, httptest.NewRequest(http.MethodPost, "/fields", strings.NewReader(string(bs))))
+	}
+	for i, name := range []string{"b", "a", "c"} {
+		w := create(&descriptorpb.FieldDescriptorProto{Name: proto.String(name), Number: proto.Int32(int32(i + 1))})
+		if w.Code != StatusCreated {
+			t.Fatalf("create %s wanted: %d. got: %d %s", name, StatusCreated, w.Code, w.Body.String())
+		}
+		if loc := w.Header().Get(HeaderLocation); loc != "/fields/"+name {
+			t.Fatalf("unexpected location %q", loc)
+		}
+	}
+	if w := create(&descriptorpb.FieldDescriptorProto{Name: proto.String("a")}); w.Code != StatusConflict {
+		t.Fatalf("duplicate wanted: %d. got: %d", StatusConflict, w.Code)
+	}
+	w := create(&descriptorpb.FieldDescriptorProto{Number: proto.Int32(9)})
+	if w.Code != StatusCreated || !strings.HasPrefix(w.Header().Get(HeaderLocation), "/fields/") {
+		t.Fatalf("generated id: %d %q", w.Code, w.Header().Get(HeaderLocation))
+	}
+	generated := strings.TrimPrefix(w.Header().Get(HeaderLocation), "/fields/")
+
+	// Get, conditional get and trimming
+	w = testServe(app, httptest.NewRequest(http.MethodGet, "/fields/a?fields=number", nil))
+	var f descriptorpb.FieldDescriptorProto
+	if w.Code != StatusOK {
+		t.Fatalf("get wanted: %d. got: %d", StatusOK, w.Code)
+	}
+	if err := proto.Unmarshal(w.Body.Bytes(), &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Name != nil || f.GetNumber() != 2 {
+		t.Fatalf("unexpected trimmed field %v", &f)
+	}
+	etag := w.Header().Get(HeaderETag)
+	r := httptest.NewRequest(http.MethodGet, "/fields/a", nil)
+	r.Header.Set(HeaderIfNoneMatch, etag)
+	if w := testServe(app, r); w.Code != StatusNotModified {
+		t.Fatalf("conditional get wanted: %d. got: %d", StatusNotModified, w.Code)
+	}
+	if w := testServe(app, httptest.NewRequest(http.MethodGet, "/fields/nope", nil)); w.Code != StatusNotFound {
+		t.Fatalf("missing wanted: %d. got: %d", StatusNotFound, w.Code)
+	}
+
+	// List with filter, ordering and pagination
+	w = testServe(app, httptest.NewRequest(http.MethodGet,
+		`/fields?filter=number<5&order_by=number%20desc&size=2`, nil))
+	if w.Code != StatusOK {
+		t.Fatalf("list wanted: %d. got: %d %s", StatusOK, w.Code, w.Body.String())
+	}
+	var list descriptorpb.DescriptorProto
+	if err := proto.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Field) != 2 || list.Field[0].GetName() != "c" || list.Field[1].GetName() != "a" {
+		t.Fatalf("unexpected page %v", list.Field)
+	}
+	if w.Header().Get(HeaderXTotalCount) != "3" {
+		t.Fatalf("unexpected total %q", w.Header().Get(HeaderXTotalCount))
+	}
+	if w := testServe(app, httptest.NewRequest(http.MethodGet, "/fields?filter=nope=1", nil)); w.Code != StatusBadRequest {
+		t.Fatalf("bad filter wanted: %d. got: %d", StatusBadRequest, w.Code)
+	}
+
+	// Update with a mask, a stale precondition and a merge patch
+	bs, _ := proto.Marshal(&descriptorpb.FieldDescriptorProto{Number: proto.Int32(7), JsonName: proto.String("x")})
+	r = httptest.NewRequest(http.MethodPatch, "/fields/a?update_mask=number", strings.NewReader(string(bs)))
+	r.Header.Set(HeaderIfMatch, etag)
+	if w := testServe(app, r); w.Code != StatusOK {
+		t.Fatalf("update wanted: %d. got: %d %s", StatusOK, w.Code, w.Body.String())
+	}
+	r = httptest.NewRequest(http.MethodPatch, "/fields/a?update_mask=number", strings.NewReader(string(bs)))
+	r.Header.Set(HeaderIfMatch, etag)
+	if w := testServe(app, r); w.Code != StatusPreconditionFailed {
+		t.Fatalf("stale update wanted: %d. got: %d", StatusPreconditionFailed, w.Code)
+	}
+	r = httptest.NewRequest(http.MethodPatch, "/fields/a", strings.NewReader(`{"typeName":"T"}`))
+	r.Header.Set(HeaderContentType, ContentTypeMergePatch.String())
+	gets := store.gets
+	w = testServe(app, r)
+	if w.Code != StatusOK {
+		t.Fatalf("merge patch wanted: %d. got: %d %s", StatusOK, w.Code, w.Body.String())
+	}
+	if n := store.gets - gets; n != 1 {
+		t.Fatalf("merge patch loaded the resource %d times", n)
+	}
+	f.Reset()
+	if err := proto.Unmarshal(w.Body.Bytes(), &f); err != nil {
+		t.Fatal(err)
+	}
+	want := &descriptorpb.FieldDescriptorProto{Name: proto.String("a"), Number: proto.Int32(7), TypeName: proto.String("T")}
+	if !proto.Equal(&f, want) {
+		t.Fatalf("wanted: %v. got: %v", want, &f)
+	}
+
+	// Without a mask only the populated fields change
+	bs, _ = proto.Marshal(&descriptorpb.FieldDescriptorProto{JsonName: proto.String("y")})
+	w = testServe(app, httptest.NewRequest(http.MethodPatch, "/fields/a", strings.NewReader(string(bs))))
+	f.Reset()
+	if err := proto.Unmarshal(w.Body.Bytes(), &f); err != nil {
+		t.Fatal(err)
+	}
+	want.JsonName = proto.String("y")
+	if w.Code != StatusOK || !proto.Equal(&f, want) {
+		t.Fatalf("maskless update wanted: %v. got: %d %v", want, w.Code, &f)
+	}
+
+	// Delete
+	for _, tst := range []struct {
+		id   string
+		code int
+	}{{generated, StatusNoContent}, {generated, StatusNotFound}} {
+		if w := testServe(app, httptest.NewRequest(http.MethodDelete, "/fields/"+tst.id, nil)); w.Code != tst.code {
+			t.Fatalf("delete wanted: %d. got: %d", tst.code, w.Code)
+		}
+	}
+}
+
+func TestMemoryStoreConditional(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	m := &descriptorpb.FieldDescriptorProto{Name: proto.String("a")}
+	if err := s.Create(ctx, "a", m); err != nil {
+		t.Fatal(err)
+	}
+	etag, _ := ProtoETag(m)
+	if err := s.Update(ctx, "a", &descriptorpb.FieldDescriptorProto{Number: proto.Int32(1)}, etag); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update(ctx, "a", m, etag); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("stale update wanted: %v. got: %v", ErrPreconditionFailed, err)
+	}
+	if err := s.Delete(ctx, "a", etag); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("stale delete wanted: %v. got: %v", ErrPreconditionFailed, err)
+	}
+	if err := s.Delete(ctx, "a", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Resource("/fields", ResourceConfig{
+		Message:     &descriptorpb.FieldDescriptorProto{},
+		ListMessage: &descriptorpb.DescriptorProto{},
+		IDField:     "name",
+		Pagination:  PaginationOptions{Mode: PaginationCursor},
+	}); err == nil {
+		t.Fatal("cursor pagination accepted without a List")
+	}
+}
@@ -0,0 +1,421 @@
+package prate
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// gRPC status codes, also used by Connect and Twirp
+type rpcCode int
+
+const (
+	codeOK rpcCode = iota
+	codeCanceled
+	codeUnknown
+	codeInvalidArgument
+	codeDeadlineExceeded
+	codeNotFound
+	codeAlreadyExists
+	codePermissionDenied
+	codeResourceExhausted
+	codeFailedPrecondition
+	codeAborted
+	codeOutOfRange
+	codeUnimplemented
+	codeInternal
+	codeUnavailable
+	codeDataLoss
+	codeUnauthenticated
+)
+
+var rpcCodeNames = [...]string{
+	"ok", "canceled", "unknown", "invalid_argument", "deadline_exceeded",
+	"not_found", "already_exists", "permission_denied", "resource_exhausted",
+	"failed_precondition", "aborted", "out_of_range", "unimplemented",
+	"internal", "unavailable", "data_loss", "unauthenticated",
+}
+
+func (c rpcCode) String() string {
+	if int(c) < len(rpcCodeNames) {
+		return rpcCodeNames[c]
+	}
+	return "unknown"
+}
+
+// The code of an error response with the given HTTP status
+func rpcCodeOf(status int) rpcCode {
+	switch status {
+	case StatusBadRequest, StatusUnprocessableEntity, StatusUnsupportedMediaType:
+		return codeInvalidArgument
+	case StatusUnauthorized:
+		return codeUnauthenticated
+	case StatusForbidden:
+		return codePermissionDenied
+	case StatusNotFound:
+		return codeNotFound
+	case StatusMethodNotAllowed, StatusNotImplemented:
+		return codeUnimplemented
+	case StatusRequestTimeout, StatusGatewayTimeout:
+		return codeDeadlineExceeded
+	case StatusConflict:
+		return codeAlreadyExists
+	case StatusPreconditionFailed:
+		return codeFailedPrecondition
+	case StatusRequestEntityTooLarge, StatusTooManyRequests:
+		return codeResourceExhausted
+	case StatusRequestedRangeNotSatisfiable:
+		return codeOutOfRange
+	case 499:
+		return codeCanceled
+	case StatusBadGateway, StatusServiceUnavailable:
+		return codeUnavailable
+	}
+	if status >= 500 {
+		return codeInternal
+	}
+	return codeUnknown
+}
+
+// HTTP status of a Connect error, from the Connect protocol spec
+var connectStatus = [...]int{
+	StatusOK, 499, StatusInternalServerError, StatusBadRequest, StatusGatewayTimeout,
+	StatusNotFound, StatusConflict, StatusForbidden, StatusTooManyRequests,
+	StatusBadRequest, StatusConflict, StatusBadRequest, StatusNotImplemented,
+	StatusInternalServerError, StatusServiceUnavailable, StatusInternalServerError,
+	StatusUnauthorized,
+}
+
+type rpcProtocol int
+
+const (
+	rpcConnect rpcProtocol = iota + 1
+	rpcGRPCWeb
+	rpcTwirp
+)
+
+// An RPC style request being served by a REST endpoint
+type rpcCall struct {
+	protocol rpcProtocol
+	// Connect with JSON bodies
+	json bool
+	// gRPC-Web with base64 bodies
+	text        bool
+	contentType string
+	timeout     time.Duration
+	// Encodes JSON responses
+	marshal protojson.MarshalOptions
+
+	// Set by writeResponse, possibly from an abandoned handler
+	mu   sync.Mutex
+	resp protoreflect.ProtoMessage
+}
+
+type rpcCallKey struct{}
+
+func rpcCallFrom(r *http.Request) *rpcCall {
+	if r == nil {
+		return nil
+	}
+	call, _ := r.Context().Value(rpcCallKey{}).(*rpcCall)
+	return call
+}
+
+func (call *rpcCall) setResponse(m protoreflect.ProtoMessage) {
+	call.mu.Lock()
+	defer call.mu.Unlock()
+	call.resp = m
+}
+
+func (call *rpcCall) response() protoreflect.ProtoMessage {
+	call.mu.Lock()
+	defer call.mu.Unlock()
+	return call.resp
+}
+
+// Recognizes Connect unary and gRPC-Web requests by their
+// content type. Returns nil for anything else.
+func detectRPC(r *http.Request) *rpcCall {
+	ct := mediaType(r)
+	switch ContentType(ct) {
+	case ContentTypeConnectProto:
+		return &rpcCall{protocol: rpcConnect, contentType: ct}
+	case ContentTypeJSON:
+		// Plain JSON is left to the endpoint
+		if r.Header.Get(HeaderConnectProtocolVersion) == "" {
+			return nil
+		}
+		return &rpcCall{protocol: rpcConnect, json: true, contentType: ct}
+	case ContentTypeGRPCWeb, ContentTypeGRPCWebProto:
+		return &rpcCall{protocol: rpcGRPCWeb, contentType: ContentTypeGRPCWebProto.String()}
+	case ContentTypeGRPCWebText, ContentTypeGRPCWebTextProto:
+		return &rpcCall{protocol: rpcGRPCWeb, text: true, contentType: ContentTypeGRPCWebTextProto.String()}
+	}
+	return nil
+}
+
+// Parses a gRPC timeout such as "250m" or "3S"
+func parseGRPCTimeout(v string) (time.Duration, bool) {
+	if len(v) < 2 || len(v) > 9 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	units := map[byte]time.Duration{
+		'H': time.Hour, 'M': time.Minute, 'S': time.Second,
+		'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond,
+	}
+	unit, ok := units[v[len(v)-1]]
+	if !ok {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// Serves Connect unary and gRPC-Web requests to POST endpoints,
+// and Twirp requests to the endpoints registered through App.Twirp.
+// The request is turned into a regular protobuf request for serve
+// and its response translated back, so middlewares, policies and
+// handlers need no changes.
+func (ep *endpoint) withRPC(serve httprouter.Handle) httprouter.Handle {
+	if ep.method != http.MethodPost {
+		return serve
+	}
+	if ep.config.twirp {
+		return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+			call := detectTwirp(r)
+			if call == nil {
+				writeTwirpError(w, "bad_route", StatusNotFound, "unsupported content type "+r.Header.Get(HeaderContentType))
+				return
+			}
+			ep.serveRPC(call, serve, w, r, params)
+		}
+	}
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		call := detectRPC(r)
+		if call == nil {
+			serve(w, r, params)
+			return
+		}
+		ep.serveRPC(call, serve, w, r, params)
+	}
+}
+
+func (ep *endpoint) serveRPC(call *rpcCall, serve httprouter.Handle, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		call.writeError(w, codeInvalidArgument, "connection error")
+		return
+	}
+	msg, err := call.decode(body, ep.requestPayload)
+	if err != nil {
+		e, ok := err.(*Error)
+		if !ok {
+			e = NewError(StatusInternalServerError)
+		}
+		if call.protocol == rpcTwirp && e.Code == StatusBadRequest {
+			writeTwirpError(w, "malformed", StatusBadRequest, e.Error())
+			return
+		}
+		call.writeError(w, rpcCodeOf(e.Code), e.Error())
+		return
+	}
+	switch call.protocol {
+	case rpcConnect:
+		call.timeout, _ = parseTimeoutHeader(r.Header.Get(HeaderConnectTimeoutMs))
+	case rpcGRPCWeb:
+		call.timeout, _ = parseGRPCTimeout(r.Header.Get(HeaderGRPCTimeout))
+	}
+
+	r = r.Clone(context.WithValue(r.Context(), rpcCallKey{}, call))
+	r.Body = io.NopCloser(bytes.NewReader(msg))
+	r.ContentLength = int64(len(msg))
+	r.Header.Set(HeaderContentType, ContentTypePROTO.String())
+	rec := newResponseRecorder()
+	serve(rec, r, params)
+	call.write(w, rec.result(), ep.config.ResponsePayloadType)
+}
+
+// Returns the protobuf encoding of the request message
+func (call *rpcCall) decode(body []byte, payload protoreflect.ProtoMessage) ([]byte, error) {
+	switch {
+	case call.json:
+		if payload == nil || len(bytes.TrimSpace(body)) == 0 {
+			return nil, nil
+		}
+		m := proto.Clone(payload)
+		proto.Reset(m)
+		if err := protojson.Unmarshal(body, m); err != nil {
+			return nil, NewError(StatusBadRequest, "invalid payload: "+err.Error())
+		}
+		bs, err := proto.Marshal(m)
+		if err != nil {
+			return nil, wrapErr(err)
+		}
+		return bs, nil
+	case call.protocol != rpcGRPCWeb:
+		return body, nil
+	}
+
+	if call.text {
+		bs, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(body)))
+		if err != nil {
+			return nil, NewError(StatusBadRequest, "invalid base64 body")
+		}
+		body = bs
+	}
+	if len(body) == 0 {
+		return nil, nil
+	}
+	if len(body) < 5 {
+		return nil, NewError(StatusBadRequest, "truncated frame")
+	}
+	if body[0]&1 != 0 {
+		return nil, NewError(StatusNotImplemented, "compressed messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(body[1:5])
+	if uint64(len(body)-5) < uint64(n) {
+		return nil, NewError(StatusBadRequest, "truncated frame")
+	}
+	return body[5 : 5+n], nil
+}
+
+// Translates the recorded REST response into the protocol of call
+func (call *rpcCall) write(w http.ResponseWriter, res *recordedResponse, responseType protoreflect.ProtoMessage) {
+	hd := w.Header()
+	for k, vs := range res.Header {
+		switch k {
+		case HeaderContentType, HeaderContentLength:
+			continue
+		}
+		hd[k] = append([]string{}, vs...)
+	}
+	if res.Status >= 400 {
+		msg := strings.TrimSpace(string(res.Body))
+		if msg == "" {
+			msg = http.StatusText(res.Status)
+		}
+		call.writeError(w, rpcCodeOf(res.Status), msg)
+		return
+	}
+
+	ct, _, _ := strings.Cut(res.Header.Get(HeaderContentType), ";")
+	body := res.Body
+	isProto := len(body) == 0 || ct == ContentTypePROTO.String()
+	switch {
+	case call.json && ct == ContentTypeJSON.String():
+	case call.json:
+		m := call.response()
+		if m == nil && len(body) > 0 && isProto && responseType != nil {
+			// Replayed from a cache, so decode it again
+			m = proto.Clone(responseType)
+			if err := proto.Unmarshal(body, m); err != nil {
+				m = nil
+			}
+		}
+		if m == nil && len(body) > 0 {
+			call.writeError(w, codeInternal, "response can't be encoded as JSON")
+			return
+		}
+		body = []byte("{}")
+		if m != nil {
+			bs, err := call.marshal.Marshal(m)
+			if err != nil {
+				call.writeError(w, codeInternal, err.Error())
+				return
+			}
+			body = bs
+		}
+	case !isProto:
+		call.writeError(w, codeInternal, "response isn't a protobuf message")
+		return
+	}
+
+	hd.Set(HeaderContentType, call.contentType)
+	if call.protocol != rpcGRPCWeb {
+		w.WriteHeader(StatusOK)
+		w.Write(body)
+		return
+	}
+	var buf bytes.Buffer
+	writeGRPCFrame(&buf, 0, body)
+	writeGRPCFrame(&buf, 0x80, grpcTrailers(codeOK, ""))
+	call.writeGRPCBody(w, buf.Bytes())
+}
+
+func (call *rpcCall) writeError(w http.ResponseWriter, code rpcCode, msg string) {
+	hd := w.Header()
+	switch call.protocol {
+	case rpcTwirp:
+		writeTwirpError(w, twirpCode(code), twirpStatus[code], msg)
+		return
+	case rpcConnect:
+		bs, _ := json.Marshal(struct {
+			Code    string `json:"code"`
+			Message string `json:"message,omitempty"`
+		}{code.String(), msg})
+		hd.Set(HeaderContentType, ContentTypeJSON.String())
+		w.WriteHeader(connectStatus[code])
+		w.Write(bs)
+		return
+	}
+	hd.Set(HeaderContentType, call.contentType)
+	var buf bytes.Buffer
+	writeGRPCFrame(&buf, 0x80, grpcTrailers(code, msg))
+	call.writeGRPCBody(w, buf.Bytes())
+}
+
+func (call *rpcCall) writeGRPCBody(w http.ResponseWriter, bs []byte) {
+	if call.text {
+		bs = []byte(base64.StdEncoding.EncodeToString(bs))
+	}
+	w.WriteHeader(StatusOK)
+	w.Write(bs)
+}
+
+func writeGRPCFrame(buf *bytes.Buffer, flags byte, bs []byte) {
+	var prefix [5]byte
+	prefix[0] = flags
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(bs)))
+	buf.Write(prefix[:])
+	buf.Write(bs)
+}
+
+// The trailer block of a gRPC-Web response
+func grpcTrailers(code rpcCode, msg string) []byte {
+	s := fmt.Sprintf("grpc-status: %d\r\n", code)
+	if msg != "" {
+		s += "grpc-message: " + grpcPercentEncode(msg) + "\r\n"
+	}
+	return []byte(s)
+}
+
+// Percent encodes a grpc-message value as the gRPC spec requires
+func grpcPercentEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
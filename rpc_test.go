@@ -0,0 +1,174 @@
+package prate
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daimaou92/prate/pb/fortest"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func rpcTestApp(t *testing.T) *App {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.POST(NewEndpointConfig("/echo", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		req := rd.Body.(*fortest.TestReq)
+		switch req.Key {
+		case "missing":
+			return nil, NewError(StatusNotFound, "no such key")
+		case "slow":
+			<-rc.Context().Done()
+			return nil, rc.Context().Err()
+		}
+		return &fortest.TestRes{Key: req.Key, Value: req.Value}, nil
+	}).WithRequestPayloadType(&fortest.TestReq{}))
+	app.mountEndpoints()
+	return app
+}
+
+func grpcWebFrame(flags byte, bs []byte) []byte {
+	frame := make([]byte, 5+len(bs))
+	frame[0] = flags
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(bs)))
+	copy(frame[5:], bs)
+	return frame
+}
+
+func TestConnect(t *testing.T) {
+	app := rpcTestApp(t)
+
+	bs, _ := proto.Marshal(&fortest.TestReq{Key: "a", Value: "proto"})
+	r := httptest.NewRequest(http.MethodPost, "/echo", bytes.NewReader(bs))
+	r.Header.Set(HeaderContentType, ContentTypeConnectProto.String())
+	w := testServe(app, r)
+	var res fortest.TestRes
+	if w.Code != StatusOK || w.Header().Get(HeaderContentType) != ContentTypeConnectProto.String() {
+		t.Fatalf("proto wanted: %d. got: %d %q", StatusOK, w.Code, w.Header().Get(HeaderContentType))
+	}
+	if err := proto.Unmarshal(w.Body.Bytes(), &res); err != nil || res.Value != "proto" {
+		t.Fatalf("unexpected response %v %v", &res, err)
+	}
+
+	// Empty messages are empty bodies
+	r = httptest.NewRequest(http.MethodPost, "/echo", nil)
+	r.Header.Set(HeaderContentType, ContentTypeConnectProto.String())
+	if w := testServe(app, r); w.Code != StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("empty wanted: %d. got: %d %q", StatusOK, w.Code, w.Body.String())
+	}
+
+	tests := []struct {
+		name, body, timeout string
+		code                int
+		want                string
+	}{
+		{"json", `{"key":"a","value":"json"}`, "", StatusOK, `{"key":"a","value":"json"}`},
+		{"not found", `{"key":"missing"}`, "", StatusNotFound, `{"code":"not_found","message":"no such key"}`},
+		{"invalid", `{"nope":1}`, "", StatusBadRequest, `"code":"invalid_argument"`},
+		{"timeout", `{"key":"slow"}`, "20", StatusGatewayTimeout, `"code":"deadline_exceeded"`},
+	}
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader(tst.body))
+			r.Header.Set(HeaderContentType, ContentTypeJSON.String())
+			r.Header.Set(HeaderConnectProtocolVersion, "1")
+			if tst.timeout != "" {
+				r.Header.Set(HeaderConnectTimeoutMs, tst.timeout)
+			}
+			w := testServe(app, r)
+			if w.Code != tst.code {
+				t.Fatalf("wanted: %d. got: %d %s", tst.code, w.Code, w.Body.String())
+			}
+			if w.Header().Get(HeaderContentType) != ContentTypeJSON.String() {
+				t.Fatalf("unexpected content type %q", w.Header().Get(HeaderContentType))
+			}
+			var got, want interface{}
+			json.Unmarshal(w.Body.Bytes(), &got)
+			if json.Unmarshal([]byte(tst.want), &want) == nil {
+				gs, _ := json.Marshal(got)
+				ws, _ := json.Marshal(want)
+				if !bytes.Equal(gs, ws) {
+					t.Fatalf("wanted: %s. got: %s", ws, gs)
+				}
+			} else if !strings.Contains(w.Body.String(), tst.want) {
+				t.Fatalf("wanted %s in: %s", tst.want, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestGRPCWeb(t *testing.T) {
+	app := rpcTestApp(t)
+
+	call := func(ct string, m *fortest.TestReq) (*fortest.TestRes, string) {
+		bs, _ := proto.Marshal(m)
+		body := grpcWebFrame(0, bs)
+		text := strings.HasPrefix(ct, ContentTypeGRPCWebText.String())
+		if text {
+			body = []byte(base64.StdEncoding.EncodeToString(body))
+		}
+		r := httptest.NewRequest(http.MethodPost, "/echo", bytes.NewReader(body))
+		r.Header.Set(HeaderContentType, ct)
+		w := testServe(app, r)
+		if w.Code != StatusOK {
+			t.Fatalf("%s wanted: %d. got: %d", ct, StatusOK, w.Code)
+		}
+		out := w.Body.Bytes()
+		if text {
+			out, _ = base64.StdEncoding.DecodeString(string(out))
+		}
+		var res *fortest.TestRes
+		var trailers string
+		for len(out) >= 5 {
+			n := binary.BigEndian.Uint32(out[1:5])
+			payload := out[5 : 5+n]
+			if out[0]&0x80 != 0 {
+				trailers = string(payload)
+			} else {
+				res = &fortest.TestRes{}
+				if err := proto.Unmarshal(payload, res); err != nil {
+					t.Fatal(err)
+				}
+			}
+			out = out[5+n:]
+		}
+		return res, trailers
+	}
+
+	res, trailers := call(ContentTypeGRPCWeb.String(), &fortest.TestReq{Key: "a", Value: "web"})
+	if res == nil || res.Value != "web" || trailers != "grpc-status: 0\r\n" {
+		t.Fatalf("unexpected response %v %q", res, trailers)
+	}
+	res, trailers = call(ContentTypeGRPCWebText.String(), &fortest.TestReq{Key: "a", Value: "text"})
+	if res == nil || res.Value != "text" {
+		t.Fatalf("unexpected text response %v %q", res, trailers)
+	}
+	res, trailers = call(ContentTypeGRPCWebProto.String(), &fortest.TestReq{Key: "missing"})
+	if res != nil || trailers != "grpc-status: 5\r\ngrpc-message: no such key\r\n" {
+		t.Fatalf("unexpected error response %v %q", res, trailers)
+	}
+
+	// REST clients are unaffected
+	bs, _ := proto.Marshal(&fortest.TestReq{Key: "a", Value: "rest"})
+	w := testServe(app, httptest.NewRequest(http.MethodPost, "/echo", bytes.NewReader(bs)))
+	var rest fortest.TestRes
+	if err := proto.Unmarshal(w.Body.Bytes(), &rest); err != nil || rest.Value != "rest" {
+		t.Fatalf("unexpected rest response %v %v", &rest, err)
+	}
+}
+
+func TestParseGRPCTimeout(t *testing.T) {
+	for v, ok := range map[string]bool{"1S": true, "250m": true, "2H": true, "S": false, "1x": false, "-1S": false, "123456789S": false} {
+		if _, got := parseGRPCTimeout(v); got != ok {
+			t.Fatalf("%q wanted: %v. got: %v", v, ok, got)
+		}
+	}
+}
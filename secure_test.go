@@ -0,0 +1,68 @@
+package prate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daimaou92/prate/pb/fortest"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func TestSecureHeaders(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nonce string
+	h := func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		nonce = rc.CSPNonce()
+		return &fortest.TestRes{}, nil
+	}
+	app.GET(NewEndpointConfig("/api", h))
+	app.GET(NewEndpointConfig("/docs/page", h))
+	app.GET(NewEndpointConfig("/embed", h).WithSecureHeaders(SecureHeadersConfig{
+		XFrameOptions: SecureHeaderDisabled,
+	}))
+	if err := app.Apply(SecureHeaders(SecureHeadersOptions{
+		Groups: map[string]SecureHeadersConfig{
+			"/docs": {
+				ContentSecurityPolicy: "script-src 'nonce-" + CSPNonce + "'",
+			},
+		},
+	})); err != nil {
+		t.Fatal(err)
+	}
+	app.mountEndpoints()
+
+	w := testServe(app, httptest.NewRequest(http.MethodGet, "/api", nil))
+	if v := w.Header().Get(HeaderXFrameOptions); v != "DENY" {
+		t.Fatalf("x-frame-options wanted: DENY. got: %s", v)
+	}
+	if v := w.Header().Get(HeaderContentSecurityPolicy); v != DefaultSecureHeaders.ContentSecurityPolicy {
+		t.Fatalf("csp wanted: %s. got: %s", DefaultSecureHeaders.ContentSecurityPolicy, v)
+	}
+	if _, ok := w.Header()[HeaderCrossOriginEmbedderPolicy]; ok {
+		t.Fatalf("disabled header was sent")
+	}
+	if nonce != "" {
+		t.Fatalf("nonce wanted empty. got: %s", nonce)
+	}
+
+	w = testServe(app, httptest.NewRequest(http.MethodGet, "/docs/page", nil))
+	if nonce == "" {
+		t.Fatalf("nonce not generated")
+	}
+	if v := w.Header().Get(HeaderContentSecurityPolicy); !strings.Contains(v, "'nonce-"+nonce+"'") {
+		t.Fatalf("csp does not contain nonce: %s", v)
+	}
+
+	w = testServe(app, httptest.NewRequest(http.MethodGet, "/embed", nil))
+	if _, ok := w.Header()[HeaderXFrameOptions]; ok {
+		t.Fatalf("x-frame-options was not overridden")
+	}
+	if v := w.Header().Get(HeaderXContentTypeOptions); v != "nosniff" {
+		t.Fatalf("x-content-type-options wanted: nosniff. got: %s", v)
+	}
+}
@@ -0,0 +1,274 @@
+package prate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+type StaticOptions struct {
+	// Served for directory requests. Defaults to "index.html".
+	Index string
+	// Serve the root index file for missing paths without an
+	// extension so client side routers can handle them
+	SPAFallback bool
+	// Sets Cache-Control max-age when positive
+	MaxAge time.Duration
+	// Middlewares not applied to the files
+	ExcludeMiddlewares []string
+}
+
+type staticEncoding struct {
+	encoding, ext string
+}
+
+// Precompressed variants looked up next to every file, in order
+// of preference
+var staticEncodings = []staticEncoding{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+type staticFiles struct {
+	fsys fs.FS
+	opts StaticOptions
+	mu   sync.Mutex
+	// Content ETags by name, size and modification time
+	etags map[string]string
+}
+
+// Serves the files of fsys under prefix with the default
+// StaticOptions. See StaticWithOptions.
+func (app *App) Static(prefix string, fsys fs.FS) error {
+	return app.StaticWithOptions(prefix, fsys, StaticOptions{})
+}
+
+// Serves the files of fsys, such as an embed.FS or os.DirFS, under
+// prefix for GET and HEAD requests through the middlewares of the
+// app. Responses carry Content-Type, ETag and Last-Modified when
+// known, honour conditional and range requests and use .br or .gz
+// siblings of a file when the client accepts them. A prefix of "/"
+// serves every path no other endpoint matches.
+func (app *App) StaticWithOptions(prefix string, fsys fs.FS, opts StaticOptions) error {
+	if app == nil || app.router == nil {
+		return wrapErr(fmt.Errorf("app not initialized"))
+	}
+	if fsys == nil {
+		return wrapErr(fmt.Errorf("nil fs.FS"))
+	}
+	if opts.Index == "" {
+		opts.Index = "index.html"
+	}
+	sf := &staticFiles{
+		fsys:  fsys,
+		opts:  opts,
+		etags: map[string]string{},
+	}
+	prefix = "/" + strings.Trim(prefix, "/")
+	ec := NewEndpointConfig(
+		strings.TrimSuffix(prefix, "/")+"/*filepath", sf.handler,
+	).WithExclude(opts.ExcludeMiddlewares...)
+
+	if prefix != "/" {
+		app.GET(ec)
+		app.HEAD(ec)
+		return nil
+	}
+	// A catch-all at the root would conflict with every other
+	// route so the files are served for unmatched paths instead
+	ec.method = http.MethodGet
+	app.registerEndpoint(ec, func(_ string, h httprouter.Handle) {
+		nf := app.router.NotFound
+		app.router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				if nf != nil {
+					nf.ServeHTTP(w, r)
+				} else {
+					http.NotFound(w, r)
+				}
+				return
+			}
+			h(w, r, httprouter.Params{{Key: "filepath", Value: r.URL.Path}})
+		})
+	})
+	return nil
+}
+
+func (sf *staticFiles) handler(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+	name := strings.TrimPrefix(path.Clean("/"+rd.Params.ByName("filepath")), "/")
+	if name == "" {
+		name = "."
+	}
+
+	f, fi, err := sf.open(name)
+	if err == nil && fi.IsDir() {
+		f.Close()
+		name = path.Join(name, sf.opts.Index)
+		f, fi, err = sf.open(name)
+	}
+	if errors.Is(err, fs.ErrNotExist) && sf.opts.SPAFallback && path.Ext(name) == "" {
+		name = sf.opts.Index
+		f, fi, err = sf.open(name)
+	}
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+			return nil, ErrNotFound
+		}
+		return nil, wrapErr(err)
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, ErrNotFound
+	}
+	defer func() {
+		f.Close()
+	}()
+
+	hd := rc.ResponseWriter.Header()
+	ct := ContentTypeFromExtension(path.Ext(name))
+	if ct == "" {
+		ct = mime.TypeByExtension(path.Ext(name))
+	}
+	if ct != "" {
+		hd.Set(HeaderContentType, ct)
+	}
+	if sf.opts.MaxAge > 0 {
+		hd.Set(HeaderCacheControl, fmt.Sprintf("public, max-age=%d", int(sf.opts.MaxAge/time.Second)))
+	}
+
+	// The variant served depends on Accept-Encoding
+	if enc, cf, cfi := sf.precompressed(rc.Request, name); cf != nil {
+		addVary(hd, HeaderAcceptEncoding)
+		f.Close()
+		f, fi, name = cf, cfi, name+enc.ext
+		hd.Set(HeaderContentEncoding, enc.encoding)
+	} else {
+		for _, e := range staticEncodings {
+			if sf.exists(name + e.ext) {
+				addVary(hd, HeaderAcceptEncoding)
+				break
+			}
+		}
+	}
+
+	rs, err := readSeeker(f)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	etag, err := sf.etag(name, fi, rs)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	hd.Set(HeaderETag, etag)
+	if err := rc.ServeContent(name, fi.ModTime(), rs); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (sf *staticFiles) open(name string) (fs.File, fs.FileInfo, error) {
+	f, err := sf.fsys.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, fi, nil
+}
+
+func (sf *staticFiles) exists(name string) bool {
+	fi, err := fs.Stat(sf.fsys, name)
+	return err == nil && !fi.IsDir()
+}
+
+// Opens the preferred precompressed sibling of name the client
+// accepts, if any
+func (sf *staticFiles) precompressed(r *http.Request, name string) (staticEncoding, fs.File, fs.FileInfo) {
+	accepted := acceptedEncodings(r.Header.Get(HeaderAcceptEncoding))
+	for _, e := range staticEncodings {
+		if !accepted[e.encoding] {
+			continue
+		}
+		f, fi, err := sf.open(name + e.ext)
+		if err != nil {
+			continue
+		}
+		if fi.IsDir() {
+			f.Close()
+			continue
+		}
+		return e, f, fi
+	}
+	return staticEncoding{}, nil, nil
+}
+
+// Encodings listed in Accept-Encoding without q=0
+func acceptedEncodings(v string) map[string]bool {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(v, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if q := strings.TrimSpace(params); strings.HasPrefix(q, "q=") {
+			if v, err := strconv.ParseFloat(q[2:], 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		if name == "" {
+			continue
+		}
+		accepted[strings.ToLower(name)] = true
+	}
+	return accepted
+}
+
+func readSeeker(f fs.File) (io.ReadSeeker, error) {
+	if rs, ok := f.(io.ReadSeeker); ok {
+		return rs, nil
+	}
+	bs, err := io.ReadAll(f)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	return bytes.NewReader(bs), nil
+}
+
+// Strong ETag of the content. Files of an embed.FS have no
+// modification time so the content is hashed once and remembered.
+func (sf *staticFiles) etag(name string, fi fs.FileInfo, rs io.ReadSeeker) (string, error) {
+	key := fmt.Sprintf("%s|%d|%d", name, fi.Size(), fi.ModTime().UnixNano())
+	sf.mu.Lock()
+	etag, ok := sf.etags[key]
+	sf.mu.Unlock()
+	if ok {
+		return etag, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, rs); err != nil {
+		return "", wrapErr(err)
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return "", wrapErr(err)
+	}
+	etag = `"` + base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:16]) + `"`
+	sf.mu.Lock()
+	sf.etags[key] = etag
+	sf.mu.Unlock()
+	return etag, nil
+}
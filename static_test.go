@@ -0,0 +1,104 @@
+package prate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func TestStatic(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.html":      {Data: []byte("<html>app</html>")},
+		"app.js":          {Data: []byte("console.log('hi')"), ModTime: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)},
+		"app.js.br":       {Data: []byte("brotli")},
+		"docs/index.html": {Data: []byte("docs")},
+	}
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.GET(NewEndpointConfig("/api/ping", func(*RequestCtx, *RequestData) (protoreflect.ProtoMessage, error) {
+		return nil, nil
+	}))
+	if err := app.Apply(&Middleware{
+		ID: "marker",
+		Handler: func(h Handler) Handler {
+			return func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+				rc.ResponseWriter.Header().Set("X-Marker", "1")
+				return h(rc, rd)
+			}
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.StaticWithOptions("/assets", fsys, StaticOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.StaticWithOptions("/", fsys, StaticOptions{SPAFallback: true}); err != nil {
+		t.Fatal(err)
+	}
+	app.mountEndpoints()
+
+	get := func(path string, hs ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		for i := 0; i+1 < len(hs); i += 2 {
+			r.Header.Set(hs[i], hs[i+1])
+		}
+		return testServe(app, r)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		headers  []string
+		code     int
+		body     string
+		encoding string
+	}{
+		{"file", "/assets/app.js", nil, StatusOK, "console.log('hi')", ""},
+		{"precompressed", "/assets/app.js", []string{HeaderAcceptEncoding, "gzip, br"}, StatusOK, "brotli", "br"},
+		{"refused encoding", "/assets/app.js", []string{HeaderAcceptEncoding, "br;q=0"}, StatusOK, "console.log('hi')", ""},
+		{"range", "/assets/app.js", []string{HeaderRange, "bytes=0-6"}, StatusPartialContent, "console", ""},
+		{"directory index", "/assets/docs/", nil, StatusOK, "docs", ""},
+		{"missing", "/assets/missing.js", nil, StatusNotFound, "", ""},
+		{"root", "/app.js", nil, StatusOK, "console.log('hi')", ""},
+		{"spa fallback", "/users/42", nil, StatusOK, "<html>app</html>", ""},
+		{"no fallback with extension", "/users/42.png", nil, StatusNotFound, "", ""},
+		{"other routes", "/api/ping", nil, StatusOK, "", ""},
+	}
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			w := get(tst.path, tst.headers...)
+			if w.Code != tst.code {
+				t.Fatalf("code wanted: %d. got: %d", tst.code, w.Code)
+			}
+			if w.Header().Get("X-Marker") != "1" {
+				t.Fatal("middleware not applied")
+			}
+			if tst.code >= 300 {
+				return
+			}
+			if w.Body.String() != tst.body {
+				t.Fatalf("body wanted: %q. got: %q", tst.body, w.Body.String())
+			}
+			if w.Header().Get(HeaderContentEncoding) != tst.encoding {
+				t.Fatalf("encoding wanted: %q. got: %q", tst.encoding, w.Header().Get(HeaderContentEncoding))
+			}
+		})
+	}
+
+	w := get("/assets/app.js")
+	if ct := w.Header().Get(HeaderContentType); ct != "application/javascript" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	if w.Header().Get(HeaderLastModified) == "" {
+		t.Fatal("missing Last-Modified")
+	}
+	if w := get("/assets/app.js", HeaderIfNoneMatch, w.Header().Get(HeaderETag)); w.Code != StatusNotModified {
+		t.Fatalf("if-none-match wanted: %d. got: %d", StatusNotModified, w.Code)
+	}
+}
@@ -0,0 +1,267 @@
+package prate
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Returns the timeout configured on the server for the endpoint.
+// 0 when there is none.
+func (ep *endpoint) limit() time.Duration {
+	if ep.config.Timeout <= 0 && ep.app != nil {
+		return ep.app.maxHandlerTimeout
+	}
+	return ep.config.Timeout
+}
+
+// Returns the deadline for a request. A client supplied timeout
+// applies, clamped to the one configured on the server if any.
+func (ep *endpoint) timeout(r *http.Request) time.Duration {
+	limit := ep.limit()
+	header := HeaderXRequestTimeout
+	if ep.app != nil {
+		header = ep.app.deadlineHeader
+	}
+
+	client, ok := parseTimeoutHeader(r.Header.Get(header))
+	if call := rpcCallFrom(r); call != nil && call.timeout > 0 {
+		client, ok = call.timeout, true
+	}
+	if !ok {
+		return limit
+	}
+	if limit > 0 && client > limit {
+		return limit
+	}
+	return client
+}
+
+func parseTimeoutHeader(v string) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if ms <= 0 {
+			return 0, false
+		}
+		return time.Duration(ms) * time.Millisecond, true
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+type handlerResult struct {
+	panicked interface{}
+}
+
+const (
+	handlerRunning int32 = iota
+	handlerFinished
+	handlerAbandoned
+)
+
+// Runs the handler on its own goroutine. Returns false when the
+// deadline fired first, in which case the handler is left running
+// and everything it references must be considered owned by it.
+// release, if not nil, is then called once the handler returns.
+func (ep *endpoint) serveWithTimeout(tw *timeoutWriter, rc *RequestCtx, rd *RequestData, release func()) bool {
+	done := make(chan handlerResult, 1)
+	ctx := rc.Context()
+	r := rc.Request
+	// Settles whether the handler finished or was abandoned when
+	// both happen at once
+	var state int32
+	go func() {
+		var res handlerResult
+		defer func() {
+			if p := recover(); p != nil {
+				res.panicked = p
+			}
+			if atomic.CompareAndSwapInt32(&state, handlerRunning, handlerFinished) {
+				done <- res
+				return
+			}
+			if release != nil {
+				release()
+			}
+		}()
+		resp, err := ep.handler(rc, rd)
+		writeResponse(rc, resp, err)
+	}()
+
+	var res handlerResult
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+		if atomic.CompareAndSwapInt32(&state, handlerRunning, handlerAbandoned) {
+			tw.timeout(r)
+			return false
+		}
+		// Finished just as the deadline fired
+		res = <-done
+	}
+	if res.panicked != nil {
+		// Let the router's panic handler deal with it
+		panic(res.panicked)
+	}
+	tw.flush()
+	return true
+}
+
+// Buffers the response of a handler running under a deadline so
+// the response can be swapped for a 504 if the deadline fires. A
+// Flush commits what was buffered and streams the rest, after which
+// the response can no longer be swapped.
+type timeoutWriter struct {
+	w  http.ResponseWriter
+	mu sync.Mutex
+	h  http.Header
+	// Copy of h as of the last call to Header. The handler goroutine
+	// may still be changing h when the deadline fires, so the 504
+	// gets this instead.
+	seen        http.Header
+	buf         bytes.Buffer
+	code        int
+	wroteHeader bool
+	committed   bool
+	timedOut    bool
+}
+
+func newTimeoutWriter(w http.ResponseWriter) *timeoutWriter {
+	return &timeoutWriter{
+		w: w,
+		h: http.Header{},
+	}
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		// Kept away from the 504 already sent
+		return http.Header{}
+	}
+	tw.seen = tw.h.Clone()
+	return tw.h
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	tw.code = code
+	tw.wroteHeader = true
+}
+
+func (tw *timeoutWriter) Write(bs []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !tw.wroteHeader {
+		tw.code = StatusOK
+		tw.wroteHeader = true
+	}
+	if tw.committed {
+		return tw.w.Write(bs)
+	}
+	return tw.buf.Write(bs)
+}
+
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	tw.commit()
+	if f, ok := tw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Sends the headers and whatever is buffered. Must be called with
+// mu held.
+func (tw *timeoutWriter) commit() {
+	if !tw.committed {
+		dst := tw.w.Header()
+		for k, vs := range tw.h {
+			dst[k] = vs
+		}
+		if !tw.wroteHeader {
+			tw.code = StatusOK
+			tw.wroteHeader = true
+		}
+		tw.w.WriteHeader(tw.code)
+		tw.committed = true
+	}
+	if tw.buf.Len() == 0 {
+		return
+	}
+	if _, err := tw.w.Write(tw.buf.Bytes()); err != nil {
+		log.Println(wrapErr(err))
+	}
+	tw.buf.Reset()
+}
+
+func (tw *timeoutWriter) flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.commit()
+}
+
+// Headers describing the handler's response rather than the
+// request, left off the 504
+var timeoutDropHeaders = []string{
+	HeaderContentType,
+	HeaderContentLength,
+	HeaderContentEncoding,
+	HeaderETag,
+	HeaderLastModified,
+	HeaderLocation,
+}
+
+// Blocks any further write from the handler and answers with a 504
+// in its place, keeping headers such as CORS ones set on the way in
+// as far as the handler was seen to set them.
+// A committed response is left as is.
+func (tw *timeoutWriter) timeout(r *http.Request) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.timedOut = true
+	if tw.committed {
+		return
+	}
+
+	dst := tw.w.Header()
+	for k, vs := range tw.seen {
+		dst[k] = vs
+	}
+	for _, k := range timeoutDropHeaders {
+		dst.Del(k)
+	}
+	rc := &RequestCtx{
+		Request:        r,
+		ResponseWriter: NewResponseWriter(tw.w),
+	}
+	if err := errorHandler(rc, NewError(
+		StatusGatewayTimeout,
+		httpStatusMessage[StatusGatewayTimeout],
+		"handler did not complete within its deadline",
+	)); err != nil {
+		log.Println(wrapErr(err))
+	}
+}
@@ -0,0 +1,139 @@
+package prate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daimaou92/prate/pb/fortest"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func TestEndpointTimeout(t *testing.T) {
+	app, err := New(AppOptions{MaxHandlerTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	defer close(release)
+	lateWrite := make(chan error, 1)
+	app.GET(NewEndpointConfig("/slow", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		<-release
+		_, err := rc.ResponseWriter.Write([]byte("late"))
+		lateWrite <- err
+		return nil, nil
+	}).WithTimeout(20 * time.Millisecond))
+	app.GET(NewEndpointConfig("/deadline", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		dl, ok := rc.Context().Deadline()
+		if !ok {
+			return nil, ErrInternalServerError
+		}
+		return &fortest.TestRes{Value: time.Until(dl).Round(time.Second).String()}, nil
+	}))
+	app.GET(NewEndpointConfig("/fast", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		rc.ResponseWriter.Header().Set("X-Fast", "1")
+		return &fortest.TestRes{}, nil
+	}).WithTimeout(time.Second))
+	app.mountEndpoints()
+
+	w := testServe(app, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	if w.Code != StatusGatewayTimeout {
+		t.Fatalf("statuscode wanted: %d. got: %d", StatusGatewayTimeout, w.Code)
+	}
+	release <- struct{}{}
+	if err := <-lateWrite; err == nil || !strings.Contains(err.Error(), http.ErrHandlerTimeout.Error()) {
+		t.Fatalf("late write wanted: %v. got: %v", http.ErrHandlerTimeout, err)
+	}
+
+	w = testServe(app, httptest.NewRequest(http.MethodGet, "/fast", nil))
+	if w.Code != StatusOK || w.Header().Get("X-Fast") != "1" {
+		t.Fatalf("buffered response not flushed: %d %v", w.Code, w.Header())
+	}
+
+	for _, tst := range []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", time.Second},
+		{"200", 0},
+		{"5s", time.Second},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/deadline", nil)
+		if tst.header != "" {
+			r.Header.Set(HeaderXRequestTimeout, tst.header)
+		}
+		w := testServe(app, r)
+		if w.Code != StatusOK {
+			t.Fatalf("statuscode wanted: %d. got: %d", StatusOK, w.Code)
+		}
+		if got := w.Body.String(); !strings.Contains(got, tst.want.String()) {
+			t.Fatalf("header %q deadline wanted: %s. got body: %q", tst.header, tst.want, got)
+		}
+	}
+
+	// Without a server limit the client deadline applies as is
+	app, err = New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.GET(NewEndpointConfig("/deadline", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		dl, ok := rc.Context().Deadline()
+		if !ok || time.Until(dl) > 5*time.Second {
+			return nil, ErrInternalServerError
+		}
+		return &fortest.TestRes{}, nil
+	}))
+	app.mountEndpoints()
+	r := httptest.NewRequest(http.MethodGet, "/deadline", nil)
+	r.Header.Set(HeaderXRequestTimeout, "5s")
+	if w := testServe(app, r); w.Code != StatusOK {
+		t.Fatalf("client deadline without a server limit wanted: %d. got: %d", StatusOK, w.Code)
+	}
+}
+
+func TestTimeoutWriter(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	defer close(release)
+	app.GET(NewEndpointConfig("/stream", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		rc.ResponseWriter.Write([]byte("a"))
+		rc.ResponseWriter.Flush()
+		rc.ResponseWriter.Write([]byte("b"))
+		return nil, nil
+	}).WithTimeout(time.Second))
+	app.GET(NewEndpointConfig("/slow", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		rc.ResponseWriter.Header().Set(HeaderContentType, "text/csv")
+		<-release
+		return nil, nil
+	}).WithTimeout(20 * time.Millisecond))
+	if err := app.Apply(&Middleware{
+		ID: "cors",
+		Handler: func(h Handler) Handler {
+			return func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+				rc.ResponseWriter.Header().Set("Access-Control-Allow-Origin", "*")
+				return h(rc, rd)
+			}
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	app.mountEndpoints()
+
+	w := testServe(app, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	if !w.Flushed || w.Body.String() != "ab" {
+		t.Fatalf("flushed stream wanted \"ab\". got: %v %q", w.Flushed, w.Body.String())
+	}
+
+	w = testServe(app, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	if w.Code != StatusGatewayTimeout || w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("timeout wanted: %d with cors headers. got: %d %v", StatusGatewayTimeout, w.Code, w.Header())
+	}
+	if w.Header().Get(HeaderContentType) == "text/csv" {
+		t.Fatal("handler content type kept on the timeout response")
+	}
+}
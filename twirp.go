@@ -0,0 +1,71 @@
+package prate
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// HTTP status of a Twirp error, from the Twirp wire protocol spec
+var twirpStatus = [...]int{
+	StatusOK, StatusRequestTimeout, StatusInternalServerError, StatusBadRequest, StatusRequestTimeout,
+	StatusNotFound, StatusConflict, StatusForbidden, StatusTooManyRequests,
+	StatusPreconditionFailed, StatusConflict, StatusBadRequest, StatusNotImplemented,
+	StatusInternalServerError, StatusServiceUnavailable, StatusInternalServerError,
+	StatusUnauthorized,
+}
+
+func twirpCode(c rpcCode) string {
+	if c == codeDataLoss {
+		return "dataloss"
+	}
+	return c.String()
+}
+
+// Registers ec as a Twirp method at /twirp/<service>/<method>,
+// where service is fully qualified, for example
+// "example.haberdasher.Haberdasher" and "MakeHat". Requests are
+// application/protobuf or application/json and answered in kind,
+// with errors as Twirp JSON errors. The Path of ec is ignored.
+// Everything else, RequestPayloadType, middlewares and policies
+// included, works as for App.POST.
+func (app *App) Twirp(service, method string, ec EndpointConfig) error {
+	if app == nil || app.router == nil {
+		return wrapErr(fmt.Errorf("app not initialized"))
+	}
+	if service == "" || method == "" || strings.ContainsAny(service+method, "/") {
+		return wrapErr(fmt.Errorf("invalid twirp method %s/%s", service, method))
+	}
+	ec.Path = "/twirp/" + service + "/" + method
+	ec.twirp = true
+	app.POST(ec)
+	return nil
+}
+
+func detectTwirp(r *http.Request) *rpcCall {
+	switch ct := mediaType(r); ContentType(ct) {
+	case ContentTypeTwirpProto:
+		return &rpcCall{protocol: rpcTwirp, contentType: ct}
+	case ContentTypeJSON:
+		return &rpcCall{
+			protocol:    rpcTwirp,
+			json:        true,
+			contentType: ct,
+			marshal:     protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true},
+		}
+	}
+	return nil
+}
+
+func writeTwirpError(w http.ResponseWriter, code string, status int, msg string) {
+	bs, _ := json.Marshal(struct {
+		Code string `json:"code"`
+		Msg  string `json:"msg"`
+	}{code, msg})
+	w.Header().Set(HeaderContentType, ContentTypeJSON.String())
+	w.WriteHeader(status)
+	w.Write(bs)
+}
@@ -0,0 +1,87 @@
+package prate
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daimaou92/prate/pb/fortest"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func TestTwirp(t *testing.T) {
+	app, err := New(AppOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Twirp("prate.test.Echo", "Echo", NewEndpointConfig("", func(rc *RequestCtx, rd *RequestData) (protoreflect.ProtoMessage, error) {
+		req := rd.Body.(*fortest.TestReq)
+		switch req.Key {
+		case "missing":
+			return nil, NewError(StatusNotFound, "no such key")
+		case "taken":
+			return nil, ErrConflict
+		}
+		return &fortest.TestRes{Key: req.Key, Value: req.Value}, nil
+	}).WithRequestPayloadType(&fortest.TestReq{})); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Twirp("bad/name", "Echo", EndpointConfig{}); err == nil {
+		t.Fatal("invalid service registered")
+	}
+	app.mountEndpoints()
+	const path = "/twirp/prate.test.Echo/Echo"
+
+	bs, _ := proto.Marshal(&fortest.TestReq{Key: "a", Value: "proto"})
+	r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(bs))
+	r.Header.Set(HeaderContentType, ContentTypeTwirpProto.String())
+	w := testServe(app, r)
+	var res fortest.TestRes
+	if w.Code != StatusOK || w.Header().Get(HeaderContentType) != ContentTypeTwirpProto.String() {
+		t.Fatalf("protobuf wanted: %d. got: %d %q", StatusOK, w.Code, w.Header().Get(HeaderContentType))
+	}
+	if err := proto.Unmarshal(w.Body.Bytes(), &res); err != nil || res.Value != "proto" {
+		t.Fatalf("unexpected response %v %v", &res, err)
+	}
+
+	tests := []struct {
+		name, contentType, body string
+		code                    int
+		want                    map[string]interface{}
+	}{
+		{"json", "application/json; charset=utf-8", `{"key":"a"}`, StatusOK, map[string]interface{}{"key": "a", "value": ""}},
+		{"not found", "application/json", `{"key":"missing"}`, StatusNotFound, map[string]interface{}{"code": "not_found", "msg": "no such key"}},
+		{"conflict", "application/json", `{"key":"taken"}`, StatusConflict, map[string]interface{}{"code": "already_exists", "msg": "Conflict"}},
+		{"malformed", "application/json", `{"key":`, StatusBadRequest, nil},
+		{"bad route", "text/plain", `hi`, StatusNotFound, nil},
+	}
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(tst.body))
+			r.Header.Set(HeaderContentType, tst.contentType)
+			w := testServe(app, r)
+			if w.Code != tst.code {
+				t.Fatalf("wanted: %d. got: %d %s", tst.code, w.Code, w.Body.String())
+			}
+			got := map[string]interface{}{}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if tst.want == nil {
+				if got["code"] != strings.ReplaceAll(tst.name, " ", "_") {
+					t.Fatalf("unexpected error %v", got)
+				}
+				return
+			}
+			for k, v := range tst.want {
+				if got[k] != v {
+					t.Fatalf("%s wanted: %v. got: %v", k, v, got[k])
+				}
+			}
+		})
+	}
+}